@@ -0,0 +1,141 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gopkg.in/yaml.v3"
+)
+
+// servedModelHeader reports the OpenRouter model that produced a response
+const servedModelHeader = "X-Served-Model"
+
+// AliasTargets are the models an alias stands for, tried in order. In the
+// config file it is either a single model or a list.
+type AliasTargets []string
+
+func (t *AliasTargets) UnmarshalYAML(node *yaml.Node) error {
+	switch node.Kind {
+	case yaml.ScalarNode:
+		*t = AliasTargets{node.Value}
+		return nil
+	case yaml.SequenceNode:
+		var targets []string
+		if err := node.Decode(&targets); err != nil {
+			return err
+		}
+		*t = targets
+		return nil
+	}
+	return fmt.Errorf("line %d: alias target must be a model or a list of models", node.Line)
+}
+
+func (t AliasTargets) MarshalYAML() (interface{}, error) {
+	if len(t) == 1 {
+		return t[0], nil
+	}
+	return []string(t), nil
+}
+
+// lookupAlias returns the targets of an alias. Ollama clients often add the
+// ":latest" tag, so "coder:latest" also finds the alias "coder".
+func lookupAlias(name string) (AliasTargets, bool) {
+	aliases := currentConfig().Aliases
+	if targets, ok := aliases[name]; ok {
+		return targets, true
+	}
+	if base := strings.TrimSuffix(name, ":latest"); base != name {
+		targets, ok := aliases[base]
+		return targets, ok
+	}
+	return nil, false
+}
+
+// requestedModels returns the models to try for a requested name: the targets
+// of an alias, or the name itself. An exact model ID takes precedence over an
+// alias of the same name.
+func requestedModels(name string) []string {
+	if _, ok := modelCatalog.Lookup(name); ok {
+		return []string{name}
+	}
+	if targets, ok := lookupAlias(name); ok {
+		return targets
+	}
+	return []string{name}
+}
+
+// allowsRequestedModel reports whether the client may use a model, at least
+// one target of an alias, or a virtual model
+func allowsRequestedModel(client *ClientKey, name string) bool {
+	if client.AllowsModel(name) {
+		return true
+	}
+	// Routing to a virtual model only considers models the client may use
+	if _, ok := lookupVirtualModel(name); ok {
+		return true
+	}
+	targets, ok := lookupAlias(name)
+	if !ok {
+		return false
+	}
+	for _, target := range targets {
+		if client.AllowsModel(target) {
+			return true
+		}
+	}
+	return false
+}
+
+// listedAliases returns the aliases the client may use, sorted by name
+func listedAliases(client *ClientKey) []string {
+	var names []string
+	for name := range currentConfig().Aliases {
+		if allowsRequestedModel(client, name) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// aliasTags returns the /api/tags entries of the aliases
+func aliasTags(client *ClientKey) []map[string]interface{} {
+	currentTime := time.Now().Format(time.RFC3339)
+	var tags []map[string]interface{}
+	for _, name := range listedAliases(client) {
+		targets, _ := lookupAlias(name)
+		tags = append(tags, map[string]interface{}{
+			"name":        name,
+			"model":       name,
+			"modified_at": currentTime,
+			"size":        270898672,
+			"digest":      "9077fe9d2ae1a4a41a868836b56b8163731a8fe16621397028c2c76f838c6907",
+			"details": map[string]interface{}{
+				"parent_model":       targets[0],
+				"format":             "gguf",
+				"family":             "alias",
+				"families":           []string{"alias"},
+				"parameter_size":     "varies",
+				"quantization_level": "Q4_K_M",
+			},
+		})
+	}
+	return tags
+}
+
+// aliasModels returns the /v1/models entries of the aliases
+func aliasModels(client *ClientKey) []gin.H {
+	var models []gin.H
+	for _, name := range listedAliases(client) {
+		models = append(models, gin.H{
+			"id":       name,
+			"object":   "model",
+			"created":  time.Now().Unix(),
+			"owned_by": "openrouter",
+		})
+	}
+	return models
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// useCatalog makes a catalog of the given models current for the test
+func useCatalog(t *testing.T, models ...ModelRecord) {
+	t.Helper()
+	s := NewCatalogService("", time.Hour, func() string { return "" })
+	s.store(&ModelCatalog{Version: modelCatalogVersion, FetchedAt: time.Now(), Models: models})
+	prev := modelCatalog
+	modelCatalog = s
+	t.Cleanup(func() { modelCatalog = prev })
+}
+
+func TestAliasTargetsYAML(t *testing.T) {
+	tests := []struct {
+		name    string
+		yaml    string
+		want    map[string]AliasTargets
+		wantErr bool
+	}{
+		{name: "single model", yaml: "coder: qwen/qwen3-coder", want: map[string]AliasTargets{"coder": {"qwen/qwen3-coder"}}},
+		{name: "list", yaml: "coder: [qwen/qwen3-coder, openai/gpt-4o]", want: map[string]AliasTargets{"coder": {"qwen/qwen3-coder", "openai/gpt-4o"}}},
+		{name: "mapping", yaml: "coder: {model: x}", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got map[string]AliasTargets
+			err := yaml.Unmarshal([]byte(tt.yaml), &got)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Unmarshal() error = %v, want error %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Unmarshal() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRequestedModels(t *testing.T) {
+	useConfig(t, func(c *Config) {
+		c.Aliases = map[string]AliasTargets{
+			"coder":         {"qwen/qwen3-coder", "openai/gpt-4o"},
+			"openai/gpt-4o": {"openai/gpt-4o-mini"}, // shadowed by the real model
+		}
+	})
+	useCatalog(t, ModelRecord{ID: "openai/gpt-4o"}, ModelRecord{ID: "qwen/qwen3-coder"})
+
+	tests := []struct {
+		name      string
+		requested string
+		want      []string
+	}{
+		{name: "alias", requested: "coder", want: []string{"qwen/qwen3-coder", "openai/gpt-4o"}},
+		{name: "alias with latest tag", requested: "coder:latest", want: []string{"qwen/qwen3-coder", "openai/gpt-4o"}},
+		{name: "model ID wins over alias", requested: "openai/gpt-4o", want: []string{"openai/gpt-4o"}},
+		{name: "not an alias", requested: "gpt-4o", want: []string{"gpt-4o"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := requestedModels(tt.requested); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("requestedModels(%q) = %v, want %v", tt.requested, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAllowsRequestedModel(t *testing.T) {
+	useConfig(t, func(c *Config) {
+		c.Aliases = map[string]AliasTargets{
+			"coder": {"qwen/qwen3-coder", "openai/gpt-4o"},
+			"fast":  {"google/gemini-flash"},
+		}
+	})
+	client := &ClientKey{Name: "ci", AllowedModels: []string{"openai/*"}}
+
+	tests := []struct {
+		requested string
+		allowed   bool
+	}{
+		{requested: "openai/gpt-4o", allowed: true},
+		{requested: "coder", allowed: true}, // one target is allowed
+		{requested: "fast", allowed: false},
+		{requested: "google/gemini-flash", allowed: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.requested, func(t *testing.T) {
+			if got := allowsRequestedModel(client, tt.requested); got != tt.allowed {
+				t.Errorf("allowsRequestedModel(%q) = %v, want %v", tt.requested, got, tt.allowed)
+			}
+		})
+	}
+	if got := listedAliases(client); !reflect.DeepEqual(got, []string{"coder"}) {
+		t.Errorf("listedAliases() = %v, want [coder]", got)
+	}
+	if got := listedAliases(nil); !reflect.DeepEqual(got, []string{"coder", "fast"}) {
+		t.Errorf("listedAliases() without auth = %v, want [coder fast]", got)
+	}
+}
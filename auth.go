@@ -0,0 +1,326 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const clientKeyPrefix = "olp-"
+
+var (
+	ErrInvalidClientKey = errors.New("invalid API key")
+	ErrExpiredClientKey = errors.New("API key expired")
+)
+
+// ClientKey is an inbound API key issued to a client of the proxy
+type ClientKey struct {
+	ID            int64      `json:"id"`
+	Name          string     `json:"name"`
+	Prefix        string     `json:"prefix"`
+	CreatedAt     time.Time  `json:"created_at"`
+	ExpiresAt     *time.Time `json:"expires_at,omitempty"`
+	AllowedModels []string   `json:"allowed_models,omitempty"`
+	Disabled      bool       `json:"disabled"`
+}
+
+// AllowsModel checks the model against the key's allowed patterns. Patterns are
+// globs matched against both the full model ID and its display name. A nil key
+// (auth disabled) or an empty pattern list allows every model.
+func (k *ClientKey) AllowsModel(model string) bool {
+	if k == nil || len(k.AllowedModels) == 0 {
+		return true
+	}
+	parts := strings.Split(model, "/")
+	displayName := parts[len(parts)-1]
+	for _, pattern := range k.AllowedModels {
+		if ok, _ := path.Match(pattern, model); ok {
+			return true
+		}
+		if ok, _ := path.Match(pattern, displayName); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Expired reports whether the key is past its expiry
+func (k *ClientKey) Expired() bool {
+	return k.ExpiresAt != nil && time.Now().After(*k.ExpiresAt)
+}
+
+// ClientName returns the name used to tag logs and accounting
+func (k *ClientKey) ClientName() string {
+	if k == nil {
+		return "anonymous"
+	}
+	return k.Name
+}
+
+// ClientKeyStore keeps hashed client keys in SQLite
+type ClientKeyStore struct {
+	db *sql.DB
+}
+
+func NewClientKeyStore(path string) (*ClientKeyStore, error) {
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = db.Exec(`CREATE TABLE IF NOT EXISTS client_keys (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		name TEXT NOT NULL UNIQUE,
+		key_hash TEXT NOT NULL UNIQUE,
+		prefix TEXT NOT NULL,
+		created_at INTEGER NOT NULL,
+		expires_at INTEGER DEFAULT 0,
+		allowed_models TEXT DEFAULT '',
+		disabled INTEGER DEFAULT 0
+	)`); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &ClientKeyStore{db: db}, nil
+}
+
+func (s *ClientKeyStore) Close() error { return s.db.Close() }
+
+func hashClientKey(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// Create issues a new key and returns its secret. The secret is only available
+// here, the store keeps its hash.
+func (s *ClientKeyStore) Create(name string, ttl time.Duration, allowedModels []string) (string, *ClientKey, error) {
+	if name == "" {
+		return "", nil, fmt.Errorf("key name is required")
+	}
+	buf := make([]byte, 24)
+	if _, err := rand.Read(buf); err != nil {
+		return "", nil, err
+	}
+	secret := clientKeyPrefix + hex.EncodeToString(buf)
+
+	key := &ClientKey{
+		Name:          name,
+		Prefix:        secret[:len(clientKeyPrefix)+6],
+		CreatedAt:     time.Now().UTC().Truncate(time.Second),
+		AllowedModels: allowedModels,
+	}
+	var expiresAt int64
+	if ttl > 0 {
+		t := key.CreatedAt.Add(ttl)
+		key.ExpiresAt = &t
+		expiresAt = t.Unix()
+	}
+
+	res, err := s.db.Exec(`INSERT INTO client_keys(name, key_hash, prefix, created_at, expires_at, allowed_models) VALUES(?, ?, ?, ?, ?, ?)`,
+		name, hashClientKey(secret), key.Prefix, key.CreatedAt.Unix(), expiresAt, strings.Join(allowedModels, ","))
+	if err != nil {
+		return "", nil, err
+	}
+	key.ID, _ = res.LastInsertId()
+	return secret, key, nil
+}
+
+func scanClientKey(row interface{ Scan(...any) error }) (*ClientKey, error) {
+	var key ClientKey
+	var createdAt, expiresAt int64
+	var models string
+	if err := row.Scan(&key.ID, &key.Name, &key.Prefix, &createdAt, &expiresAt, &models, &key.Disabled); err != nil {
+		return nil, err
+	}
+	key.CreatedAt = time.Unix(createdAt, 0).UTC()
+	if expiresAt > 0 {
+		t := time.Unix(expiresAt, 0).UTC()
+		key.ExpiresAt = &t
+	}
+	if models != "" {
+		key.AllowedModels = strings.Split(models, ",")
+	}
+	return &key, nil
+}
+
+const clientKeyColumns = `id, name, prefix, created_at, expires_at, allowed_models, disabled`
+
+// Lookup returns the key matching secret, or an error if it is unknown,
+// disabled or expired
+func (s *ClientKeyStore) Lookup(secret string) (*ClientKey, error) {
+	row := s.db.QueryRow(`SELECT `+clientKeyColumns+` FROM client_keys WHERE key_hash=?`, hashClientKey(secret))
+	key, err := scanClientKey(row)
+	if err == sql.ErrNoRows {
+		return nil, ErrInvalidClientKey
+	}
+	if err != nil {
+		return nil, err
+	}
+	if key.Disabled {
+		return nil, ErrInvalidClientKey
+	}
+	if key.Expired() {
+		return nil, ErrExpiredClientKey
+	}
+	return key, nil
+}
+
+// List returns every key, including disabled and expired ones
+func (s *ClientKeyStore) List() ([]*ClientKey, error) {
+	rows, err := s.db.Query(`SELECT ` + clientKeyColumns + ` FROM client_keys ORDER BY name`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var keys []*ClientKey
+	for rows.Next() {
+		key, err := scanClientKey(rows)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, rows.Err()
+}
+
+// Revoke disables the key with the given name
+func (s *ClientKeyStore) Revoke(name string) error {
+	res, err := s.db.Exec(`UPDATE client_keys SET disabled=1 WHERE name=?`, name)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return fmt.Errorf("no key named %q", name)
+	}
+	return nil
+}
+
+type clientKeyContextKey struct{}
+
+// clientFromContext returns the authenticated client, or nil when auth is disabled
+func clientFromContext(ctx context.Context) *ClientKey {
+	key, _ := ctx.Value(clientKeyContextKey{}).(*ClientKey)
+	return key
+}
+
+// isOpenAIPath reports whether a route belongs to the OpenAI-compatible API,
+// which expects errors as {"error": {"message": ...}}
+func isOpenAIPath(p string) bool {
+	return strings.HasPrefix(p, "/v1/")
+}
+
+// respondError writes an error in the shape expected by the calling API
+func respondError(c *gin.Context, status int, errType, message string) {
+	if isOpenAIPath(c.Request.URL.Path) {
+		c.AbortWithStatusJSON(status, gin.H{"error": gin.H{"message": message, "type": errType}})
+		return
+	}
+	c.AbortWithStatusJSON(status, gin.H{"error": message})
+}
+
+// bearerToken extracts the token from an "Authorization: Bearer" header
+func bearerToken(c *gin.Context) string {
+	auth := c.GetHeader("Authorization")
+	if len(auth) > 7 && strings.EqualFold(auth[:7], "bearer ") {
+		return strings.TrimSpace(auth[7:])
+	}
+	return ""
+}
+
+// clientAuthMiddleware authenticates requests with a client key passed as a
+// Bearer token (OpenAI clients) or in a custom header (Ollama clients)
+func clientAuthMiddleware(store *ClientKeyStore, header string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		token := bearerToken(c)
+		if token == "" && header != "" {
+			token = strings.TrimSpace(c.GetHeader(header))
+		}
+		if token == "" {
+			respondError(c, http.StatusUnauthorized, "authentication_error", "missing API key")
+			return
+		}
+
+		key, err := store.Lookup(token)
+		if err != nil {
+			if errors.Is(err, ErrInvalidClientKey) || errors.Is(err, ErrExpiredClientKey) {
+				respondError(c, http.StatusUnauthorized, "authentication_error", err.Error())
+				return
+			}
+			respondError(c, http.StatusInternalServerError, "server_error", "failed to verify API key")
+			return
+		}
+
+		c.Set("client", key.Name)
+		c.Request = c.Request.WithContext(context.WithValue(c.Request.Context(), clientKeyContextKey{}, key))
+		c.Next()
+	}
+}
+
+// adminAuthMiddleware protects the admin API with a static token
+func adminAuthMiddleware(token string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		got := bearerToken(c)
+		if got == "" || subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "invalid admin token"})
+			return
+		}
+		c.Next()
+	}
+}
+
+// registerClientKeyRoutes adds the key management endpoints to the admin API
+func registerClientKeyRoutes(admin *gin.RouterGroup, store *ClientKeyStore) {
+	admin.GET("/keys", func(c *gin.Context) {
+		keys, err := store.List()
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"keys": keys})
+	})
+
+	admin.POST("/keys", func(c *gin.Context) {
+		var request struct {
+			Name          string   `json:"name"`
+			ExpiresIn     string   `json:"expires_in"` // Go duration, e.g. "720h"
+			AllowedModels []string `json:"allowed_models"`
+		}
+		if err := c.ShouldBindJSON(&request); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid JSON payload: " + err.Error()})
+			return
+		}
+		var ttl time.Duration
+		if request.ExpiresIn != "" {
+			var err error
+			if ttl, err = time.ParseDuration(request.ExpiresIn); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "invalid expires_in: " + err.Error()})
+				return
+			}
+		}
+		secret, key, err := store.Create(request.Name, ttl, request.AllowedModels)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusCreated, gin.H{"key": secret, "client": key})
+	})
+
+	admin.DELETE("/keys/:name", func(c *gin.Context) {
+		if err := store.Revoke(c.Param("name")); err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return
+		}
+		c.Status(http.StatusNoContent)
+	})
+}
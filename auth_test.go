@@ -0,0 +1,134 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func newTestClientKeyStore(t *testing.T) *ClientKeyStore {
+	t.Helper()
+	s, err := NewClientKeyStore(filepath.Join(t.TempDir(), "keys.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func TestClientKeyAllowsModel(t *testing.T) {
+	tests := []struct {
+		name    string
+		key     *ClientKey
+		model   string
+		allowed bool
+	}{
+		{name: "auth disabled", key: nil, model: "openai/gpt-4o", allowed: true},
+		{name: "no patterns", key: &ClientKey{}, model: "openai/gpt-4o", allowed: true},
+		{name: "full ID", key: &ClientKey{AllowedModels: []string{"openai/*"}}, model: "openai/gpt-4o", allowed: true},
+		{name: "display name", key: &ClientKey{AllowedModels: []string{"gpt-4o*"}}, model: "openai/gpt-4o-mini", allowed: true},
+		{name: "no match", key: &ClientKey{AllowedModels: []string{"openai/*", "claude-*"}}, model: "google/gemini-pro", allowed: false},
+		{name: "vendor only in ID", key: &ClientKey{AllowedModels: []string{"openai/*"}}, model: "gpt-4o", allowed: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.key.AllowsModel(tt.model); got != tt.allowed {
+				t.Errorf("AllowsModel(%q) = %v, want %v", tt.model, got, tt.allowed)
+			}
+		})
+	}
+}
+
+func TestClientKeyStore(t *testing.T) {
+	s := newTestClientKeyStore(t)
+	secret, key, err := s.Create("ci", time.Hour, []string{"openai/*"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(secret, clientKeyPrefix) || !strings.HasPrefix(secret, key.Prefix) {
+		t.Errorf("secret %q does not start with %q", secret, key.Prefix)
+	}
+	if _, _, err := s.Create("", 0, nil); err == nil {
+		t.Error("Create() without a name succeeded")
+	}
+
+	got, err := s.Lookup(secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Name != "ci" || len(got.AllowedModels) != 1 || got.ExpiresAt == nil {
+		t.Errorf("Lookup() = %+v", got)
+	}
+	if _, err := s.Lookup(secret + "x"); !errors.Is(err, ErrInvalidClientKey) {
+		t.Errorf("Lookup(unknown) = %v, want ErrInvalidClientKey", err)
+	}
+
+	expired, _, err := s.Create("old", time.Hour, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.db.Exec(`UPDATE client_keys SET expires_at=? WHERE name='old'`, time.Now().Add(-time.Minute).Unix()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Lookup(expired); !errors.Is(err, ErrExpiredClientKey) {
+		t.Errorf("Lookup(expired) = %v, want ErrExpiredClientKey", err)
+	}
+
+	if err := s.Revoke("ci"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Lookup(secret); !errors.Is(err, ErrInvalidClientKey) {
+		t.Errorf("Lookup(revoked) = %v, want ErrInvalidClientKey", err)
+	}
+	if err := s.Revoke("missing"); err == nil {
+		t.Error("Revoke() of an unknown key succeeded")
+	}
+}
+
+func TestClientAuthMiddleware(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	s := newTestClientKeyStore(t)
+	secret, _, err := s.Create("ci", 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := gin.New()
+	r.Use(clientAuthMiddleware(s, "X-Api-Key"))
+	handler := func(c *gin.Context) { c.String(http.StatusOK, clientFromContext(c.Request.Context()).ClientName()) }
+	r.POST("/api/chat", handler)
+	r.POST("/v1/chat/completions", handler)
+
+	tests := []struct {
+		name       string
+		path       string
+		header     string
+		value      string
+		wantStatus int
+		wantBody   string
+	}{
+		{name: "bearer token", path: "/v1/chat/completions", header: "Authorization", value: "Bearer " + secret, wantStatus: http.StatusOK, wantBody: "ci"},
+		{name: "custom header", path: "/api/chat", header: "X-Api-Key", value: secret, wantStatus: http.StatusOK, wantBody: "ci"},
+		{name: "missing key", path: "/api/chat", wantStatus: http.StatusUnauthorized, wantBody: `{"error":"missing API key"}`},
+		{name: "invalid key", path: "/v1/chat/completions", header: "Authorization", value: "Bearer olp-nope", wantStatus: http.StatusUnauthorized,
+			wantBody: `{"error":{"message":"invalid API key","type":"authentication_error"}}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, tt.path, nil)
+			if tt.header != "" {
+				req.Header.Set(tt.header, tt.value)
+			}
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+			if w.Code != tt.wantStatus || w.Body.String() != tt.wantBody {
+				t.Errorf("got %d %s, want %d %s", w.Code, w.Body.String(), tt.wantStatus, tt.wantBody)
+			}
+		})
+	}
+}
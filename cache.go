@@ -0,0 +1,387 @@
+package main
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sashabaranov/go-openai"
+)
+
+// cacheHeader reports whether a chat response came from the response cache
+const cacheHeader = "X-Cache"
+
+const (
+	cacheHit    = "HIT"
+	cacheMiss   = "MISS"
+	cacheBypass = "BYPASS"
+)
+
+// samplingParams are the request parameters that change a chat response, in
+// the same form for the Ollama and OpenAI APIs
+type samplingParams struct {
+	Temperature *float64 `json:"temperature,omitempty"`
+	TopP        *float64 `json:"top_p,omitempty"`
+	MaxTokens   int      `json:"max_tokens,omitempty"`
+	Stop        []string `json:"stop,omitempty"`
+	Seed        *int     `json:"seed,omitempty"`
+}
+
+// ollamaOptions are the model options of an Ollama chat request
+type ollamaOptions struct {
+	Temperature *float64 `json:"temperature"`
+	TopP        *float64 `json:"top_p"`
+	NumPredict  int      `json:"num_predict"`
+	Stop        []string `json:"stop"`
+	Seed        *int     `json:"seed"`
+}
+
+func (o *ollamaOptions) sampling() samplingParams {
+	if o == nil {
+		return samplingParams{}
+	}
+	return samplingParams{Temperature: o.Temperature, TopP: o.TopP, MaxTokens: o.NumPredict, Stop: o.Stop, Seed: o.Seed}
+}
+
+// openAISampling returns the sampling parameters of an OpenAI chat request.
+// Unset and zero values cannot be told apart, so both mean the default.
+func openAISampling(req openai.ChatCompletionRequest) samplingParams {
+	params := samplingParams{MaxTokens: req.MaxTokens, Stop: req.Stop, Seed: req.Seed}
+	if req.MaxCompletionTokens > 0 {
+		params.MaxTokens = req.MaxCompletionTokens
+	}
+	if req.Temperature != 0 {
+		t := float64(req.Temperature)
+		params.Temperature = &t
+	}
+	if req.TopP != 0 {
+		p := float64(req.TopP)
+		params.TopP = &p
+	}
+	return params
+}
+
+// responseCacheKey is the canonical hash of a chat request: the requested
+// model, the messages, the sampling parameters and the OpenRouter extensions.
+// scope is the allowed model patterns of the client key, so responses are
+// only shared between keys that may use the same models, and fallback the
+// fallback mode, so a strict request never gets a fallback model's answer.
+func responseCacheKey(scope []string, fallback, model string, msgs []openai.ChatCompletionMessage, params samplingParams, extras upstreamExtras) (string, error) {
+	scope = append([]string(nil), scope...)
+	sort.Strings(scope)
+	data, err := json.Marshal(struct {
+		Scope    []string                       `json:"scope,omitempty"`
+		Fallback string                         `json:"fallback"`
+		Model    string                         `json:"model"`
+		Messages []openai.ChatCompletionMessage `json:"messages"`
+		Params   samplingParams                 `json:"params"`
+		Extras   upstreamExtras                 `json:"extras,omitempty"`
+	}{scope, fallback, model, msgs, params, extras})
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// CachedResponse is a completed chat response, replayable in both APIs with
+// or without streaming
+type CachedResponse struct {
+	Model        string
+	Content      string
+	FinishReason string
+	Usage        openai.Usage
+	Cost         float64 // charged to the request; cache hits cost nothing
+}
+
+// ResponseCache stores chat responses in SQLite, expiring them after
+// response_cache.ttl and evicting the oldest beyond the size limits
+type ResponseCache struct {
+	db *sql.DB
+}
+
+func NewResponseCache(path string) (*ResponseCache, error) {
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = db.Exec(`CREATE TABLE IF NOT EXISTS response_cache (
+		key TEXT PRIMARY KEY,
+		model TEXT NOT NULL,
+		content TEXT NOT NULL,
+		finish_reason TEXT NOT NULL,
+		prompt_tokens INTEGER DEFAULT 0,
+		completion_tokens INTEGER DEFAULT 0,
+		size INTEGER NOT NULL,
+		created_at INTEGER NOT NULL,
+		expires_at INTEGER NOT NULL
+	)`); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &ResponseCache{db: db}, nil
+}
+
+func (rc *ResponseCache) Close() error { return rc.db.Close() }
+
+// Get returns the response stored under key, if it has not expired
+func (rc *ResponseCache) Get(key string) (*CachedResponse, error) {
+	var resp CachedResponse
+	err := rc.db.QueryRow(`SELECT model, content, finish_reason, prompt_tokens, completion_tokens
+		FROM response_cache WHERE key = ? AND expires_at > ?`, key, time.Now().UnixNano()).
+		Scan(&resp.Model, &resp.Content, &resp.FinishReason, &resp.Usage.PromptTokens, &resp.Usage.CompletionTokens)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	resp.Usage.TotalTokens = resp.Usage.PromptTokens + resp.Usage.CompletionTokens
+	return &resp, nil
+}
+
+// Put stores a response under key and prunes the cache
+func (rc *ResponseCache) Put(key string, resp CachedResponse) error {
+	cfg := currentConfig().ResponseCache
+	now := time.Now()
+	_, err := rc.db.Exec(`INSERT OR REPLACE INTO response_cache(key, model, content, finish_reason, prompt_tokens, completion_tokens, size, created_at, expires_at)
+		VALUES(?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		key, resp.Model, resp.Content, resp.FinishReason, resp.Usage.PromptTokens, resp.Usage.CompletionTokens,
+		len(resp.Model)+len(resp.Content), now.UnixNano(), now.Add(cfg.TTL).UnixNano())
+	if err != nil {
+		return err
+	}
+	return rc.Prune()
+}
+
+// Prune deletes expired responses, then the oldest ones beyond
+// response_cache.max_entries and response_cache.max_size_mb
+func (rc *ResponseCache) Prune() error {
+	cfg := currentConfig().ResponseCache
+	if _, err := rc.db.Exec(`DELETE FROM response_cache WHERE expires_at <= ?`, time.Now().UnixNano()); err != nil {
+		return err
+	}
+	if cfg.MaxEntries > 0 {
+		if _, err := rc.db.Exec(`DELETE FROM response_cache WHERE key NOT IN (
+			SELECT key FROM response_cache ORDER BY created_at DESC, key LIMIT ?)`, cfg.MaxEntries); err != nil {
+			return err
+		}
+	}
+	if cfg.MaxSizeMB > 0 {
+		if _, err := rc.db.Exec(`DELETE FROM response_cache WHERE key IN (
+			SELECT key FROM (SELECT key, SUM(size) OVER (ORDER BY created_at DESC, key) AS total FROM response_cache)
+			WHERE total > ?)`, int64(cfg.MaxSizeMB)<<20); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// bypassesCache reports whether a request must not be answered from the
+// cache: it sent Cache-Control: no-cache or no-store, or samples with a
+// temperature above 0
+func bypassesCache(c *gin.Context, params samplingParams) bool {
+	directives := strings.ToLower(c.GetHeader("Cache-Control"))
+	if strings.Contains(directives, "no-cache") || strings.Contains(directives, "no-store") {
+		return true
+	}
+	return params.Temperature != nil && *params.Temperature > 0
+}
+
+// chatRequestKey returns the canonical hash of a chat request, used by the
+// response cache and to coalesce identical requests, or "" when the request
+// bypasses both
+func chatRequestKey(c *gin.Context, model string, msgs []openai.ChatCompletionMessage, params samplingParams) string {
+	if bypassesCache(c, params) {
+		return ""
+	}
+	var scope []string
+	if client := clientFromContext(c.Request.Context()); client != nil {
+		scope = client.AllowedModels
+	}
+	ctx := c.Request.Context()
+	key, err := responseCacheKey(scope, fallbackMode(ctx), model, msgs, params, upstreamExtrasFromContext(ctx))
+	if err != nil {
+		slog.Error("failed to hash chat request", "error", err)
+		return ""
+	}
+	return key
+}
+
+// Lookup looks up a chat request by the key of chatRequestKey and reports the
+// outcome in the X-Cache header. It returns the cached response on a hit. A
+// nil cache is disabled.
+func (rc *ResponseCache) Lookup(c *gin.Context, key string) *CachedResponse {
+	if rc == nil {
+		return nil
+	}
+	if key == "" {
+		c.Header(cacheHeader, cacheBypass)
+		responseCacheTotal.WithLabelValues("bypass").Inc()
+		return nil
+	}
+	resp, err := rc.Get(key)
+	if err != nil {
+		slog.Error("failed to read response cache", "error", err)
+	}
+	if resp != nil {
+		c.Header(cacheHeader, cacheHit)
+		c.Header(servedModelHeader, resp.Model)
+		responseCacheTotal.WithLabelValues("hit").Inc()
+		slog.Info("Serving cached response", "model", resp.Model)
+		return resp
+	}
+	c.Header(cacheHeader, cacheMiss)
+	responseCacheTotal.WithLabelValues("miss").Inc()
+	return nil
+}
+
+// Store keeps a completed response under its request key
+func (rc *ResponseCache) Store(key string, resp CachedResponse) {
+	if rc == nil || key == "" || resp.Content == "" {
+		return
+	}
+	if resp.FinishReason == "" {
+		resp.FinishReason = "stop"
+	}
+	if err := rc.Put(key, resp); err != nil {
+		slog.Error("failed to write response cache", "model", resp.Model, "error", err)
+	}
+}
+
+// writeCachedOllama replays a cached response in the Ollama chat format, as
+// one JSON object or as an NDJSON stream of the content and the final message
+func writeCachedOllama(c *gin.Context, resp *CachedResponse, stream bool) {
+	if !stream {
+		c.JSON(http.StatusOK, ollamaFinalMessage(resp, resp.Content))
+		return
+	}
+	w := newReplayStream(c, "application/x-ndjson")
+	w.ollamaChunk(resp.Model, resp.Content)
+	w.ollamaFinal(resp)
+}
+
+// writeCachedOpenAI replays a cached response in the OpenAI chat format, as
+// one completion or as an SSE stream of chunks
+func writeCachedOpenAI(c *gin.Context, resp *CachedResponse, stream bool, includeUsage bool) {
+	if !stream {
+		c.JSON(http.StatusOK, chatResponseWithCost{
+			ChatCompletionResponse: openai.ChatCompletionResponse{
+				ID:      "chatcmpl-" + fmt.Sprintf("%d", time.Now().Unix()),
+				Object:  "chat.completion",
+				Created: time.Now().Unix(),
+				Model:   resp.Model,
+				Choices: []openai.ChatCompletionChoice{{
+					Message:      openai.ChatCompletionMessage{Role: openai.ChatMessageRoleAssistant, Content: resp.Content},
+					FinishReason: openai.FinishReason(resp.FinishReason),
+				}},
+			},
+			Usage: costUsage{Usage: resp.Usage, Cost: resp.Cost},
+		})
+		return
+	}
+	w := newReplayStream(c, "text/event-stream")
+	w.openAIChunk(resp.Model, resp.Content)
+	w.openAIFinal(resp, includeUsage)
+}
+
+// ollamaFinalMessage is the done message of an Ollama chat response that
+// did not come from this request's own upstream call
+func ollamaFinalMessage(resp *CachedResponse, content string) gin.H {
+	return gin.H{
+		"model":             resp.Model,
+		"created_at":        time.Now().Format(time.RFC3339),
+		"message":           gin.H{"role": "assistant", "content": content},
+		"done":              true,
+		"finish_reason":     resp.FinishReason,
+		"total_duration":    0,
+		"load_duration":     0,
+		"prompt_eval_count": resp.Usage.PromptTokens,
+		"eval_count":        resp.Usage.CompletionTokens,
+		"eval_duration":     0,
+		"cost":              resp.Cost,
+	}
+}
+
+// replayStream writes a response that did not come from this request's own
+// upstream stream as Ollama NDJSON or OpenAI SSE
+type replayStream struct {
+	c       *gin.Context
+	id      string
+	created int64
+}
+
+func newReplayStream(c *gin.Context, contentType string) *replayStream {
+	c.Writer.Header().Set("Content-Type", contentType)
+	c.Writer.Header().Set("Cache-Control", "no-cache")
+	c.Status(http.StatusOK)
+	return &replayStream{c: c, id: "chatcmpl-" + fmt.Sprintf("%d", time.Now().Unix()), created: time.Now().Unix()}
+}
+
+func (w *replayStream) write(format string, v interface{}) {
+	data, _ := json.Marshal(v)
+	fmt.Fprintf(w.c.Writer, format, data)
+	w.c.Writer.Flush()
+}
+
+func (w *replayStream) ollamaChunk(model, content string) {
+	w.write("%s\n", gin.H{
+		"model":      model,
+		"created_at": time.Now().Format(time.RFC3339),
+		"message":    gin.H{"role": "assistant", "content": content},
+		"done":       false,
+	})
+}
+
+func (w *replayStream) ollamaFinal(resp *CachedResponse) {
+	w.write("%s\n", ollamaFinalMessage(resp, ""))
+}
+
+func (w *replayStream) ollamaError(err error) {
+	w.write("%s\n", map[string]string{"error": "Stream error: " + err.Error()})
+}
+
+func (w *replayStream) openAIChunk(model, content string) {
+	w.write("data: %s\n\n", w.openAIEvent(model, openai.ChatCompletionStreamChoiceDelta{Content: content}, ""))
+}
+
+func (w *replayStream) openAIFinal(resp *CachedResponse, includeUsage bool) {
+	w.write("data: %s\n\n", w.openAIEvent(resp.Model, openai.ChatCompletionStreamChoiceDelta{}, resp.FinishReason))
+	if includeUsage {
+		w.write("data: %s\n\n", streamUsageWithCost{
+			ChatCompletionStreamResponse: openai.ChatCompletionStreamResponse{
+				ID: w.id, Object: "chat.completion.chunk", Created: w.created, Model: resp.Model,
+				Choices: []openai.ChatCompletionStreamChoice{},
+			},
+			Usage: costUsage{Usage: resp.Usage, Cost: resp.Cost},
+		})
+	}
+	fmt.Fprintf(w.c.Writer, "data: [DONE]\n\n")
+	w.c.Writer.Flush()
+}
+
+// openAIError ends a stream with an error event, as OpenRouter does
+func (w *replayStream) openAIError(err error) {
+	w.write("data: %s\n\n", gin.H{"error": gin.H{"message": "Stream error: " + err.Error(), "type": "upstream_error"}})
+	fmt.Fprintf(w.c.Writer, "data: [DONE]\n\n")
+	w.c.Writer.Flush()
+}
+
+func (w *replayStream) openAIEvent(model string, delta openai.ChatCompletionStreamChoiceDelta, finishReason string) openai.ChatCompletionStreamResponse {
+	return openai.ChatCompletionStreamResponse{
+		ID:      w.id,
+		Object:  "chat.completion.chunk",
+		Created: w.created,
+		Model:   model,
+		Choices: []openai.ChatCompletionStreamChoice{{Delta: delta, FinishReason: openai.FinishReason(finishReason)}},
+	}
+}
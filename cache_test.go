@@ -0,0 +1,134 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sashabaranov/go-openai"
+)
+
+func TestResponseCacheKey(t *testing.T) {
+	msgs := []openai.ChatCompletionMessage{{Role: "user", Content: "hi"}}
+	temp := 0.0
+	want, err := responseCacheKey(nil, FallbackLenient, "openai/gpt-4o", msgs, samplingParams{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		scope    []string
+		fallback string
+		model    string
+		msgs     []openai.ChatCompletionMessage
+		params   samplingParams
+		extras   upstreamExtras
+		same     bool
+	}{
+		{name: "identical", fallback: FallbackLenient, model: "openai/gpt-4o", msgs: msgs, same: true},
+		{name: "other model", fallback: FallbackLenient, model: "openai/gpt-4o-mini", msgs: msgs},
+		{name: "other messages", fallback: FallbackLenient, model: "openai/gpt-4o", msgs: []openai.ChatCompletionMessage{{Role: "user", Content: "hello"}}},
+		{name: "max tokens", fallback: FallbackLenient, model: "openai/gpt-4o", msgs: msgs, params: samplingParams{MaxTokens: 10}},
+		{name: "explicit zero temperature", fallback: FallbackLenient, model: "openai/gpt-4o", msgs: msgs, params: samplingParams{Temperature: &temp}},
+		{name: "extensions", fallback: FallbackLenient, model: "openai/gpt-4o", msgs: msgs, extras: upstreamExtras{"transforms": json.RawMessage(`["middle-out"]`)}},
+		{name: "strict fallback", fallback: FallbackStrict, model: "openai/gpt-4o", msgs: msgs},
+		{name: "restricted client", scope: []string{"gpt-4o"}, fallback: FallbackLenient, model: "openai/gpt-4o", msgs: msgs},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := responseCacheKey(tt.scope, tt.fallback, tt.model, tt.msgs, tt.params, tt.extras)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if (got == want) != tt.same {
+				t.Errorf("key equal to base = %v, want %v", got == want, tt.same)
+			}
+		})
+	}
+}
+
+func TestResponseCacheKeyScopeOrder(t *testing.T) {
+	a, _ := responseCacheKey([]string{"gemini*", "gpt-4o"}, FallbackLenient, "openai/gpt-4o", nil, samplingParams{}, nil)
+	b, _ := responseCacheKey([]string{"gpt-4o", "gemini*"}, FallbackLenient, "openai/gpt-4o", nil, samplingParams{}, nil)
+	if a != b {
+		t.Error("keys differ for the same allowed models in another order")
+	}
+}
+
+func TestOpenAISampling(t *testing.T) {
+	ptr := func(v float64) *float64 { return &v }
+	seed := 7
+	tests := []struct {
+		name string
+		req  openai.ChatCompletionRequest
+		want samplingParams
+	}{
+		{name: "defaults", want: samplingParams{}},
+		{name: "temperature and top_p", req: openai.ChatCompletionRequest{Temperature: 0.5, TopP: 0.25}, want: samplingParams{Temperature: ptr(0.5), TopP: ptr(0.25)}},
+		{name: "max_tokens", req: openai.ChatCompletionRequest{MaxTokens: 100}, want: samplingParams{MaxTokens: 100}},
+		{name: "max_completion_tokens wins", req: openai.ChatCompletionRequest{MaxTokens: 100, MaxCompletionTokens: 50}, want: samplingParams{MaxTokens: 50}},
+		{name: "stop and seed", req: openai.ChatCompletionRequest{Stop: []string{"\n"}, Seed: &seed}, want: samplingParams{Stop: []string{"\n"}, Seed: &seed}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := openAISampling(tt.req)
+			gotKey, _ := responseCacheKey(nil, FallbackLenient, "m", nil, got, nil)
+			wantKey, _ := responseCacheKey(nil, FallbackLenient, "m", nil, tt.want, nil)
+			if gotKey != wantKey {
+				t.Errorf("openAISampling() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+// newChatContext returns a gin context for a chat request with the given
+// headers, passed through the fallback middleware
+func newChatContext(t *testing.T, headers map[string]string) *gin.Context {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request = httptest.NewRequest(http.MethodPost, "/v1/chat/completions", nil)
+	for k, v := range headers {
+		c.Request.Header.Set(k, v)
+	}
+	fallbackMiddleware()(c)
+	return c
+}
+
+func TestChatRequestKey(t *testing.T) {
+	msgs := []openai.ChatCompletionMessage{{Role: "user", Content: "hi"}}
+	warm := 0.7
+	lenient := chatRequestKey(newChatContext(t, nil), "openai/gpt-4o", msgs, samplingParams{})
+	if lenient == "" {
+		t.Fatal("default request bypasses the cache")
+	}
+
+	tests := []struct {
+		name    string
+		headers map[string]string
+		params  samplingParams
+		want    string // "lenient" for the default key, "other" for a different one, "" to bypass
+	}{
+		{name: "explicit lenient", headers: map[string]string{fallbackHeader: "lenient"}, want: "lenient"},
+		{name: "strict", headers: map[string]string{fallbackHeader: "strict"}, want: "other"},
+		{name: "no-cache", headers: map[string]string{"Cache-Control": "no-cache"}, want: ""},
+		{name: "no-store", headers: map[string]string{"Cache-Control": "private, no-store"}, want: ""},
+		{name: "temperature", params: samplingParams{Temperature: &warm}, want: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := chatRequestKey(newChatContext(t, tt.headers), "openai/gpt-4o", msgs, tt.params)
+			switch {
+			case tt.want == "" && got != "":
+				t.Errorf("key = %q, want a bypass", got)
+			case tt.want == "lenient" && got != lenient:
+				t.Errorf("key differs from the default request")
+			case tt.want == "other" && (got == "" || got == lenient):
+				t.Errorf("key = %q, want one differing from the default request", got)
+			}
+		})
+	}
+}
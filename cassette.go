@@ -0,0 +1,454 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// CassetteOff sends upstream requests to OpenRouter
+	CassetteOff = "off"
+	// CassetteRecord sends upstream requests to OpenRouter and records them
+	CassetteRecord = "record"
+	// CassetteReplay answers upstream requests from the cassette, offline
+	CassetteReplay = "replay"
+)
+
+// cassetteMatchFields are the parts of an upstream request cassette.match can compare
+var cassetteMatchFields = []string{"method", "path", "body", "model", "messages", "stream"}
+
+const cassetteVersion = 1
+
+// upstreamTransport carries every request to OpenRouter: chat completions,
+// the model catalog and key info. initCassette replaces it to record or replay.
+var upstreamTransport http.RoundTripper = http.DefaultTransport
+
+// Cassette is a file of recorded upstream requests and responses
+type Cassette struct {
+	Version      int            `json:"version"`
+	Interactions []*Interaction `json:"interactions"`
+}
+
+// Interaction is one upstream request and its response, or the transport error
+type Interaction struct {
+	RecordedAt time.Time         `json:"recorded_at"`
+	Request    RecordedRequest   `json:"request"`
+	Response   *RecordedResponse `json:"response,omitempty"`
+	Error      string            `json:"error,omitempty"`
+}
+
+type RecordedRequest struct {
+	Method string          `json:"method"`
+	Path   string          `json:"path"` // relative to upstream.base_url
+	Body   json.RawMessage `json:"body,omitempty"`
+}
+
+type RecordedResponse struct {
+	Status    int            `json:"status"`
+	Header    http.Header    `json:"header"`
+	LatencyMs int64          `json:"latency_ms"` // until the response headers
+	Chunks    []RecordedRead `json:"chunks"`
+}
+
+// RecordedRead is a piece of a response body as it was read, with the time
+// since the previous one, so streams replay with their timing
+type RecordedRead struct {
+	DelayMs int64  `json:"delay_ms"`
+	Data    string `json:"data"`
+}
+
+// CassetteMissError is returned in replay mode for an upstream request the
+// cassette has no response for. It ends routing, as every other model would
+// miss too.
+type CassetteMissError struct {
+	Method string
+	Path   string
+	Model  string
+}
+
+func (e *CassetteMissError) Error() string {
+	if e.Model != "" {
+		return fmt.Sprintf("no recorded response in the cassette for %s %s (model %q); record it with cassette.mode: record", e.Method, e.Path, e.Model)
+	}
+	return fmt.Sprintf("no recorded response in the cassette for %s %s; record it with cassette.mode: record", e.Method, e.Path)
+}
+
+// initCassette sets up recording or replaying of upstream traffic
+func initCassette(cfg CassetteConfig) error {
+	switch cfg.Mode {
+	case CassetteRecord:
+		rec, err := newCassetteRecorder(cfg.Path, http.DefaultTransport)
+		if err != nil {
+			return err
+		}
+		upstreamTransport = rec
+		slog.Info("Recording upstream requests", "cassette", cfg.Path, "recorded", rec.recorded)
+	case CassetteReplay:
+		player, err := newCassettePlayer(cfg)
+		if err != nil {
+			return err
+		}
+		upstreamTransport = player
+		slog.Info("Replaying upstream requests, OpenRouter will not be contacted", "cassette", cfg.Path, "requests", len(player.interactions), "match", cfg.Match)
+	}
+	return nil
+}
+
+// closeCassette closes the cassette file being recorded, if any
+func closeCassette() error {
+	if rec, ok := upstreamTransport.(*cassetteRecorder); ok {
+		return rec.Close()
+	}
+	return nil
+}
+
+// readCassette loads a cassette file; a missing file is an empty cassette
+func readCassette(path string) (*Cassette, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return &Cassette{Version: cassetteVersion}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var c Cassette
+	if err := json.Unmarshal(data, &c); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if c.Version != cassetteVersion {
+		return nil, fmt.Errorf("%s: unsupported cassette version %d", path, c.Version)
+	}
+	return &c, nil
+}
+
+// upstreamPath returns the path of an upstream URL relative to
+// upstream.base_url, so cassettes do not depend on it
+func upstreamPath(u *url.URL) string {
+	path := u.Path
+	if base, err := url.Parse(currentConfig().Upstream.BaseURL); err == nil {
+		path = strings.TrimPrefix(path, strings.TrimSuffix(base.Path, "/"))
+	}
+	path = strings.TrimPrefix(path, "/")
+	if u.RawQuery != "" {
+		path += "?" + u.RawQuery
+	}
+	return path
+}
+
+// readRequestBody returns the body of a request and restores it for sending
+func readRequestBody(req *http.Request) ([]byte, error) {
+	if req.Body == nil {
+		return nil, nil
+	}
+	body, err := io.ReadAll(req.Body)
+	req.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	req.Body = io.NopCloser(bytes.NewReader(body))
+	return body, nil
+}
+
+// cassetteTail closes the interaction list of a cassette file being recorded
+const cassetteTail = "\n]}\n"
+
+// cassetteRecorder sends upstream requests and appends them to the cassette
+// file as their responses complete
+type cassetteRecorder struct {
+	base http.RoundTripper
+	path string
+
+	mu       sync.Mutex
+	file     *os.File
+	end      int64 // offset of cassetteTail, where the next interaction goes
+	recorded int
+}
+
+// newCassetteRecorder opens a cassette for recording. An existing cassette is
+// rewritten once with one interaction per line, so new interactions can be
+// appended without rewriting the file.
+func newCassetteRecorder(path string, base http.RoundTripper) (*cassetteRecorder, error) {
+	c, err := readCassette(path)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, `{"version":%d,"interactions":[`, cassetteVersion)
+	for i, in := range c.Interactions {
+		data, err := json.Marshal(in)
+		if err != nil {
+			return nil, err
+		}
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		buf.WriteByte('\n')
+		buf.Write(data)
+	}
+	end := int64(buf.Len())
+	buf.WriteString(cassetteTail)
+	if err := writeFileAtomic(path, buf.Bytes()); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	return &cassetteRecorder{base: base, path: path, file: f, end: end, recorded: len(c.Interactions)}, nil
+}
+
+func (r *cassetteRecorder) RoundTrip(req *http.Request) (*http.Response, error) {
+	body, err := readRequestBody(req)
+	if err != nil {
+		return nil, err
+	}
+	in := &Interaction{
+		RecordedAt: time.Now().UTC(),
+		Request:    RecordedRequest{Method: req.Method, Path: upstreamPath(req.URL)},
+	}
+	if json.Valid(body) {
+		in.Request.Body = body
+	}
+
+	start := time.Now()
+	resp, err := r.base.RoundTrip(req)
+	if err != nil {
+		in.Error = err.Error()
+		r.save(in)
+		return nil, err
+	}
+	header := resp.Header.Clone()
+	header.Del("Set-Cookie")
+	in.Response = &RecordedResponse{Status: resp.StatusCode, Header: header, LatencyMs: time.Since(start).Milliseconds()}
+	resp.Body = &recordingBody{body: resp.Body, last: time.Now(), done: func(chunks []RecordedRead) {
+		in.Response.Chunks = chunks
+		r.save(in)
+	}}
+	return resp, nil
+}
+
+// save appends an interaction to the cassette file, keeping it valid JSON
+func (r *cassetteRecorder) save(in *Interaction) {
+	data, err := json.Marshal(in)
+	if err == nil {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		sep := ",\n"
+		if r.recorded == 0 {
+			sep = "\n"
+		}
+		entry := sep + string(data)
+		if _, err = r.file.WriteAt([]byte(entry+cassetteTail), r.end); err == nil {
+			r.end += int64(len(entry))
+			r.recorded++
+		}
+	}
+	if err != nil {
+		slog.Error("failed to write cassette", "path", r.path, "error", err)
+	}
+}
+
+func (r *cassetteRecorder) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.file.Close()
+}
+
+// recordingBody records a response body as the client reads it
+type recordingBody struct {
+	body   io.ReadCloser
+	last   time.Time
+	chunks []RecordedRead
+	done   func([]RecordedRead)
+	once   sync.Once
+}
+
+func (b *recordingBody) Read(p []byte) (int, error) {
+	n, err := b.body.Read(p)
+	if n > 0 {
+		now := time.Now()
+		b.chunks = append(b.chunks, RecordedRead{DelayMs: now.Sub(b.last).Milliseconds(), Data: string(p[:n])})
+		b.last = now
+	}
+	if err == io.EOF {
+		b.finish()
+	}
+	return n, err
+}
+
+// Close records what was read, also when the client stopped early
+func (b *recordingBody) Close() error {
+	b.finish()
+	return b.body.Close()
+}
+
+func (b *recordingBody) finish() {
+	b.once.Do(func() { b.done(b.chunks) })
+}
+
+// cassettePlayer answers upstream requests from a cassette. Requests are
+// matched on the parts named by cassette.match; identical requests get the
+// recorded responses in order, the last one repeating.
+type cassettePlayer struct {
+	match    []string
+	ignore   []string
+	realtime bool
+
+	mu           sync.Mutex
+	interactions map[string][]*Interaction
+	served       map[string]int
+}
+
+func newCassettePlayer(cfg CassetteConfig) (*cassettePlayer, error) {
+	c, err := readCassette(cfg.Path)
+	if err != nil {
+		return nil, err
+	}
+	if len(c.Interactions) == 0 {
+		return nil, fmt.Errorf("%s: no recorded requests to replay", cfg.Path)
+	}
+	p := &cassettePlayer{
+		match:        cfg.Match,
+		ignore:       cfg.IgnoreFields,
+		realtime:     cfg.Realtime,
+		interactions: make(map[string][]*Interaction),
+		served:       make(map[string]int),
+	}
+	for _, in := range c.Interactions {
+		key, err := p.key(in.Request)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s %s: %w", cfg.Path, in.Request.Method, in.Request.Path, err)
+		}
+		p.interactions[key] = append(p.interactions[key], in)
+	}
+	return p, nil
+}
+
+// key is the canonical form of the parts of a request that are matched
+func (p *cassettePlayer) key(req RecordedRequest) (string, error) {
+	var body map[string]interface{}
+	if len(req.Body) > 0 {
+		if err := json.Unmarshal(req.Body, &body); err != nil {
+			return "", err
+		}
+		for _, field := range p.ignore {
+			delete(body, field)
+		}
+	}
+	parts := make(map[string]interface{}, len(p.match))
+	for _, field := range p.match {
+		switch field {
+		case "method":
+			parts[field] = req.Method
+		case "path":
+			parts[field] = req.Path
+		case "body":
+			parts[field] = body
+		default:
+			parts[field] = body[field]
+		}
+	}
+	data, err := json.Marshal(parts)
+	return string(data), err
+}
+
+func (p *cassettePlayer) RoundTrip(req *http.Request) (*http.Response, error) {
+	body, err := readRequestBody(req)
+	if err != nil {
+		return nil, err
+	}
+	recorded := RecordedRequest{Method: req.Method, Path: upstreamPath(req.URL)}
+	if json.Valid(body) {
+		recorded.Body = body
+	}
+	key, err := p.key(recorded)
+	if err != nil {
+		return nil, err
+	}
+
+	p.mu.Lock()
+	matches := p.interactions[key]
+	i := min(p.served[key], len(matches)-1)
+	p.served[key]++
+	p.mu.Unlock()
+	if len(matches) == 0 {
+		var fields struct {
+			Model string `json:"model"`
+		}
+		_ = json.Unmarshal(body, &fields)
+		return nil, &CassetteMissError{Method: recorded.Method, Path: recorded.Path, Model: fields.Model}
+	}
+
+	in := matches[i]
+	if in.Error != "" {
+		return nil, errors.New(in.Error)
+	}
+	if p.realtime {
+		if err := sleepContext(req, time.Duration(in.Response.LatencyMs)*time.Millisecond); err != nil {
+			return nil, err
+		}
+	}
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", in.Response.Status, http.StatusText(in.Response.Status)),
+		StatusCode:    in.Response.Status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        in.Response.Header.Clone(),
+		Body:          &replayBody{req: req, chunks: in.Response.Chunks, realtime: p.realtime},
+		ContentLength: -1,
+		Request:       req,
+	}, nil
+}
+
+// replayBody plays back a recorded response body, with its timing in realtime mode
+type replayBody struct {
+	req      *http.Request
+	chunks   []RecordedRead
+	realtime bool
+	buf      []byte
+}
+
+func (b *replayBody) Read(p []byte) (int, error) {
+	for len(b.buf) == 0 {
+		if len(b.chunks) == 0 {
+			return 0, io.EOF
+		}
+		chunk := b.chunks[0]
+		b.chunks = b.chunks[1:]
+		if b.realtime {
+			if err := sleepContext(b.req, time.Duration(chunk.DelayMs)*time.Millisecond); err != nil {
+				return 0, err
+			}
+		}
+		b.buf = []byte(chunk.Data)
+	}
+	n := copy(p, b.buf)
+	b.buf = b.buf[n:]
+	return n, nil
+}
+
+func (b *replayBody) Close() error { return nil }
+
+// sleepContext waits for d or until the request is canceled
+func sleepContext(req *http.Request, d time.Duration) error {
+	if d <= 0 {
+		return nil
+	}
+	select {
+	case <-time.After(d):
+		return nil
+	case <-req.Context().Done():
+		return req.Context().Err()
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCassettePlayerKey(t *testing.T) {
+	body := func(s string) json.RawMessage { return json.RawMessage(s) }
+	base := RecordedRequest{Method: "POST", Path: "chat/completions",
+		Body: body(`{"model":"openai/gpt-4o","messages":[{"role":"user","content":"hi"}],"stream":false,"provider":{"order":["a"]}}`)}
+
+	tests := []struct {
+		name   string
+		match  []string
+		ignore []string
+		other  RecordedRequest
+		same   bool
+	}{
+		{name: "identical", match: []string{"method", "path", "body"}, other: base, same: true},
+		{name: "field order", match: []string{"method", "path", "body"}, same: true, other: RecordedRequest{Method: "POST", Path: "chat/completions",
+			Body: body(`{"provider":{"order":["a"]},"stream":false,"messages":[{"role":"user","content":"hi"}],"model":"openai/gpt-4o"}`)}},
+		{name: "other method", match: []string{"method", "path", "body"}, other: RecordedRequest{Method: "GET", Path: base.Path, Body: base.Body}},
+		{name: "other path", match: []string{"method", "path", "body"}, other: RecordedRequest{Method: "POST", Path: "models", Body: base.Body}},
+		{name: "other body field", match: []string{"method", "path", "body"}, other: RecordedRequest{Method: "POST", Path: base.Path,
+			Body: body(`{"model":"openai/gpt-4o","messages":[{"role":"user","content":"hi"}],"stream":false,"provider":{"order":["b"]}}`)}},
+		{name: "ignored body field", match: []string{"method", "path", "body"}, ignore: []string{"provider"}, same: true, other: RecordedRequest{Method: "POST", Path: base.Path,
+			Body: body(`{"model":"openai/gpt-4o","messages":[{"role":"user","content":"hi"}],"stream":false}`)}},
+		{name: "only model and messages", match: []string{"path", "model", "messages"}, same: true, other: RecordedRequest{Method: "POST", Path: base.Path,
+			Body: body(`{"model":"openai/gpt-4o","messages":[{"role":"user","content":"hi"}],"stream":true}`)}},
+		{name: "stream matched", match: []string{"path", "model", "messages", "stream"}, other: RecordedRequest{Method: "POST", Path: base.Path,
+			Body: body(`{"model":"openai/gpt-4o","messages":[{"role":"user","content":"hi"}],"stream":true}`)}},
+		{name: "no body", match: []string{"method", "path"}, other: RecordedRequest{Method: "POST", Path: base.Path}, same: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &cassettePlayer{match: tt.match, ignore: tt.ignore}
+			want, err := p.key(base)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := p.key(tt.other)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if (got == want) != tt.same {
+				t.Errorf("keys equal = %v, want %v\n%s\n%s", got == want, tt.same, got, want)
+			}
+		})
+	}
+}
+
+func TestCassettePlayerKeyInvalidBody(t *testing.T) {
+	p := &cassettePlayer{match: []string{"body"}}
+	if _, err := p.key(RecordedRequest{Body: json.RawMessage(`[1, 2]`)}); err == nil {
+		t.Error("key() of a non-object body succeeded")
+	}
+}
+
+func TestCassetteRecorderAppends(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"data":"` + r.URL.Path + `"}`))
+	}))
+	defer srv.Close()
+	useConfig(t, func(c *Config) { c.Upstream.BaseURL = srv.URL })
+	path := filepath.Join(t.TempDir(), "cassette.json")
+
+	record := func(paths ...string) {
+		t.Helper()
+		rec, err := newCassetteRecorder(path, http.DefaultTransport)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer rec.Close()
+		client := &http.Client{Transport: rec}
+		for _, p := range paths {
+			resp, err := client.Post(upstreamURL(p), "application/json", strings.NewReader(`{"model":"`+p+`"}`))
+			if err != nil {
+				t.Fatal(err)
+			}
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+		}
+	}
+	record("models", "chat/completions")
+	record("auth/key") // extends the existing cassette
+
+	c, err := readCassette(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, in := range c.Interactions {
+		got = append(got, in.Request.Path+" "+in.Response.Chunks[0].Data)
+	}
+	want := []string{`models {"data":"/models"}`, `chat/completions {"data":"/chat/completions"}`, `auth/key {"data":"/auth/key"}`}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("recorded:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
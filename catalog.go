@@ -0,0 +1,207 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+)
+
+// CatalogService is the single source of OpenRouter model metadata for the
+// handlers, the provider and free-mode discovery. The catalog is cached in
+// memory and in the cache file for the TTL; concurrent refreshes are collapsed
+// into one upstream fetch and a stale catalog keeps being served while a
+// refresh is pending or failing.
+type CatalogService struct {
+	path     string
+	ttl      time.Duration
+	apiKey   func() string
+	current  atomic.Pointer[ModelCatalog]
+	group    singleflight.Group
+	mu       sync.Mutex
+	onChange []func(*ModelCatalog)
+
+	lastAttempt atomic.Int64 // unix nanos of the last upstream fetch
+}
+
+// catalogRevalidateInterval limits how often a stale catalog triggers a
+// background fetch while OpenRouter keeps failing
+const catalogRevalidateInterval = time.Minute
+
+func NewCatalogService(path string, ttl time.Duration, apiKey func() string) *CatalogService {
+	return &CatalogService{path: path, ttl: ttl, apiKey: apiKey}
+}
+
+// OnChange registers fn to be called with every newly loaded catalog
+func (s *CatalogService) OnChange(fn func(*ModelCatalog)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.onChange = append(s.onChange, fn)
+}
+
+func (s *CatalogService) store(catalog *ModelCatalog) {
+	catalog.index = make(map[string]int, len(catalog.Models))
+	for i, m := range catalog.Models {
+		catalog.index[m.ID] = i
+	}
+	s.current.Store(catalog)
+	s.mu.Lock()
+	hooks := s.onChange
+	s.mu.Unlock()
+	for _, fn := range hooks {
+		fn(catalog)
+	}
+}
+
+func (s *CatalogService) fresh(catalog *ModelCatalog) bool {
+	return time.Since(catalog.FetchedAt) < s.ttl
+}
+
+// Load reads the cache file and fetches a new catalog when it is missing or
+// older than the TTL. A stale cache is used if OpenRouter cannot be reached.
+func (s *CatalogService) Load() (*ModelCatalog, error) {
+	cached, legacy, readErr := readModelCatalog(s.path)
+	if readErr != nil && !os.IsNotExist(readErr) {
+		slog.Warn("ignoring unreadable model cache", "path", s.path, "error", readErr)
+	}
+	if legacy {
+		slog.Info("migrating plain-text model cache to the versioned format", "path", s.path)
+		if err := writeModelCatalog(s.path, cached); err != nil {
+			slog.Warn("failed to migrate model cache", "path", s.path, "error", err)
+		}
+	}
+
+	if cached != nil && s.fresh(cached) {
+		s.store(cached)
+		return cached, nil
+	}
+	catalog, err := s.Refresh()
+	if err != nil {
+		// If fetch fails but we have a cached file (even if stale), use it
+		if cached != nil {
+			slog.Warn("failed to fetch model catalog, using stale cache", "path", s.path, "fetched_at", cached.FetchedAt, "error", err)
+			s.store(cached)
+			return cached, nil
+		}
+		return nil, err
+	}
+	return catalog, nil
+}
+
+// Get returns the current catalog. A stale catalog is returned immediately
+// while a refresh runs in the background; only the very first call waits.
+func (s *CatalogService) Get() (*ModelCatalog, error) {
+	catalog := s.current.Load()
+	if catalog == nil {
+		v, err, _ := s.group.Do("load", func() (interface{}, error) {
+			if catalog := s.current.Load(); catalog != nil {
+				return catalog, nil
+			}
+			return s.Load()
+		})
+		if err != nil {
+			return nil, err
+		}
+		return v.(*ModelCatalog), nil
+	}
+	if !s.fresh(catalog) && time.Since(time.Unix(0, s.lastAttempt.Load())) > catalogRevalidateInterval {
+		go func() {
+			if _, err := s.Refresh(); err != nil {
+				slog.Warn("failed to refresh model catalog, serving stale copy", "fetched_at", catalog.FetchedAt, "error", err)
+			}
+		}()
+	}
+	return catalog, nil
+}
+
+// Refresh fetches the catalog from OpenRouter regardless of its age, rewrites
+// the cache file and swaps in the new catalog. Concurrent calls share one fetch.
+func (s *CatalogService) Refresh() (*ModelCatalog, error) {
+	v, err, _ := s.group.Do("refresh", func() (interface{}, error) {
+		s.lastAttempt.Store(time.Now().UnixNano())
+		catalog, err := fetchModelCatalog(s.apiKey())
+		if err != nil {
+			return nil, err
+		}
+		if err := writeModelCatalog(s.path, catalog); err != nil {
+			slog.Warn("failed to write model cache", "path", s.path, "error", err)
+		}
+		s.store(catalog)
+		return catalog, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return v.(*ModelCatalog), nil
+}
+
+// Start refreshes the catalog in the background whenever it reaches the TTL,
+// retrying sooner after a failed fetch
+func (s *CatalogService) Start() {
+	retry := 10 * time.Minute
+	if s.ttl < retry {
+		retry = s.ttl
+	}
+	go func() {
+		for {
+			delay := s.ttl
+			if catalog := s.current.Load(); catalog != nil {
+				delay = s.ttl - time.Since(catalog.FetchedAt)
+			}
+			if delay > 0 {
+				time.Sleep(delay)
+			}
+			if _, err := s.Refresh(); err != nil {
+				slog.Warn("failed to refresh model catalog, keeping current list", "error", err, "retry_in", retry)
+				time.Sleep(retry)
+			}
+		}
+	}()
+}
+
+// Lookup returns the record of a model by full ID
+func (s *CatalogService) Lookup(id string) (ModelRecord, bool) {
+	if s == nil {
+		return ModelRecord{}, false
+	}
+	catalog, err := s.Get()
+	if err != nil {
+		return ModelRecord{}, false
+	}
+	i, ok := catalog.index[id]
+	if !ok {
+		return ModelRecord{}, false
+	}
+	return catalog.Models[i], true
+}
+
+// IDs returns the full IDs of the catalog's models
+func (c *ModelCatalog) IDs() []string {
+	ids := make([]string, len(c.Models))
+	for i, m := range c.Models {
+		ids[i] = m.ID
+	}
+	return ids
+}
+
+// Resolve maps a model name to a full catalog ID: an exact ID first, then a
+// display name that identifies a single model, so "gpt-4o" resolves to
+// "openai/gpt-4o". Full IDs missing from the catalog are used as is.
+func (s *CatalogService) Resolve(name string) (string, error) {
+	catalog, err := s.Get()
+	if err != nil {
+		return "", fmt.Errorf("failed to get models: %w", err)
+	}
+	id, err := resolveModelName(name, catalog.IDs())
+	var notFound *ModelNotFoundError
+	if errors.As(err, &notFound) && strings.Contains(name, "/") {
+		return name, nil
+	}
+	return id, err
+}
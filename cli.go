@@ -0,0 +1,130 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// runKeysCommand implements `ollama-proxy keys <create|list|revoke>` for managing
+// inbound client keys without going through the admin API
+func runKeysCommand(args []string) int {
+	usage := func() {
+		fmt.Fprintln(os.Stderr, "usage: ollama-proxy keys create -name NAME [-expires 720h] [-models 'gemini*,llama*']")
+		fmt.Fprintln(os.Stderr, "       ollama-proxy keys list")
+		fmt.Fprintln(os.Stderr, "       ollama-proxy keys revoke NAME")
+		fmt.Fprintln(os.Stderr, "       ollama-proxy keys limits -name NAME [-rpm N] [-rpd N] [-rpmo N] [-tpd N] [-tpmo N] [-cpd USD] [-cpmo USD]")
+	}
+	if len(args) == 0 {
+		usage()
+		return 2
+	}
+
+	store, err := NewClientKeyStore(databasePath())
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "failed to open key store:", err)
+		return 1
+	}
+	defer store.Close()
+
+	switch args[0] {
+	case "create":
+		fs := flag.NewFlagSet("keys create", flag.ContinueOnError)
+		name := fs.String("name", "", "client name")
+		expires := fs.Duration("expires", 0, "key lifetime, e.g. 720h (0 = never expires)")
+		models := fs.String("models", "", "comma separated allowed model patterns (empty = all)")
+		if err := fs.Parse(args[1:]); err != nil {
+			return 2
+		}
+		var allowed []string
+		for _, m := range strings.Split(*models, ",") {
+			if m = strings.TrimSpace(m); m != "" {
+				allowed = append(allowed, m)
+			}
+		}
+		secret, key, err := store.Create(*name, *expires, allowed)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "failed to create key:", err)
+			return 1
+		}
+		fmt.Printf("Created key for %q. Store it now, it cannot be shown again:\n%s\n", key.Name, secret)
+		return 0
+
+	case "list":
+		keys, err := store.List()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "failed to list keys:", err)
+			return 1
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "NAME\tPREFIX\tCREATED\tEXPIRES\tMODELS\tSTATUS")
+		for _, k := range keys {
+			expires := "never"
+			if k.ExpiresAt != nil {
+				expires = k.ExpiresAt.Format(time.RFC3339)
+			}
+			models := "*"
+			if len(k.AllowedModels) > 0 {
+				models = strings.Join(k.AllowedModels, ",")
+			}
+			status := "active"
+			if k.Disabled {
+				status = "revoked"
+			} else if k.Expired() {
+				status = "expired"
+			}
+			fmt.Fprintf(w, "%s\t%s…\t%s\t%s\t%s\t%s\n", k.Name, k.Prefix, k.CreatedAt.Format(time.RFC3339), expires, models, status)
+		}
+		w.Flush()
+		return 0
+
+	case "limits":
+		fs := flag.NewFlagSet("keys limits", flag.ContinueOnError)
+		name := fs.String("name", "", "client name")
+		var l ClientLimits
+		fs.Int64Var(&l.RequestsPerMinute, "rpm", 0, "requests per minute (0 = unlimited)")
+		fs.Int64Var(&l.RequestsPerDay, "rpd", 0, "requests per day")
+		fs.Int64Var(&l.RequestsPerMonth, "rpmo", 0, "requests per month")
+		fs.Int64Var(&l.TokensPerDay, "tpd", 0, "tokens per day")
+		fs.Int64Var(&l.TokensPerMonth, "tpmo", 0, "tokens per month")
+		fs.Float64Var(&l.CostPerDay, "cpd", 0, "cost per day in USD")
+		fs.Float64Var(&l.CostPerMonth, "cpmo", 0, "cost per month in USD")
+		if err := fs.Parse(args[1:]); err != nil {
+			return 2
+		}
+		if *name == "" {
+			usage()
+			return 2
+		}
+		usageStore, err := NewUsageStore(databasePath())
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "failed to open usage store:", err)
+			return 1
+		}
+		defer usageStore.Close()
+		if err := usageStore.SetLimits(*name, l); err != nil {
+			fmt.Fprintln(os.Stderr, "failed to set limits:", err)
+			return 1
+		}
+		fmt.Printf("Updated limits for %q\n", *name)
+		return 0
+
+	case "revoke":
+		if len(args) != 2 {
+			usage()
+			return 2
+		}
+		if err := store.Revoke(args[1]); err != nil {
+			fmt.Fprintln(os.Stderr, "failed to revoke key:", err)
+			return 1
+		}
+		fmt.Printf("Revoked key %q\n", args[1])
+		return 0
+	}
+
+	usage()
+	return 2
+}
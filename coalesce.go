@@ -0,0 +1,284 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sashabaranov/go-openai"
+)
+
+// coalescedHeader marks responses shared with an identical request in flight
+const coalescedHeader = "X-Coalesced"
+
+// errFlightAborted is seen by the requests joined to one whose upstream call failed
+var errFlightAborted = errors.New("coalesced request failed")
+
+// inflight is the upstream response of a chat request, shared with the
+// identical requests that arrive while it is running. The leading request
+// publishes the content as it streams in; followers replay what is buffered
+// and then wait for more.
+type inflight struct {
+	key string
+
+	mu           sync.Mutex
+	changed      chan struct{} // closed and replaced whenever the response grows
+	model        string
+	chunks       []string
+	finishReason string
+	usage        openai.Usage
+	done         bool
+	err          error
+
+	followers  int                // requests following the flight
+	leaderGone bool               // the leader's client went away
+	cancel     context.CancelFunc // cancels the leader's upstream call
+}
+
+// requestCoalescer tracks the chat requests in flight by request key
+type requestCoalescer struct {
+	mu      sync.Mutex
+	flights map[string]*inflight
+}
+
+var coalescer = &requestCoalescer{flights: make(map[string]*inflight)}
+
+// Join returns the request in flight for key and whether the caller leads it.
+// The leader must call Done when it returns. Requests are not coalesced when
+// routing.coalesce is off or the request bypasses the cache; the flight is
+// then nil, and its methods do nothing.
+func (rc *requestCoalescer) Join(key string) (*inflight, bool) {
+	if key == "" || !currentConfig().Routing.Coalesce {
+		return nil, true
+	}
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	if f, ok := rc.flights[key]; ok {
+		coalescedRequestsTotal.Inc()
+		f.mu.Lock()
+		f.followers++
+		f.mu.Unlock()
+		return f, false
+	}
+	f := &inflight{key: key, changed: make(chan struct{})}
+	rc.flights[key] = f
+	return f, true
+}
+
+func (rc *requestCoalescer) remove(f *inflight) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	if rc.flights[f.key] == f {
+		delete(rc.flights, f.key)
+	}
+}
+
+// update changes the flight under its lock and wakes up the followers
+func (f *inflight) update(change func()) {
+	if f == nil {
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.done {
+		return
+	}
+	change()
+	close(f.changed)
+	f.changed = make(chan struct{})
+}
+
+// Start records the model serving the request
+func (f *inflight) Start(model string) {
+	f.update(func() { f.model = model })
+}
+
+// Write publishes a piece of content
+func (f *inflight) Write(content string) {
+	if content == "" {
+		return
+	}
+	f.update(func() { f.chunks = append(f.chunks, content) })
+}
+
+// Finish completes the response. Requests arriving afterwards start a new
+// flight, or hit the response cache.
+func (f *inflight) Finish(finishReason string, usage openai.Usage) {
+	if finishReason == "" {
+		finishReason = "stop"
+	}
+	f.update(func() {
+		f.finishReason = finishReason
+		f.usage = usage
+		f.done = true
+	})
+	if f != nil {
+		coalescer.remove(f)
+	}
+}
+
+// Done fails the response if the leader returned without finishing it
+func (f *inflight) Done() {
+	f.update(func() {
+		f.err = errFlightAborted
+		f.done = true
+	})
+	if f != nil {
+		coalescer.remove(f)
+	}
+}
+
+// Context returns the context of the leader's upstream call. Other requests
+// following the flight must get the whole response, so the call is only
+// canceled once the leader's client and every follower have gone away.
+func (f *inflight) Context(ctx context.Context) (context.Context, context.CancelFunc) {
+	if f == nil {
+		return ctx, func() {}
+	}
+	upstreamCtx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+	f.mu.Lock()
+	f.cancel = cancel
+	f.mu.Unlock()
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-upstreamCtx.Done():
+			return
+		}
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		f.leaderGone = true
+		if f.followers == 0 {
+			cancel()
+		}
+	}()
+	return upstreamCtx, cancel
+}
+
+// leave is called by a follower when it returns
+func (f *inflight) leave() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.followers--
+	if f.leaderGone && f.followers == 0 && f.cancel != nil {
+		f.cancel()
+	}
+}
+
+// wait returns the chunks after the first from once there are any, or the
+// response is complete
+func (f *inflight) wait(ctx context.Context, from int) (chunks []string, done bool, err error) {
+	for {
+		f.mu.Lock()
+		if len(f.chunks) > from || f.done {
+			chunks, done, err = f.chunks[from:], f.done, f.err
+			f.mu.Unlock()
+			return chunks, done, err
+		}
+		changed := f.changed
+		f.mu.Unlock()
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return nil, false, ctx.Err()
+		}
+	}
+}
+
+// charge reports the usage and cost of the shared response for the follower,
+// as if it had made the upstream call itself, so client limits, spend caps
+// and the request log account for it
+func (f *inflight) charge(c *gin.Context) *CachedResponse {
+	resp := f.response()
+	resp.Cost = setUsage(c, resp.Model, resp.Usage)
+	return resp
+}
+
+// response returns the complete response
+func (f *inflight) response() *CachedResponse {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return &CachedResponse{Model: f.model, Content: strings.Join(f.chunks, ""), FinishReason: f.finishReason, Usage: f.usage}
+}
+
+// servedModel returns the model serving the request, once known
+func (f *inflight) servedModel() string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.model
+}
+
+// Follow answers a request from the flight it joined, in the Ollama or OpenAI
+// format. It returns false, having written nothing, if the leader failed
+// first; the request then goes upstream itself.
+func (f *inflight) Follow(c *gin.Context, openAI, stream, includeUsage bool) bool {
+	defer f.leave()
+	ctx := c.Request.Context()
+	var w *replayStream
+	for sent := 0; ; {
+		chunks, done, err := f.wait(ctx, sent)
+		if ctx.Err() != nil {
+			return true // the client is gone
+		}
+		if err != nil && w == nil {
+			slog.Info("coalesced request failed, sending it upstream", "error", err)
+			return false
+		}
+		if err != nil {
+			if openAI {
+				w.openAIError(err)
+			} else {
+				w.ollamaError(err)
+			}
+			return true
+		}
+		if !stream {
+			if !done {
+				sent += len(chunks)
+				continue
+			}
+			resp := f.charge(c)
+			c.Header(coalescedHeader, "true")
+			c.Header(servedModelHeader, resp.Model)
+			c.Header(requestCostHeader, formatCost(resp.Cost))
+			if openAI {
+				writeCachedOpenAI(c, resp, false, false)
+			} else {
+				writeCachedOllama(c, resp, false)
+			}
+			return true
+		}
+
+		if w == nil {
+			c.Header(coalescedHeader, "true")
+			c.Header(servedModelHeader, f.servedModel())
+			contentType := "application/x-ndjson"
+			if openAI {
+				contentType = "text/event-stream"
+			}
+			w = newReplayStream(c, contentType)
+			defer trackStream(c)()
+		}
+		model := f.servedModel()
+		for _, chunk := range chunks {
+			if openAI {
+				w.openAIChunk(model, chunk)
+			} else {
+				w.ollamaChunk(model, chunk)
+			}
+		}
+		sent += len(chunks)
+		if done {
+			resp := f.charge(c)
+			if openAI {
+				w.openAIFinal(resp, includeUsage)
+			} else {
+				w.ollamaFinal(resp)
+			}
+			return true
+		}
+	}
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sashabaranov/go-openai"
+)
+
+func newFollowerContext(t *testing.T) (*gin.Context, *httptest.ResponseRecorder) {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest(http.MethodPost, "/v1/chat/completions", nil)
+	return c, w
+}
+
+func TestCoalescerJoin(t *testing.T) {
+	tests := []struct {
+		name      string
+		coalesce  bool
+		key       string
+		followers bool
+	}{
+		{name: "disabled", coalesce: false, key: "k1"},
+		{name: "bypassed request", coalesce: true, key: ""},
+		{name: "enabled", coalesce: true, key: "k2", followers: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useConfig(t, func(c *Config) { c.Routing.Coalesce = tt.coalesce })
+			leaderFlight, leader := coalescer.Join(tt.key)
+			if !leader {
+				t.Fatal("first request does not lead")
+			}
+			defer leaderFlight.Done()
+			flight, leader := coalescer.Join(tt.key)
+			if leader == tt.followers {
+				t.Fatalf("second request leads = %v, want %v", leader, !tt.followers)
+			}
+			if tt.followers && flight != leaderFlight {
+				t.Error("follower joined another flight")
+			}
+			if !tt.followers && flight != nil {
+				t.Error("uncoalesced request got a flight")
+			}
+		})
+	}
+}
+
+func TestCoalescerFinishEndsFlight(t *testing.T) {
+	useConfig(t, func(c *Config) { c.Routing.Coalesce = true })
+	f, _ := coalescer.Join("finish")
+	f.Finish("stop", openai.Usage{})
+	if _, leader := coalescer.Join("finish"); !leader {
+		t.Error("request after the finished flight follows it")
+	}
+	coalescer.remove(coalescer.flights["finish"])
+}
+
+func TestFollowChargesFollowers(t *testing.T) {
+	useConfig(t, func(c *Config) { c.Routing.Coalesce = true })
+	leaderFlight, _ := coalescer.Join("charge")
+	follower, _ := coalescer.Join("charge")
+	usage := openai.Usage{PromptTokens: 3, CompletionTokens: 2, TotalTokens: 5}
+	go func() {
+		leaderFlight.Start("openai/gpt-4o")
+		leaderFlight.Write("Hel")
+		leaderFlight.Write("lo")
+		leaderFlight.Finish("stop", usage)
+	}()
+
+	c, w := newFollowerContext(t)
+	if !follower.Follow(c, true, false, false) {
+		t.Fatal("follower was not answered")
+	}
+	var resp chatResponseWithCost
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if got := resp.Choices[0].Message.Content; got != "Hello" {
+		t.Errorf("content = %q, want Hello", got)
+	}
+	if w.Header().Get(coalescedHeader) != "true" || w.Header().Get(servedModelHeader) != "openai/gpt-4o" {
+		t.Errorf("headers = %v", w.Header())
+	}
+	charged, _ := c.Get("usage")
+	if charged != usage {
+		t.Errorf("charged usage = %+v, want %+v", charged, usage)
+	}
+	if c.GetString("served_model") != "openai/gpt-4o" {
+		t.Errorf("served model = %q", c.GetString("served_model"))
+	}
+}
+
+func TestFollowLeaderFailure(t *testing.T) {
+	tests := []struct {
+		name     string
+		openAI   bool
+		stream   bool
+		written  []string
+		answered bool
+		want     []string // in the follower's response
+	}{
+		{name: "before any output", openAI: true, stream: true, answered: false},
+		{name: "non-stream", openAI: true, stream: false, written: []string{"Hel"}, answered: false},
+		{name: "openai stream", openAI: true, stream: true, written: []string{"Hel"}, answered: true,
+			want: []string{`"content":"Hel"`, `"error":`, "data: [DONE]"}},
+		{name: "ollama stream", openAI: false, stream: true, written: []string{"Hel"}, answered: true,
+			want: []string{`"content":"Hel"`, `"error":"Stream error: coalesced request failed"`}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useConfig(t, func(c *Config) { c.Routing.Coalesce = true })
+			leaderFlight, _ := coalescer.Join("fail")
+			follower, _ := coalescer.Join("fail")
+			leaderFlight.Start("openai/gpt-4o")
+			for _, chunk := range tt.written {
+				leaderFlight.Write(chunk)
+			}
+			go func() {
+				time.Sleep(20 * time.Millisecond)
+				leaderFlight.Done()
+			}()
+
+			c, w := newFollowerContext(t)
+			if got := follower.Follow(c, tt.openAI, tt.stream, false); got != tt.answered {
+				t.Fatalf("Follow() = %v, want %v", got, tt.answered)
+			}
+			if !tt.answered && w.Body.Len() > 0 {
+				t.Errorf("follower sent upstream after writing %q", w.Body.String())
+			}
+			for _, want := range tt.want {
+				if !strings.Contains(w.Body.String(), want) {
+					t.Errorf("response lacks %q:\n%s", want, w.Body.String())
+				}
+			}
+		})
+	}
+}
+
+func TestFlightContext(t *testing.T) {
+	useConfig(t, func(c *Config) { c.Routing.Coalesce = true })
+	leaderFlight, _ := coalescer.Join("context")
+	defer leaderFlight.Done()
+	clientCtx, disconnect := context.WithCancel(context.Background())
+	upstreamCtx, cancel := leaderFlight.Context(clientCtx)
+	defer cancel()
+
+	follower, _ := coalescer.Join("context")
+	disconnect()
+	time.Sleep(20 * time.Millisecond)
+	if upstreamCtx.Err() != nil {
+		t.Fatal("upstream call canceled while a follower waits")
+	}
+	follower.leave()
+	select {
+	case <-upstreamCtx.Done():
+	case <-time.After(time.Second):
+		t.Fatal("upstream call not canceled after everyone left")
+	}
+}
+
+func TestFlightContextWithoutFollowers(t *testing.T) {
+	var nilFlight *inflight
+	ctx := context.Background()
+	if got, _ := nilFlight.Context(ctx); got != ctx {
+		t.Error("uncoalesced request got another context")
+	}
+
+	useConfig(t, func(c *Config) { c.Routing.Coalesce = true })
+	f, _ := coalescer.Join("alone")
+	defer f.Done()
+	clientCtx, disconnect := context.WithCancel(context.Background())
+	upstreamCtx, cancel := f.Context(clientCtx)
+	defer cancel()
+	disconnect()
+	select {
+	case <-upstreamCtx.Done():
+	case <-time.After(time.Second):
+		t.Fatal("upstream call not canceled when its only client left")
+	}
+}
@@ -0,0 +1,584 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/url"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Config is the effective proxy configuration. It is built from the defaults,
+// then the YAML file named by CONFIG_FILE, then the environment variables, so
+// existing env-only deployments keep working unchanged.
+type Config struct {
+	Listen   ListenConfig   `yaml:"listen"`
+	Upstream UpstreamConfig `yaml:"upstream"`
+	Routing  RoutingConfig  `yaml:"routing"`
+	Timeouts TimeoutConfig  `yaml:"timeouts"`
+	Limits   LimitConfig    `yaml:"limits"`
+	Auth     AuthConfig     `yaml:"auth"`
+	Storage  StorageConfig  `yaml:"storage"`
+	Logging  LoggingConfig  `yaml:"logging"`
+	Tracing  TracingConfig  `yaml:"tracing"`
+
+	// ResponseCache answers repeated identical chat requests from SQLite
+	ResponseCache ResponseCacheConfig `yaml:"response_cache"`
+	// Cassette records upstream traffic to a file, or replays it offline
+	Cassette CassetteConfig `yaml:"cassette"`
+
+	// Aliases map client-facing model names to OpenRouter models
+	Aliases map[string]AliasTargets `yaml:"aliases,omitempty"`
+	// VirtualModels map router model names to model filter rules that
+	// restrict free-mode fallback
+	VirtualModels map[string][]string `yaml:"virtual_models"`
+	// Fallbacks map a model, alias or virtual model name to the models tried
+	// when it fails. An empty chain disables fallback for that name.
+	Fallbacks map[string][]string `yaml:"fallbacks,omitempty"`
+	// Extensions are OpenRouter request fields, such as provider preferences,
+	// added to upstream chat requests
+	Extensions ExtensionsConfig `yaml:"extensions,omitempty"`
+
+	virtualModels map[string]*ModelFilter // compiled VirtualModels
+	extensions    *compiledExtensions     // Extensions encoded as JSON
+}
+
+// ExtensionsConfig holds OpenRouter request fields: Default for every request,
+// Models per model by full ID or display name
+type ExtensionsConfig struct {
+	Default map[string]interface{}            `yaml:"default,omitempty"`
+	Models  map[string]map[string]interface{} `yaml:"models,omitempty"`
+}
+
+type ListenConfig struct {
+	Port int `yaml:"port"`
+}
+
+type UpstreamConfig struct {
+	BaseURL     string   `yaml:"base_url"`
+	APIKeys     []string `yaml:"api_keys"`
+	KeyStrategy string   `yaml:"key_strategy"`
+	QuotaSync   bool     `yaml:"quota_sync"`
+}
+
+type RoutingConfig struct {
+	FreeMode     bool          `yaml:"free_mode"`
+	ToolUseOnly  bool          `yaml:"tool_use_only"`
+	Fallback     string        `yaml:"fallback"`
+	Coalesce     bool          `yaml:"coalesce"` // share one upstream call between identical concurrent requests
+	ModelFilter  string        `yaml:"model_filter"`
+	CatalogCache string        `yaml:"catalog_cache"`
+	CatalogTTL   time.Duration `yaml:"catalog_ttl"`
+	ConfigWatch  time.Duration `yaml:"config_watch"`
+}
+
+type TimeoutConfig struct {
+	Request     time.Duration `yaml:"request"`
+	Stream      time.Duration `yaml:"stream"`
+	Catalog     time.Duration `yaml:"catalog"`
+	ServerRead  time.Duration `yaml:"server_read"`
+	ServerWrite time.Duration `yaml:"server_write"`
+	ServerIdle  time.Duration `yaml:"server_idle"`
+	Shutdown    time.Duration `yaml:"shutdown"`
+}
+
+type LimitConfig struct {
+	FailureCooldown   time.Duration `yaml:"failure_cooldown"`
+	RateLimitCooldown time.Duration `yaml:"rate_limit_cooldown"`
+	FreeDailyLimit    int           `yaml:"free_daily_limit"` // 0 follows the account tier
+	FreeMinuteLimit   int           `yaml:"free_minute_limit"`
+	QuotaReserve      int           `yaml:"quota_reserve"`
+	DailySpendCap     float64       `yaml:"daily_spend_cap"` // USD, 0 means no cap
+	MonthlySpendCap   float64       `yaml:"monthly_spend_cap"`
+}
+
+type AuthConfig struct {
+	Enabled     bool   `yaml:"enabled"`
+	Header      string `yaml:"header"`
+	AdminAPIKey string `yaml:"admin_api_key"`
+}
+
+type StorageConfig struct {
+	Database                string `yaml:"database"`
+	RequestLogRetentionDays int    `yaml:"request_log_retention_days"`
+}
+
+type ResponseCacheConfig struct {
+	Enabled    bool          `yaml:"enabled"`
+	TTL        time.Duration `yaml:"ttl"`
+	MaxEntries int           `yaml:"max_entries"` // 0 means no limit
+	MaxSizeMB  int           `yaml:"max_size_mb"` // 0 means no limit
+}
+
+type CassetteConfig struct {
+	Mode         string   `yaml:"mode"` // off, record or replay
+	Path         string   `yaml:"path"`
+	Match        []string `yaml:"match"`         // request parts compared in replay mode
+	IgnoreFields []string `yaml:"ignore_fields"` // body fields left out of the comparison
+	Realtime     bool     `yaml:"realtime"`      // replay with the recorded timing
+}
+
+type LoggingConfig struct {
+	Level string `yaml:"level"`
+}
+
+type TracingConfig struct {
+	Exporter    string `yaml:"exporter"`
+	Protocol    string `yaml:"protocol"`
+	ServiceName string `yaml:"service_name"`
+}
+
+func defaultConfig() *Config {
+	return &Config{
+		Listen: ListenConfig{Port: 11434},
+		Upstream: UpstreamConfig{
+			BaseURL:     "https://openrouter.ai/api/v1/",
+			KeyStrategy: "round_robin",
+		},
+		Routing: RoutingConfig{
+			FreeMode:     true,
+			Fallback:     FallbackLenient,
+			ModelFilter:  "/models-filter/filter",
+			CatalogCache: "free-models",
+			CatalogTTL:   24 * time.Hour,
+			ConfigWatch:  5 * time.Second,
+		},
+		Timeouts: TimeoutConfig{
+			Request:     30 * time.Second,
+			Stream:      60 * time.Second,
+			Catalog:     10 * time.Second,
+			ServerRead:  30 * time.Second,
+			ServerWrite: 30 * time.Second,
+			ServerIdle:  120 * time.Second,
+			Shutdown:    10 * time.Second,
+		},
+		Limits: LimitConfig{
+			FailureCooldown:   5 * time.Minute,
+			RateLimitCooldown: time.Minute,
+			FreeMinuteLimit:   freeMinuteLimit,
+		},
+		Auth:          AuthConfig{Header: "X-API-Key"},
+		Storage:       StorageConfig{Database: "failures.db", RequestLogRetentionDays: 30},
+		ResponseCache: ResponseCacheConfig{TTL: time.Hour, MaxEntries: 10000, MaxSizeMB: 100},
+		Cassette:      CassetteConfig{Mode: CassetteOff, Path: "cassette.json", Match: []string{"method", "path", "body"}},
+		Logging:       LoggingConfig{Level: "info"},
+		Tracing:       TracingConfig{Exporter: "none", Protocol: "http/protobuf", ServiceName: "ollama-openrouter-proxy"},
+		VirtualModels: defaultVirtualModels(),
+	}
+}
+
+// proxyConfig is the active configuration, swapped as a whole on reload
+var proxyConfig atomic.Pointer[Config]
+
+// logLevel is the level of the default logger, changed when logging.level is reloaded
+var logLevel slog.LevelVar
+
+var fallbackConfig = defaultConfig()
+
+// currentConfig returns the active configuration, or the defaults before one
+// has been loaded
+func currentConfig() *Config {
+	if c := proxyConfig.Load(); c != nil {
+		return c
+	}
+	return fallbackConfig
+}
+
+// configPath returns the configuration file set with CONFIG_FILE, if any
+func configPath() string {
+	return os.Getenv("CONFIG_FILE")
+}
+
+// loadConfig builds and validates the configuration from the file at path (may
+// be empty) and the environment
+func loadConfig(path string) (*Config, error) {
+	cfg := defaultConfig()
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		if err := decodeConfig(bytes.NewReader(data), cfg); err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+	}
+	if err := errors.Join(applyEnv(cfg), cfg.Validate()); err != nil {
+		return nil, err
+	}
+	virtual, err := compileVirtualModels(cfg.VirtualModels)
+	if err != nil {
+		return nil, err
+	}
+	cfg.virtualModels = virtual
+	if cfg.extensions, err = compileExtensions(cfg.Extensions); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// decodeConfig reads YAML over cfg, rejecting keys that do not exist
+func decodeConfig(r io.Reader, cfg *Config) error {
+	dec := yaml.NewDecoder(r)
+	dec.KnownFields(true)
+	if err := dec.Decode(cfg); err != nil && err != io.EOF {
+		return err
+	}
+	return nil
+}
+
+// configEnv maps the environment variables to configuration fields. Values
+// that do not parse are reported instead of being ignored.
+var configEnv = []struct {
+	name  string
+	apply func(c *Config, v string) error
+}{
+	{"PORT", func(c *Config, v string) error { return parseInt(v, &c.Listen.Port) }},
+	{"OPENROUTER_BASE_URL", func(c *Config, v string) error { c.Upstream.BaseURL = v; return nil }},
+	{"KEY_STRATEGY", func(c *Config, v string) error { c.Upstream.KeyStrategy = v; return nil }},
+	{"QUOTA_SYNC", func(c *Config, v string) error { return parseBool(v, &c.Upstream.QuotaSync) }},
+	{"FREE_MODE", func(c *Config, v string) error { return parseBool(v, &c.Routing.FreeMode) }},
+	{"TOOL_USE_ONLY", func(c *Config, v string) error { return parseBool(v, &c.Routing.ToolUseOnly) }},
+	{"FALLBACK_MODE", func(c *Config, v string) error { c.Routing.Fallback = v; return nil }},
+	{"COALESCE_REQUESTS", func(c *Config, v string) error { return parseBool(v, &c.Routing.Coalesce) }},
+	{"MODEL_FILTER_PATH", func(c *Config, v string) error { c.Routing.ModelFilter = v; return nil }},
+	{"FREE_MODELS_CACHE", func(c *Config, v string) error { c.Routing.CatalogCache = v; return nil }},
+	{"CACHE_TTL_HOURS", func(c *Config, v string) error { return parseUnits(v, time.Hour, &c.Routing.CatalogTTL) }},
+	{"CONFIG_WATCH_SECONDS", func(c *Config, v string) error { return parseUnits(v, time.Second, &c.Routing.ConfigWatch) }},
+	{"FAILURE_COOLDOWN_MINUTES", func(c *Config, v string) error { return parseUnits(v, time.Minute, &c.Limits.FailureCooldown) }},
+	{"RATELIMIT_COOLDOWN_MINUTES", func(c *Config, v string) error { return parseUnits(v, time.Minute, &c.Limits.RateLimitCooldown) }},
+	{"FREE_DAILY_LIMIT", func(c *Config, v string) error { return parseInt(v, &c.Limits.FreeDailyLimit) }},
+	{"FREE_MINUTE_LIMIT", func(c *Config, v string) error { return parseInt(v, &c.Limits.FreeMinuteLimit) }},
+	{"QUOTA_RESERVE", func(c *Config, v string) error { return parseInt(v, &c.Limits.QuotaReserve) }},
+	{"DAILY_SPEND_CAP", func(c *Config, v string) error { return parseFloat(v, &c.Limits.DailySpendCap) }},
+	{"MONTHLY_SPEND_CAP", func(c *Config, v string) error { return parseFloat(v, &c.Limits.MonthlySpendCap) }},
+	{"AUTH_ENABLED", func(c *Config, v string) error { return parseBool(v, &c.Auth.Enabled) }},
+	{"AUTH_HEADER", func(c *Config, v string) error { c.Auth.Header = v; return nil }},
+	{"ADMIN_API_KEY", func(c *Config, v string) error { c.Auth.AdminAPIKey = v; return nil }},
+	{"FAILURE_DB", func(c *Config, v string) error { c.Storage.Database = v; return nil }},
+	{"REQUEST_LOG_RETENTION_DAYS", func(c *Config, v string) error { return parseInt(v, &c.Storage.RequestLogRetentionDays) }},
+	{"RESPONSE_CACHE", func(c *Config, v string) error { return parseBool(v, &c.ResponseCache.Enabled) }},
+	{"RESPONSE_CACHE_TTL_MINUTES", func(c *Config, v string) error { return parseUnits(v, time.Minute, &c.ResponseCache.TTL) }},
+	{"RESPONSE_CACHE_MAX_ENTRIES", func(c *Config, v string) error { return parseInt(v, &c.ResponseCache.MaxEntries) }},
+	{"RESPONSE_CACHE_MAX_SIZE_MB", func(c *Config, v string) error { return parseInt(v, &c.ResponseCache.MaxSizeMB) }},
+	{"CASSETTE_MODE", func(c *Config, v string) error { c.Cassette.Mode = strings.ToLower(v); return nil }},
+	{"CASSETTE_PATH", func(c *Config, v string) error { c.Cassette.Path = v; return nil }},
+	{"CASSETTE_MATCH", func(c *Config, v string) error { c.Cassette.Match = splitList(v); return nil }},
+	{"CASSETTE_REALTIME", func(c *Config, v string) error { return parseBool(v, &c.Cassette.Realtime) }},
+	{"LOG_LEVEL", func(c *Config, v string) error { c.Logging.Level = strings.ToLower(v); return nil }},
+	{"OTEL_TRACES_EXPORTER", func(c *Config, v string) error { c.Tracing.Exporter = strings.ToLower(v); return nil }},
+	{"OTEL_EXPORTER_OTLP_PROTOCOL", func(c *Config, v string) error { c.Tracing.Protocol = v; return nil }},
+	{"OTEL_SERVICE_NAME", func(c *Config, v string) error { c.Tracing.ServiceName = v; return nil }},
+}
+
+// applyEnv overrides cfg with the environment variables that are set
+func applyEnv(cfg *Config) error {
+	var errs []error
+	for _, env := range configEnv {
+		v := os.Getenv(env.name)
+		if v == "" {
+			continue
+		}
+		if err := env.apply(cfg, strings.TrimSpace(v)); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", env.name, err))
+		}
+	}
+	// Keys from the environment replace the keys of the file
+	if keys := loadAPIKeys(); len(keys) > 0 {
+		cfg.Upstream.APIKeys = keys
+	}
+	return errors.Join(errs...)
+}
+
+func parseBool(v string, dst *bool) error {
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		return fmt.Errorf("invalid boolean %q", v)
+	}
+	*dst = b
+	return nil
+}
+
+func parseInt(v string, dst *int) error {
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		return fmt.Errorf("invalid number %q", v)
+	}
+	*dst = n
+	return nil
+}
+
+func parseFloat(v string, dst *float64) error {
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		return fmt.Errorf("invalid number %q", v)
+	}
+	*dst = f
+	return nil
+}
+
+// splitList reads a comma or space separated list
+func splitList(v string) []string {
+	return strings.FieldsFunc(v, func(r rune) bool { return r == ',' || r == ' ' })
+}
+
+// parseUnits reads a plain number of units, e.g. minutes, or a Go duration
+func parseUnits(v string, unit time.Duration, dst *time.Duration) error {
+	if f, err := strconv.ParseFloat(v, 64); err == nil {
+		*dst = time.Duration(f * float64(unit))
+		return nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		return fmt.Errorf("invalid duration %q", v)
+	}
+	*dst = d
+	return nil
+}
+
+// Validate reports every invalid setting, named by its path in the file
+func (c *Config) Validate() error {
+	var errs []error
+	check := func(ok bool, field, format string, args ...any) {
+		if !ok {
+			errs = append(errs, fmt.Errorf("%s: %s", field, fmt.Sprintf(format, args...)))
+		}
+	}
+	oneOf := func(value, field string, allowed ...string) {
+		check(contains(allowed, value), field, "%q is not one of %s", value, strings.Join(allowed, ", "))
+	}
+
+	check(c.Listen.Port > 0 && c.Listen.Port < 65536, "listen.port", "%d is not a valid port", c.Listen.Port)
+
+	u, err := url.Parse(c.Upstream.BaseURL)
+	check(err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != "", "upstream.base_url", "%q is not an http(s) URL", c.Upstream.BaseURL)
+	oneOf(c.Upstream.KeyStrategy, "upstream.key_strategy", KeyStrategyRoundRobin, KeyStrategyLeastUsed)
+	for i, k := range c.Upstream.APIKeys {
+		check(strings.TrimSpace(k) != "", fmt.Sprintf("upstream.api_keys[%d]", i), "empty key")
+	}
+
+	check(c.Routing.ModelFilter != "", "routing.model_filter", "must not be empty")
+	oneOf(c.Routing.Fallback, "routing.fallback", FallbackLenient, FallbackStrict)
+	check(c.Routing.CatalogCache != "", "routing.catalog_cache", "must not be empty")
+	check(c.Routing.CatalogTTL > 0, "routing.catalog_ttl", "must be positive")
+	check(c.Routing.ConfigWatch >= 0, "routing.config_watch", "must not be negative")
+
+	for field, d := range map[string]time.Duration{
+		"timeouts.request":      c.Timeouts.Request,
+		"timeouts.stream":       c.Timeouts.Stream,
+		"timeouts.catalog":      c.Timeouts.Catalog,
+		"timeouts.server_read":  c.Timeouts.ServerRead,
+		"timeouts.server_write": c.Timeouts.ServerWrite,
+		"timeouts.server_idle":  c.Timeouts.ServerIdle,
+		"timeouts.shutdown":     c.Timeouts.Shutdown,
+	} {
+		check(d > 0, field, "must be positive")
+	}
+
+	check(c.Limits.FailureCooldown >= 0, "limits.failure_cooldown", "must not be negative")
+	check(c.Limits.RateLimitCooldown >= 0, "limits.rate_limit_cooldown", "must not be negative")
+	check(c.Limits.FreeDailyLimit >= 0, "limits.free_daily_limit", "must not be negative")
+	check(c.Limits.FreeMinuteLimit >= 0, "limits.free_minute_limit", "must not be negative")
+	check(c.Limits.QuotaReserve >= 0, "limits.quota_reserve", "must not be negative")
+	check(c.Limits.DailySpendCap >= 0, "limits.daily_spend_cap", "must not be negative")
+	check(c.Limits.MonthlySpendCap >= 0, "limits.monthly_spend_cap", "must not be negative")
+
+	check(c.Auth.Header != "", "auth.header", "must not be empty")
+	check(c.Storage.Database != "", "storage.database", "must not be empty")
+	check(c.Storage.RequestLogRetentionDays >= 0, "storage.request_log_retention_days", "must not be negative")
+	check(c.ResponseCache.TTL > 0, "response_cache.ttl", "must be positive")
+	check(c.ResponseCache.MaxEntries >= 0, "response_cache.max_entries", "must not be negative")
+	check(c.ResponseCache.MaxSizeMB >= 0, "response_cache.max_size_mb", "must not be negative")
+
+	oneOf(c.Cassette.Mode, "cassette.mode", CassetteOff, CassetteRecord, CassetteReplay)
+	if c.Cassette.Mode != CassetteOff {
+		check(c.Cassette.Path != "", "cassette.path", "must not be empty")
+		check(len(c.Cassette.Match) > 0, "cassette.match", "must not be empty")
+	}
+	for i, field := range c.Cassette.Match {
+		check(contains(cassetteMatchFields, field), fmt.Sprintf("cassette.match[%d]", i), "must be one of %s", strings.Join(cassetteMatchFields, ", "))
+	}
+
+	oneOf(c.Logging.Level, "logging.level", "debug", "info", "warn", "error")
+	oneOf(c.Tracing.Exporter, "tracing.exporter", "none", "otlp", "console")
+	oneOf(c.Tracing.Protocol, "tracing.protocol", "http/protobuf", "grpc")
+
+	aliases := make([]string, 0, len(c.Aliases))
+	for name := range c.Aliases {
+		aliases = append(aliases, name)
+	}
+	sort.Strings(aliases)
+	for _, name := range aliases {
+		check(strings.TrimSpace(name) != "", "aliases", "empty alias name")
+		check(len(c.Aliases[name]) > 0, "aliases."+name, "no target models")
+		for i, target := range c.Aliases[name] {
+			check(strings.TrimSpace(target) != "", fmt.Sprintf("aliases.%s[%d]", name, i), "empty model")
+		}
+	}
+
+	virtual := make([]string, 0, len(c.VirtualModels))
+	for name := range c.VirtualModels {
+		virtual = append(virtual, name)
+	}
+	sort.Strings(virtual)
+	for _, name := range virtual {
+		check(strings.TrimSpace(name) != "", "virtual_models", "empty model name")
+		_, isAlias := c.Aliases[name]
+		check(!isAlias, "virtual_models."+name, "also defined as an alias")
+		_, err := compileVirtualModels(map[string][]string{name: c.VirtualModels[name]})
+		check(err == nil, "virtual_models."+name, "%v", err)
+	}
+
+	fallbacks := make([]string, 0, len(c.Fallbacks))
+	for name := range c.Fallbacks {
+		fallbacks = append(fallbacks, name)
+	}
+	sort.Strings(fallbacks)
+	for _, name := range fallbacks {
+		check(strings.TrimSpace(name) != "", "fallbacks", "empty model name")
+		for i, entry := range c.Fallbacks[name] {
+			check(strings.TrimSpace(entry) != "", fmt.Sprintf("fallbacks.%s[%d]", name, i), "empty model")
+			check(entry != name, fmt.Sprintf("fallbacks.%s[%d]", name, i), "falls back to itself")
+		}
+	}
+
+	_, err = encodeExtras(c.Extensions.Default)
+	check(err == nil, "extensions.default", "%v", err)
+	extended := make([]string, 0, len(c.Extensions.Models))
+	for name := range c.Extensions.Models {
+		extended = append(extended, name)
+	}
+	sort.Strings(extended)
+	for _, name := range extended {
+		_, err := encodeExtras(c.Extensions.Models[name])
+		check(err == nil, "extensions.models."+name, "%v", err)
+	}
+	return errors.Join(errs...)
+}
+
+// Redacted returns a copy safe to print: API keys are replaced by their
+// fingerprint and the admin key is hidden
+func (c *Config) Redacted() *Config {
+	r := *c
+	r.Upstream.APIKeys = make([]string, len(c.Upstream.APIKeys))
+	for i, k := range c.Upstream.APIKeys {
+		r.Upstream.APIKeys[i] = "redacted:" + keyFingerprint(k)
+	}
+	if r.Auth.AdminAPIKey != "" {
+		r.Auth.AdminAPIKey = "redacted"
+	}
+	return &r
+}
+
+// slogLevel returns the slog level of logging.level
+func (c *Config) slogLevel() slog.Level {
+	switch c.Logging.Level {
+	case "debug":
+		return slog.LevelDebug
+	case "warn":
+		return slog.LevelWarn
+	case "error":
+		return slog.LevelError
+	}
+	return slog.LevelInfo
+}
+
+// reloadableConfig lists the settings that take effect without a restart
+var reloadableConfig = map[string]bool{
+	"logging.level":              true,
+	"routing.tool_use_only":      true,
+	"routing.fallback":           true,
+	"routing.coalesce":           true,
+	"limits.failure_cooldown":    true,
+	"limits.rate_limit_cooldown": true,
+	"limits.daily_spend_cap":     true,
+	"limits.monthly_spend_cap":   true,
+	"timeouts.request":           true,
+	"timeouts.stream":            true,
+	"response_cache.ttl":         true,
+	"response_cache.max_entries": true,
+	"response_cache.max_size_mb": true,
+	"aliases":                    true,
+	"virtual_models":             true,
+	"fallbacks":                  true,
+	"extensions.default":         true,
+	"extensions.models":          true,
+}
+
+// reloadConfig re-reads the configuration and swaps it in if it is valid.
+// Changed settings that are only read at startup are reported.
+func reloadConfig(path string) error {
+	next, err := loadConfig(path)
+	if err != nil {
+		return err
+	}
+	prev := currentConfig()
+	var restart []string
+	for _, field := range configChanges(reflect.ValueOf(*prev), reflect.ValueOf(*next), "") {
+		if !reloadableConfig[field] {
+			restart = append(restart, field)
+		}
+	}
+	if len(restart) > 0 {
+		slog.Warn("configuration changes need a restart to take effect", "settings", restart)
+	}
+	proxyConfig.Store(next)
+	logLevel.Set(next.slogLevel())
+	return nil
+}
+
+// configChanges returns the paths of the settings that differ between a and b
+func configChanges(a, b reflect.Value, prefix string) []string {
+	var changed []string
+	for i := 0; i < a.NumField(); i++ {
+		if !a.Type().Field(i).IsExported() {
+			continue
+		}
+		name := strings.Split(a.Type().Field(i).Tag.Get("yaml"), ",")[0]
+		if prefix != "" {
+			name = prefix + "." + name
+		}
+		if a.Field(i).Kind() == reflect.Struct {
+			changed = append(changed, configChanges(a.Field(i), b.Field(i), name)...)
+			continue
+		}
+		if !reflect.DeepEqual(a.Field(i).Interface(), b.Field(i).Interface()) {
+			changed = append(changed, name)
+		}
+	}
+	return changed
+}
+
+// runConfigCommand implements `ollama-proxy config print`, which shows the
+// effective configuration with secrets redacted
+func runConfigCommand(args []string) int {
+	if len(args) != 1 || args[0] != "print" {
+		fmt.Fprintln(os.Stderr, "usage: ollama-proxy config print")
+		return 2
+	}
+	cfg, err := loadConfig(configPath())
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "invalid configuration:", err)
+		return 1
+	}
+	enc := yaml.NewEncoder(os.Stdout)
+	enc.SetIndent(2)
+	if err := enc.Encode(cfg.Redacted()); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if err := enc.Close(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
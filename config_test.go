@@ -0,0 +1,57 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestConfigValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		change func(c *Config)
+		want   string // field named in the error, "" for a valid config
+	}{
+		{name: "defaults", change: func(c *Config) {}},
+		{name: "port", change: func(c *Config) { c.Listen.Port = 70000 }, want: "listen.port"},
+		{name: "base url", change: func(c *Config) { c.Upstream.BaseURL = "openrouter.ai" }, want: "upstream.base_url"},
+		{name: "key strategy", change: func(c *Config) { c.Upstream.KeyStrategy = "random" }, want: "upstream.key_strategy"},
+		{name: "empty api key", change: func(c *Config) { c.Upstream.APIKeys = []string{"k", " "} }, want: "upstream.api_keys[1]"},
+		{name: "fallback mode", change: func(c *Config) { c.Routing.Fallback = "sometimes" }, want: "routing.fallback"},
+		{name: "catalog ttl", change: func(c *Config) { c.Routing.CatalogTTL = 0 }, want: "routing.catalog_ttl"},
+		{name: "stream timeout", change: func(c *Config) { c.Timeouts.Stream = -time.Second }, want: "timeouts.stream"},
+		{name: "response cache ttl", change: func(c *Config) { c.ResponseCache.TTL = 0 }, want: "response_cache.ttl"},
+		{name: "response cache entries", change: func(c *Config) { c.ResponseCache.MaxEntries = -1 }, want: "response_cache.max_entries"},
+		{name: "cassette mode", change: func(c *Config) { c.Cassette.Mode = "rewind" }, want: "cassette.mode"},
+		{name: "cassette match field", change: func(c *Config) {
+			c.Cassette.Mode = CassetteReplay
+			c.Cassette.Match = []string{"path", "headers"}
+		}, want: "cassette.match"},
+		{name: "cassette off ignores match", change: func(c *Config) { c.Cassette.Match = nil }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := defaultConfig()
+			tt.change(c)
+			err := c.Validate()
+			if tt.want == "" {
+				if err != nil {
+					t.Fatalf("Validate() = %v, want nil", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("Validate() = %v, want an error for %s", err, tt.want)
+			}
+		})
+	}
+}
+
+// useConfig makes a changed default configuration active for the test
+func useConfig(t *testing.T, change func(c *Config)) {
+	t.Helper()
+	c := defaultConfig()
+	change(c)
+	prev := proxyConfig.Swap(c)
+	t.Cleanup(func() { proxyConfig.Store(prev) })
+}
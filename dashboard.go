@@ -0,0 +1,29 @@
+package main
+
+import (
+	_ "embed"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// The dashboard is a single self-contained page so it works without internet
+// access. It holds no data itself and calls the /admin API with the admin key.
+//
+//go:embed dashboard/index.html
+var dashboardHTML []byte
+
+// registerDashboardRoutes serves the status dashboard and the status endpoint
+// it polls for key and quota state
+func registerDashboardRoutes(r *gin.Engine, admin *gin.RouterGroup) {
+	r.GET("/dashboard", func(c *gin.Context) {
+		c.Data(http.StatusOK, "text/html; charset=utf-8", dashboardHTML)
+	})
+
+	admin.GET("/status", func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{
+			"free_mode": freeMode,
+			"keys":      keyPool.Status(),
+		})
+	})
+}
@@ -3,14 +3,12 @@ package main
 import (
 	"database/sql"
 	_ "github.com/mattn/go-sqlite3"
-	"os"
+	"strings"
 	"time"
 )
 
 type FailureStore struct {
 	db *sql.DB
-	defaultCooldown time.Duration
-	rateLimitCooldown time.Duration
 }
 
 func NewFailureStore(path string) (*FailureStore, error) {
@@ -28,27 +26,13 @@ func NewFailureStore(path string) (*FailureStore, error) {
 		db.Close()
 		return nil, err
 	}
-	
-	// Set default cooldown periods
-	defaultCooldown := 5 * time.Minute
-	if cd := os.Getenv("FAILURE_COOLDOWN_MINUTES"); cd != "" {
-		if minutes, err := time.ParseDuration(cd + "m"); err == nil {
-			defaultCooldown = minutes
-		}
-	}
-	
-	rateLimitCooldown := 1 * time.Minute
-	if cd := os.Getenv("RATELIMIT_COOLDOWN_MINUTES"); cd != "" {
-		if minutes, err := time.ParseDuration(cd + "m"); err == nil {
-			rateLimitCooldown = minutes
-		}
+	// Databases created before last_error was tracked lack the column
+	if _, err = db.Exec(`ALTER TABLE failures ADD COLUMN last_error TEXT DEFAULT ''`); err != nil && !strings.Contains(err.Error(), "duplicate column") {
+		db.Close()
+		return nil, err
 	}
 	
-	return &FailureStore{
-		db: db,
-		defaultCooldown: defaultCooldown,
-		rateLimitCooldown: rateLimitCooldown,
-	}, nil
+	return &FailureStore{db: db}, nil
 }
 
 func (s *FailureStore) Close() error { return s.db.Close() }
@@ -58,14 +42,24 @@ func (s *FailureStore) MarkFailure(model string) error {
 }
 
 func (s *FailureStore) MarkFailureWithType(model string, failureType string) error {
+	return s.MarkFailureWithError(model, failureType, nil)
+}
+
+// MarkFailureWithError records a failure together with the error that caused it
+func (s *FailureStore) MarkFailureWithError(model string, failureType string, cause error) error {
+	lastError := ""
+	if cause != nil {
+		lastError = cause.Error()
+	}
 	_, err := s.db.Exec(`
-		INSERT INTO failures(model, failed_at, failure_type, failure_count) 
-		VALUES(?, ?, ?, 1) 
+		INSERT INTO failures(model, failed_at, failure_type, failure_count, last_error) 
+		VALUES(?, ?, ?, 1, ?) 
 		ON CONFLICT(model) DO UPDATE SET 
 			failed_at=excluded.failed_at,
 			failure_type=excluded.failure_type,
-			failure_count=failure_count+1
-	`, model, time.Now().Unix(), failureType)
+			failure_count=failure_count+1,
+			last_error=CASE WHEN excluded.last_error != '' THEN excluded.last_error ELSE last_error END
+	`, model, time.Now().Unix(), failureType, lastError)
 	return err
 }
 
@@ -81,24 +75,30 @@ func (s *FailureStore) ShouldSkip(model string) (bool, error) {
 		return false, err
 	}
 	
-	// Use different cooldown periods based on failure type
-	var cooldown time.Duration
-	if failureType == "rate_limit" {
-		cooldown = s.rateLimitCooldown
-	} else {
-		cooldown = s.defaultCooldown
-		// Exponential backoff for repeated failures
-		if failureCount > 1 {
-			cooldown = cooldown * time.Duration(min(failureCount, 5))
-		}
-	}
-	
-	if time.Since(time.Unix(ts, 0)) < cooldown {
+	if time.Since(time.Unix(ts, 0)) < s.cooldown(failureType, failureCount) {
 		return true, nil
 	}
 	return false, nil
 }
 
+// cooldown returns how long a model is skipped after a failure
+func (s *FailureStore) cooldown(failureType string, failureCount int) time.Duration {
+	// Use different cooldown periods based on failure type
+	switch failureType {
+	case "rate_limit":
+		return currentConfig().Limits.RateLimitCooldown
+	case "cleared":
+		// A success ended the failure, the record is only kept for history
+		return 0
+	}
+	cooldown := currentConfig().Limits.FailureCooldown
+	// Exponential backoff for repeated failures
+	if failureCount > 1 {
+		cooldown = cooldown * time.Duration(min(failureCount, 5))
+	}
+	return cooldown
+}
+
 func min(a, b int) int {
 	if a < b {
 		return a
@@ -122,3 +122,43 @@ func (s *FailureStore) ResetAllFailures() error {
 	_, err := s.db.Exec(`DELETE FROM failures`)
 	return err
 }
+
+// ModelFailure is the failure record of a model
+type ModelFailure struct {
+	Model         string     `json:"model"`
+	FailedAt      time.Time  `json:"failed_at"`
+	FailureType   string     `json:"failure_type"`
+	FailureCount  int        `json:"failure_count"`
+	LastError     string     `json:"last_error,omitempty"`
+	CooldownUntil *time.Time `json:"cooldown_until,omitempty"`
+}
+
+// ListFailures returns the failure records of all models, keyed by model
+func (s *FailureStore) ListFailures() (map[string]ModelFailure, error) {
+	rows, err := s.db.Query(`SELECT model, failed_at, failure_type, failure_count, COALESCE(last_error, '') FROM failures`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	failures := make(map[string]ModelFailure)
+	for rows.Next() {
+		var f ModelFailure
+		var ts int64
+		if err := rows.Scan(&f.Model, &ts, &f.FailureType, &f.FailureCount, &f.LastError); err != nil {
+			return nil, err
+		}
+		f.FailedAt = time.Unix(ts, 0).UTC()
+		if until := f.FailedAt.Add(s.cooldown(f.FailureType, f.FailureCount)); until.After(time.Now()) {
+			f.CooldownUntil = &until
+		}
+		failures[f.Model] = f
+	}
+	return failures, rows.Err()
+}
+
+// ResetFailure deletes the failure record of one model, ending its cooldown
+func (s *FailureStore) ResetFailure(model string) error {
+	_, err := s.db.Exec(`DELETE FROM failures WHERE model=?`, model)
+	return err
+}
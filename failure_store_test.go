@@ -0,0 +1,62 @@
+package main
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+)
+
+func TestFailureStoreShouldSkip(t *testing.T) {
+	tests := []struct {
+		name     string
+		failures []string // failure types recorded in order
+		clear    bool     // a success follows the failures
+		want     bool
+	}{
+		{name: "no failure"},
+		{name: "failed", failures: []string{"general"}, want: true},
+		{name: "rate limited", failures: []string{"rate_limit"}, want: true},
+		{name: "cleared by a success", failures: []string{"general", "general"}, clear: true},
+		{name: "failed again after a success", failures: []string{"general"}, clear: true, want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := NewFailureStore(filepath.Join(t.TempDir(), "failures.db"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer s.Close()
+
+			for _, failureType := range tt.failures {
+				if err := s.MarkFailureWithError("test/model", failureType, errors.New("boom")); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if tt.clear {
+				if err := s.ClearFailure("test/model"); err != nil {
+					t.Fatal(err)
+				}
+				if tt.want {
+					if err := s.MarkFailureWithType("test/model", "general"); err != nil {
+						t.Fatal(err)
+					}
+				}
+			}
+
+			skip, err := s.ShouldSkip("test/model")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if skip != tt.want {
+				t.Errorf("ShouldSkip() = %v, want %v", skip, tt.want)
+			}
+			failures, err := s.ListFailures()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if inCooldown := failures["test/model"].CooldownUntil != nil; inCooldown != tt.want {
+				t.Errorf("listed in cooldown = %v, want %v", inCooldown, tt.want)
+			}
+		})
+	}
+}
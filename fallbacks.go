@@ -0,0 +1,350 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// fallbackHeader lets a request choose its fallback mode
+const fallbackHeader = "X-Fallback"
+
+const (
+	// FallbackLenient tries the fallback chain of a model, or any free model
+	FallbackLenient = "lenient"
+	// FallbackStrict only tries the requested model, or the targets of an alias
+	FallbackStrict = "strict"
+)
+
+type fallbackModeContextKey struct{}
+
+// fallbackMiddleware stores the fallback mode chosen with the X-Fallback header
+func fallbackMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		mode := strings.ToLower(strings.TrimSpace(c.GetHeader(fallbackHeader)))
+		if mode == "" {
+			c.Next()
+			return
+		}
+		if mode != FallbackLenient && mode != FallbackStrict {
+			respondError(c, http.StatusBadRequest, "invalid_request_error",
+				fmt.Sprintf("%s must be %q or %q", fallbackHeader, FallbackStrict, FallbackLenient))
+			return
+		}
+		c.Request = c.Request.WithContext(context.WithValue(c.Request.Context(), fallbackModeContextKey{}, mode))
+		c.Next()
+	}
+}
+
+// fallbackMode returns the fallback mode of a request: the one it chose, or
+// routing.fallback
+func fallbackMode(ctx context.Context) string {
+	if mode, ok := ctx.Value(fallbackModeContextKey{}).(string); ok {
+		return mode
+	}
+	return currentConfig().Routing.Fallback
+}
+
+// lookupFallbacks returns the configured fallback chain of a requested name.
+// The ":latest" tag is ignored, and a chain configured for a full ID also
+// applies to the model's display name.
+func lookupFallbacks(name string) ([]string, bool) {
+	fallbacks := currentConfig().Fallbacks
+	if len(fallbacks) == 0 {
+		return nil, false
+	}
+	base := strings.TrimSuffix(name, ":latest")
+	for _, key := range []string{name, base} {
+		if chain, ok := fallbacks[key]; ok {
+			return chain, true
+		}
+	}
+	if id, err := modelCatalog.Resolve(base); err == nil {
+		chain, ok := fallbacks[id]
+		return chain, ok
+	}
+	return nil, false
+}
+
+// FallbackDisabledError is returned when the requested models failed and
+// fallback is disabled, by the request or for the model
+type FallbackDisabledError struct {
+	Model string
+	Err   error // last upstream error, nil if no model could be tried
+}
+
+func (e *FallbackDisabledError) Error() string {
+	if e.Err == nil {
+		return fmt.Sprintf("model %q is not available and fallback is disabled", e.Model)
+	}
+	return fmt.Sprintf("model %q failed and fallback is disabled: %v", e.Model, e.Err)
+}
+
+func (e *FallbackDisabledError) Unwrap() error {
+	return e.Err
+}
+
+// modelCall sends the request to one model and keeps the response on success
+type modelCall func(ctx context.Context, model string) error
+
+// freeRoute tries free models for one request
+type freeRoute struct {
+	ctx     context.Context
+	call    modelCall
+	tried   []string
+	lastErr error
+}
+
+// try tries the models a name stands for, in order. It returns the model that
+// answered, or an error that ends routing; both are empty when every model
+// failed or was skipped.
+func (r *freeRoute) try(name string) (string, error) {
+	client := clientFromContext(r.ctx)
+	for _, requested := range requestedModels(name) {
+		fullModelName, err := resolveFreeModel(requested)
+		var ambiguousErr *AmbiguousModelError
+		if errors.As(err, &ambiguousErr) {
+			return "", err
+		}
+		if err != nil || modelOverrides.IsDisabled(fullModelName) {
+			continue // Not a free model, or disabled
+		}
+		if !client.AllowsModel(fullModelName) || contains(r.tried, fullModelName) || permanentFailures.IsPermanentlyFailed(fullModelName) {
+			continue
+		}
+		if err := keyPool.CheckQuota(); err != nil {
+			return "", err
+		}
+		skip, err := shouldSkipModel(r.ctx, fullModelName)
+		if skip {
+			slog.Debug("model is in cooldown", "model", fullModelName)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		r.tried = append(r.tried, fullModelName)
+		slog.Debug("trying model", "model", fullModelName, "requested", name)
+		limiter := globalRateLimiter.GetLimiter(fullModelName)
+		waitRateLimits(r.ctx, limiter)
+		attemptCtx, span := startAttemptSpan(r.ctx, fullModelName, len(r.tried))
+		err = r.call(attemptCtx, fullModelName)
+		endSpan(span, err)
+		if endsRouting(err) {
+			return "", err
+		}
+		if err == nil {
+			limiter.RecordSuccess()
+			_ = failureStore.ClearFailure(fullModelName)
+			slog.Info("successfully used requested model", "model", fullModelName)
+			return fullModelName, nil
+		}
+		r.lastErr = err
+		limiter.RecordFailure(err)
+		slog.Warn("model failed, will try fallbacks", "model", fullModelName, "error", err)
+		markModelFailure(fullModelName, err)
+	}
+	return "", nil
+}
+
+// routeFreeRequest routes a request in free mode. A virtual model goes to any
+// free model matching its policy. Any other name tries the requested model, or
+// each target of an alias, then its configured fallback chain, or without one
+// any available free model. fallback runs the free-model routing of getFreeChat
+// or getFreeStream restricted to a policy.
+func routeFreeRequest(ctx context.Context, name string, call modelCall, fallback func(policy *ModelFilter) (string, error)) (string, error) {
+	if policy, ok := lookupVirtualModel(name); ok {
+		return fallback(policy)
+	}
+
+	r := &freeRoute{ctx: ctx, call: call}
+	if model, err := r.try(name); model != "" || err != nil {
+		return model, err
+	}
+
+	chain, configured := lookupFallbacks(name)
+	if fallbackMode(ctx) == FallbackStrict || (configured && len(chain) == 0) {
+		return "", &FallbackDisabledError{Model: name, Err: r.lastErr}
+	}
+	if !configured {
+		// Fallback to any available free model; the ones we just tried are in cooldown
+		if len(r.tried) > 0 {
+			slog.Info("falling back to other free models", "skipping", r.tried)
+		}
+		return fallback(nil)
+	}
+
+	for _, entry := range chain {
+		slog.Info("trying fallback", "model", name, "fallback", entry)
+		if policy, ok := lookupVirtualModel(entry); ok {
+			model, err := fallback(policy)
+			if err == nil || endsRouting(err) {
+				return model, err
+			}
+			r.lastErr = err
+			continue
+		}
+		model, err := r.try(entry)
+		var ambiguousErr *AmbiguousModelError
+		if errors.As(err, &ambiguousErr) {
+			slog.Warn("skipping ambiguous fallback", "model", name, "fallback", entry, "error", err)
+			continue
+		}
+		if model != "" || err != nil {
+			return model, err
+		}
+	}
+	if r.lastErr == nil {
+		return "", fmt.Errorf("no free models available for %q or its fallbacks", name)
+	}
+	return "", fmt.Errorf("model %q and its fallbacks failed, last error: %w", name, r.lastErr)
+}
+
+// endsRouting reports errors every other model would return too: the quota is
+// used up, or the replayed cassette has no response
+func endsRouting(err error) bool {
+	var quotaErr *QuotaExceededError
+	var missErr *CassetteMissError
+	return errors.As(err, &quotaErr) || errors.As(err, &missErr)
+}
+
+// tryPaidModels tries the models in order and returns the first that answers
+func tryPaidModels(ctx context.Context, models []string, call modelCall) (string, error) {
+	var err error
+	for i, m := range models {
+		if err = callWithRetries(ctx, m, call); err == nil {
+			return m, nil
+		}
+		if endsRouting(err) {
+			return "", err
+		}
+		if i < len(models)-1 {
+			slog.Warn("alias target failed, trying next", "model", m, "error", err)
+		}
+	}
+	return "", err
+}
+
+// callWithRetries sends a request to one model under its rate limiter,
+// retrying transient failures with backoff while the limiter allows
+func callWithRetries(ctx context.Context, model string, call modelCall) error {
+	limiter := globalRateLimiter.GetLimiter(model)
+	for attempt := 1; ; attempt++ {
+		waitRateLimits(ctx, limiter)
+		attemptCtx, span := startAttemptSpan(ctx, model, attempt)
+		err := call(attemptCtx, model)
+		endSpan(span, err)
+		if err == nil {
+			limiter.RecordSuccess()
+			_ = failureStore.ClearFailure(model)
+			return nil
+		}
+		if endsRouting(err) {
+			return err
+		}
+		limiter.RecordFailure(err)
+		if !isRetryableError(err) || !limiter.ShouldRetry(attempt) || ctx.Err() != nil {
+			markModelFailure(model, err)
+			return err
+		}
+
+		delay := limiter.RetryDelay(attempt)
+		slog.Warn("model failed, retrying", "model", model, "attempt", attempt, "delay", delay, "error", err)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// ModelNotAllowedError is returned when the client key may use none of the
+// models a requested name routes to
+type ModelNotAllowedError struct {
+	Model string
+}
+
+func (e *ModelNotAllowedError) Error() string {
+	return fmt.Sprintf("model %q is not allowed for this API key", e.Model)
+}
+
+// allowedModels returns the models the client of the request may use
+func allowedModels(ctx context.Context, models []string) []string {
+	client := clientFromContext(ctx)
+	var allowed []string
+	for _, m := range models {
+		if client.AllowsModel(m) {
+			allowed = append(allowed, m)
+		}
+	}
+	return allowed
+}
+
+// markModelFailure records a failed model: for the session if the model is
+// gone, otherwise with the cooldown of the failure type
+func markModelFailure(model string, err error) {
+	if isPermanentError(err) {
+		permanentFailures.MarkPermanentFailure(model)
+		slog.Warn("model permanently unavailable, won't retry this session", "model", model, "error", err)
+		return
+	}
+	failureType := "general"
+	if isRateLimitError(err) {
+		failureType = "rate_limit"
+	}
+	_ = failureStore.MarkFailureWithError(model, failureType, err)
+}
+
+// routePaidRequest tries the targets of a requested name, then its configured
+// fallback chain unless the request is strict. Only models the client key may
+// use are tried.
+func routePaidRequest(ctx context.Context, provider *OpenrouterProvider, name string, targets []string, call modelCall) (string, error) {
+	var model string
+	var err error
+	targets = allowedModels(ctx, targets)
+	tried := len(targets) > 0
+	if tried {
+		if model, err = tryPaidModels(ctx, targets, call); err == nil {
+			return model, nil
+		}
+	}
+	chain, _ := lookupFallbacks(name)
+	if len(chain) > 0 && fallbackMode(ctx) != FallbackStrict {
+		for _, entry := range chain {
+			models, resolveErr := resolveModelTargets(provider, entry)
+			if resolveErr != nil {
+				slog.Warn("skipping unknown fallback", "model", name, "fallback", entry, "error", resolveErr)
+				continue
+			}
+			if models = allowedModels(ctx, models); len(models) == 0 {
+				continue
+			}
+			tried = true
+			slog.Info("trying fallback", "model", name, "fallback", entry, "error", err)
+			if model, err = tryPaidModels(ctx, models, call); err == nil {
+				return model, nil
+			}
+		}
+	}
+	if !tried {
+		return "", &ModelNotAllowedError{Model: name}
+	}
+	return "", err
+}
+
+// respondModelNotAllowed answers 403 when routing found no model the client
+// key may use, and reports whether it did
+func respondModelNotAllowed(c *gin.Context, err error) bool {
+	var deniedErr *ModelNotAllowedError
+	if !errors.As(err, &deniedErr) {
+		return false
+	}
+	respondError(c, http.StatusForbidden, "permission_denied", err.Error())
+	return true
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sashabaranov/go-openai"
+)
+
+// useRoutingState gives the test fresh rate limiters and failure tracking
+func useRoutingState(t *testing.T) {
+	t.Helper()
+	store, err := NewFailureStore(filepath.Join(t.TempDir(), "failures.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	prevLimiter, prevStore, prevPermanent := globalRateLimiter, failureStore, permanentFailures
+	globalRateLimiter, failureStore, permanentFailures = NewGlobalRateLimiter(), store, NewPermanentFailureTracker()
+	t.Cleanup(func() {
+		store.Close()
+		globalRateLimiter, failureStore, permanentFailures = prevLimiter, prevStore, prevPermanent
+	})
+}
+
+func TestCallWithRetries(t *testing.T) {
+	serverErr := &openai.APIError{HTTPStatusCode: http.StatusInternalServerError, Message: "boom"}
+	tests := []struct {
+		name         string
+		errs         []error // returned by successive attempts, then success
+		priorFailure int     // failures of other requests to the model
+		wantCalls    int
+		wantErr      bool
+	}{
+		{name: "success", wantCalls: 1},
+		{name: "transient failure", errs: []error{serverErr}, wantCalls: 2},
+		{name: "gives up", errs: []error{serverErr, serverErr, serverErr, serverErr}, wantCalls: 3, wantErr: true},
+		{name: "not retryable", errs: []error{&openai.APIError{HTTPStatusCode: http.StatusBadRequest, Message: "bad"}}, wantCalls: 1, wantErr: true},
+		{name: "others failed before", errs: []error{serverErr}, priorFailure: 10, wantCalls: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useRoutingState(t)
+			limiter := globalRateLimiter.GetLimiter("test/model")
+			limiter.baseDelay = 0
+			for i := 0; i < tt.priorFailure; i++ {
+				limiter.RecordFailure(errors.New("boom"))
+			}
+
+			calls := 0
+			err := callWithRetries(context.Background(), "test/model", func(ctx context.Context, model string) error {
+				calls++
+				if calls <= len(tt.errs) {
+					return tt.errs[calls-1]
+				}
+				return nil
+			})
+			if (err != nil) != tt.wantErr {
+				t.Errorf("callWithRetries() = %v, want error %v", err, tt.wantErr)
+			}
+			if calls != tt.wantCalls {
+				t.Errorf("made %d calls, want %d", calls, tt.wantCalls)
+			}
+		})
+	}
+}
+
+func TestLookupFallbacks(t *testing.T) {
+	useConfig(t, func(c *Config) {
+		c.Fallbacks = map[string][]string{
+			"coder":         {"openai/gpt-4o", "free-auto"},
+			"openai/gpt-4o": {"openai/gpt-4o-mini"},
+			"strict-model":  {},
+		}
+	})
+	useCatalog(t, ModelRecord{ID: "openai/gpt-4o"}, ModelRecord{ID: "openai/gpt-4o-mini"})
+
+	tests := []struct {
+		requested  string
+		want       []string
+		configured bool
+	}{
+		{requested: "coder", want: []string{"openai/gpt-4o", "free-auto"}, configured: true},
+		{requested: "coder:latest", want: []string{"openai/gpt-4o", "free-auto"}, configured: true},
+		{requested: "gpt-4o", want: []string{"openai/gpt-4o-mini"}, configured: true}, // display name
+		{requested: "strict-model", want: []string{}, configured: true},
+		{requested: "openai/gpt-4o-mini"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.requested, func(t *testing.T) {
+			chain, ok := lookupFallbacks(tt.requested)
+			if ok != tt.configured || (ok && !reflect.DeepEqual(chain, tt.want)) {
+				t.Errorf("lookupFallbacks(%q) = %v, %v, want %v, %v", tt.requested, chain, ok, tt.want, tt.configured)
+			}
+		})
+	}
+}
+
+func TestRoutePaidRequest(t *testing.T) {
+	badRequest := &openai.APIError{HTTPStatusCode: http.StatusBadRequest, Message: "bad"}
+	tests := []struct {
+		name      string
+		mode      string   // X-Fallback of the request, "" for routing.fallback
+		allowed   []string // patterns of the client key, nil without auth
+		failing   []string
+		want      string
+		wantTried []string
+		wantErr   bool
+		denied    bool // no model may be used by the client
+	}{
+		{name: "first target answers", want: "openai/gpt-4o", wantTried: []string{"openai/gpt-4o"}},
+		{name: "next target", failing: []string{"openai/gpt-4o"}, want: "anthropic/claude",
+			wantTried: []string{"openai/gpt-4o", "anthropic/claude"}},
+		{name: "fallback chain", failing: []string{"openai/gpt-4o", "anthropic/claude"}, want: "google/gemini",
+			wantTried: []string{"openai/gpt-4o", "anthropic/claude", "google/gemini"}},
+		{name: "strict", mode: FallbackStrict, failing: []string{"openai/gpt-4o", "anthropic/claude"},
+			wantTried: []string{"openai/gpt-4o", "anthropic/claude"}, wantErr: true},
+		{name: "targets not allowed", allowed: []string{"google/*"}, want: "google/gemini", wantTried: []string{"google/gemini"}},
+		{name: "fallback not allowed", allowed: []string{"openai/*"}, failing: []string{"openai/gpt-4o"},
+			wantTried: []string{"openai/gpt-4o"}, wantErr: true},
+		{name: "nothing allowed", allowed: []string{"mistral/*"}, wantErr: true, denied: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useRoutingState(t)
+			useConfig(t, func(c *Config) {
+				c.Fallbacks = map[string][]string{"coder": {"unknown-model", "google/gemini"}}
+			})
+			useCatalog(t, ModelRecord{ID: "openai/gpt-4o"}, ModelRecord{ID: "anthropic/claude"}, ModelRecord{ID: "google/gemini"})
+			provider := NewOpenrouterProvider(nil, modelCatalog)
+
+			ctx := context.Background()
+			if tt.mode != "" {
+				ctx = context.WithValue(ctx, fallbackModeContextKey{}, tt.mode)
+			}
+			if tt.allowed != nil {
+				ctx = context.WithValue(ctx, clientKeyContextKey{}, &ClientKey{Name: "ci", AllowedModels: tt.allowed})
+			}
+			var tried []string
+			model, err := routePaidRequest(ctx, provider, "coder", []string{"openai/gpt-4o", "anthropic/claude"}, func(ctx context.Context, model string) error {
+				tried = append(tried, model)
+				if contains(tt.failing, model) {
+					return badRequest
+				}
+				return nil
+			})
+
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("routePaidRequest() = %v, want error %v", err, tt.wantErr)
+			}
+			var deniedErr *ModelNotAllowedError
+			if errors.As(err, &deniedErr) != tt.denied {
+				t.Errorf("routePaidRequest() = %v, want ModelNotAllowedError %v", err, tt.denied)
+			}
+			if model != tt.want {
+				t.Errorf("answered by %q, want %q", model, tt.want)
+			}
+			if !reflect.DeepEqual(tried, tt.wantTried) {
+				t.Errorf("tried %v, want %v", tried, tt.wantTried)
+			}
+		})
+	}
+}
+
+func TestFallbackMiddleware(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	useConfig(t, func(c *Config) { c.Routing.Fallback = FallbackLenient })
+	r := gin.New()
+	r.Use(fallbackMiddleware())
+	r.POST("/v1/chat/completions", func(c *gin.Context) { c.String(http.StatusOK, fallbackMode(c.Request.Context())) })
+
+	tests := []struct {
+		header     string
+		wantStatus int
+		wantMode   string
+	}{
+		{header: "", wantStatus: http.StatusOK, wantMode: FallbackLenient},
+		{header: "strict", wantStatus: http.StatusOK, wantMode: FallbackStrict},
+		{header: " Strict ", wantStatus: http.StatusOK, wantMode: FallbackStrict},
+		{header: "lenient", wantStatus: http.StatusOK, wantMode: FallbackLenient},
+		{header: "never", wantStatus: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.header, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", nil)
+			req.Header.Set(fallbackHeader, tt.header)
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", w.Code, tt.wantStatus)
+			}
+			if tt.wantMode != "" && w.Body.String() != tt.wantMode {
+				t.Errorf("fallback mode = %q, want %q", w.Body.String(), tt.wantMode)
+			}
+		})
+	}
+}
@@ -3,28 +3,62 @@ package main
 import (
 	"encoding/json"
 	"fmt"
+	"log/slog"
 	"net/http"
 	"os"
+	"path/filepath"
 	"sort"
 	"strings"
+	"sync/atomic"
 	"time"
 )
 
+// orModels is the response of OpenRouter's /models endpoint
 type orModels struct {
 	Data []struct {
-		ID                   string   `json:"id"`
-		ContextLength        int      `json:"context_length"`
-		SupportedParameters  []string `json:"supported_parameters"`
-		TopProvider          struct {
-			ContextLength int `json:"context_length"`
+		ID                  string   `json:"id"`
+		Name                string   `json:"name"`
+		Created             int64    `json:"created"`
+		ContextLength       int      `json:"context_length"`
+		SupportedParameters []string `json:"supported_parameters"`
+		Architecture        struct {
+			InputModalities  []string `json:"input_modalities"`
+			OutputModalities []string `json:"output_modalities"`
+		} `json:"architecture"`
+		TopProvider struct {
+			ContextLength       int `json:"context_length"`
+			MaxCompletionTokens int `json:"max_completion_tokens"`
 		} `json:"top_provider"`
-		Pricing struct {
-			Prompt     string `json:"prompt"`
-			Completion string `json:"completion"`
-		} `json:"pricing"`
+		Pricing ModelPricing `json:"pricing"`
 	} `json:"data"`
 }
 
+// ModelPricing holds OpenRouter's per-token prices, as decimal strings in USD
+type ModelPricing struct {
+	Prompt     string `json:"prompt"`
+	Completion string `json:"completion"`
+	Request    string `json:"request,omitempty"`
+	Image      string `json:"image,omitempty"`
+}
+
+// ModelRecord is the metadata kept for every model in the catalog cache
+type ModelRecord struct {
+	ID                  string       `json:"id"`
+	Name                string       `json:"name,omitempty"`
+	Created             int64        `json:"created,omitempty"`
+	ContextLength       int          `json:"context_length,omitempty"`
+	MaxCompletionTokens int          `json:"max_completion_tokens,omitempty"`
+	InputModalities     []string     `json:"input_modalities,omitempty"`
+	OutputModalities    []string     `json:"output_modalities,omitempty"`
+	SupportedParameters []string     `json:"supported_parameters,omitempty"`
+	Pricing             ModelPricing `json:"pricing"`
+}
+
+// IsFree reports whether both prompt and completion tokens cost nothing
+func (m ModelRecord) IsFree() bool {
+	return m.Pricing.Prompt == "0" && m.Pricing.Completion == "0"
+}
+
 // supportsToolUse checks if a model supports tool use by looking for "tools" in supported_parameters
 func supportsToolUse(supportedParams []string) bool {
 	for _, param := range supportedParams {
@@ -35,13 +69,51 @@ func supportsToolUse(supportedParams []string) bool {
 	return false
 }
 
-func fetchFreeModels(apiKey string) ([]string, error) {
+// modelCatalogVersion is the current format of the catalog cache file
+const modelCatalogVersion = 1
+
+// ModelCatalog is the full OpenRouter model list as stored in the cache file
+type ModelCatalog struct {
+	Version   int           `json:"version"`
+	FetchedAt time.Time     `json:"fetched_at"`
+	Models    []ModelRecord `json:"models"`
+
+	index map[string]int // position of each model ID, built when loaded
+}
+
+// FreeModelIDs returns the IDs of the free models, largest context first. With
+// TOOL_USE_ONLY only models supporting tool use are returned.
+func (c *ModelCatalog) FreeModelIDs() []string {
+	toolUseOnly := currentConfig().Routing.ToolUseOnly
+
+	var free []ModelRecord
+	for _, m := range c.Models {
+		if !m.IsFree() {
+			continue
+		}
+		// If tool use filtering is enabled, skip models that don't support tools
+		if toolUseOnly && !supportsToolUse(m.SupportedParameters) {
+			continue
+		}
+		free = append(free, m)
+	}
+	sort.SliceStable(free, func(i, j int) bool { return free[i].ContextLength > free[j].ContextLength })
+	models := make([]string, len(free))
+	for i, m := range free {
+		models[i] = m.ID
+	}
+	return models
+}
+
+// fetchModelCatalog downloads the metadata of every model from OpenRouter
+func fetchModelCatalog(apiKey string) (*ModelCatalog, error) {
 	// Create HTTP client with timeout
 	client := &http.Client{
-		Timeout: 10 * time.Second,
+		Transport: upstreamTransport,
+		Timeout:   currentConfig().Timeouts.Catalog,
 	}
 	
-	req, err := http.NewRequest("GET", "https://openrouter.ai/api/v1/models", nil)
+	req, err := http.NewRequest("GET", upstreamURL("models"), nil)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create request: %w", err)
 	}
@@ -61,85 +133,146 @@ func fetchFreeModels(apiKey string) ([]string, error) {
 		return nil, err
 	}
 	
-	// Check if tool use filtering is enabled
-	toolUseOnly := strings.ToLower(os.Getenv("TOOL_USE_ONLY")) == "true"
-	
-	type item struct {
-		id  string
-		ctx int
-	}
-	var items []item
+	catalog := &ModelCatalog{Version: modelCatalogVersion, FetchedAt: time.Now().UTC()}
 	for _, m := range result.Data {
-		if m.Pricing.Prompt == "0" && m.Pricing.Completion == "0" {
-			// If tool use filtering is enabled, skip models that don't support tools
-			if toolUseOnly && !supportsToolUse(m.SupportedParameters) {
-				continue
-			}
-			
-			ctx := m.TopProvider.ContextLength
-			if ctx == 0 {
-				ctx = m.ContextLength
-			}
-			items = append(items, item{id: m.ID, ctx: ctx})
+		ctx := m.TopProvider.ContextLength
+		if ctx == 0 {
+			ctx = m.ContextLength
 		}
+		catalog.Models = append(catalog.Models, ModelRecord{
+			ID:                  m.ID,
+			Name:                m.Name,
+			Created:             m.Created,
+			ContextLength:       ctx,
+			MaxCompletionTokens: m.TopProvider.MaxCompletionTokens,
+			InputModalities:     m.Architecture.InputModalities,
+			OutputModalities:    m.Architecture.OutputModalities,
+			SupportedParameters: m.SupportedParameters,
+			Pricing:             m.Pricing,
+		})
 	}
-	sort.Slice(items, func(i, j int) bool { return items[i].ctx > items[j].ctx })
-	models := make([]string, len(items))
-	for i, it := range items {
-		models[i] = it.id
+	if len(catalog.Models) == 0 {
+		return nil, fmt.Errorf("OpenRouter returned no models")
 	}
-	return models, nil
+	return catalog, nil
 }
 
-func ensureFreeModelFile(apiKey, path string) ([]string, error) {
-	// Allow cache TTL to be configured via environment
-	cacheTTL := 24 * time.Hour
-	if ttlStr := os.Getenv("CACHE_TTL_HOURS"); ttlStr != "" {
-		if hours, err := time.ParseDuration(ttlStr + "h"); err == nil {
-			cacheTTL = hours
-		}
+// readModelCatalog loads the cache file. Caches written by older versions, one
+// free model ID per line, are converted: their models only carry an ID and are
+// marked free. Having no capabilities or prices, they are stale right away and
+// only used when a fresh catalog cannot be fetched.
+func readModelCatalog(path string) (catalog *ModelCatalog, legacy bool, err error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, false, err
 	}
 
-	if stat, err := os.Stat(path); err == nil {
-		// Check if cache is still fresh
-		if time.Since(stat.ModTime()) < cacheTTL {
-			data, err := os.ReadFile(path)
-			if err != nil {
-				return nil, err
+	if trimmed := strings.TrimSpace(string(data)); !strings.HasPrefix(trimmed, "{") {
+		catalog = &ModelCatalog{Version: modelCatalogVersion}
+		for _, line := range strings.Split(trimmed, "\n") {
+			if line = strings.TrimSpace(line); line != "" {
+				catalog.Models = append(catalog.Models, ModelRecord{ID: line, Pricing: ModelPricing{Prompt: "0", Completion: "0"}})
 			}
-			var models []string
-			for _, line := range strings.Split(string(data), "\n") {
-				line = strings.TrimSpace(line)
-				if line != "" {
-					models = append(models, line)
-				}
-			}
-			return models, nil
 		}
-		// Cache is stale, will fetch fresh models below
+		return catalog, true, nil
 	}
 
-	// Fetch fresh models from API
-	models, err := fetchFreeModels(apiKey)
+	catalog = &ModelCatalog{}
+	if err := json.Unmarshal(data, catalog); err != nil {
+		return nil, false, fmt.Errorf("invalid model cache %s: %w", path, err)
+	}
+	if catalog.Version != modelCatalogVersion {
+		return nil, false, fmt.Errorf("unsupported model cache version %d in %s", catalog.Version, path)
+	}
+	return catalog, false, nil
+}
+
+// writeModelCatalog saves the catalog through a temporary file and a rename, so
+// readers never see a partially written cache
+func writeModelCatalog(path string, catalog *ModelCatalog) error {
+	data, err := json.MarshalIndent(catalog, "", "  ")
 	if err != nil {
-		// If fetch fails but we have a cached file (even if stale), use it
-		if _, statErr := os.Stat(path); statErr == nil {
-			data, readErr := os.ReadFile(path)
-			if readErr == nil {
-				var cachedModels []string
-				for _, line := range strings.Split(string(data), "\n") {
-					line = strings.TrimSpace(line)
-					if line != "" {
-						cachedModels = append(cachedModels, line)
-					}
-				}
-				return cachedModels, nil
-			}
-		}
-		return nil, err
+		return err
+	}
+	return writeFileAtomic(path, data)
+}
+
+// writeFileAtomic replaces the file at path with data through a temporary file
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
 	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
 
-	// Save fresh models to cache
-	_ = os.WriteFile(path, []byte(strings.Join(models, "\n")), 0644)
-	return models, nil
+// freeModels is the current free model list in routing order. Handlers read it
+// concurrently while the refresher replaces it, so it is swapped atomically.
+var freeModels atomic.Pointer[[]string]
+
+// currentFreeModels returns the free model list in routing order
+func currentFreeModels() []string {
+	if models := freeModels.Load(); models != nil {
+		return *models
+	}
+	return nil
+}
+
+// setFreeModels replaces the free model list
+func setFreeModels(models []string) {
+	freeModels.Store(&models)
+}
+
+// loadFreeModels swaps in the free models of a newly loaded catalog, logging
+// which models were added or removed
+func loadFreeModels(catalog *ModelCatalog) []string {
+	models := catalog.FreeModelIDs()
+	previous := currentFreeModels()
+	if len(models) == 0 && len(previous) > 0 {
+		slog.Warn("model catalog has no free models, keeping current list", "models", len(previous))
+		return previous
+	}
+	added, removed := diffModels(previous, models)
+	setFreeModels(models)
+	if previous == nil {
+		return models
+	}
+	if len(added) > 0 || len(removed) > 0 {
+		slog.Info("free model catalog changed", "added", added, "removed", removed, "models", len(models))
+	} else {
+		slog.Debug("free model catalog unchanged", "models", len(models))
+	}
+	return models
+}
+
+// diffModels returns the models only in next and only in prev
+func diffModels(prev, next []string) (added, removed []string) {
+	old := make(map[string]struct{}, len(prev))
+	for _, m := range prev {
+		old[m] = struct{}{}
+	}
+	for _, m := range next {
+		if _, ok := old[m]; ok {
+			delete(old, m)
+			continue
+		}
+		added = append(added, m)
+	}
+	for _, m := range prev {
+		if _, ok := old[m]; ok {
+			removed = append(removed, m)
+		}
+	}
+	return added, removed
 }
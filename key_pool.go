@@ -0,0 +1,396 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sashabaranov/go-openai"
+)
+
+const (
+	KeyStrategyRoundRobin = "round_robin"
+	KeyStrategyLeastUsed  = "least_used"
+)
+
+// PoolKey is one OpenRouter API key with its own client, rate limit and quota state
+type PoolKey struct {
+	ID      string // fingerprint, safe to log
+	secret  string
+	client  *openai.Client
+	limiter *RateLimiter
+	quota   *QuotaTracker // nil unless quota tracking is enabled
+
+	mu             sync.Mutex
+	disabled       bool
+	disabledReason string
+	inFlight       int
+	used           int64
+	lastError      string
+}
+
+// KeyStatus is a snapshot of a key's health
+type KeyStatus struct {
+	ID             string        `json:"id"`
+	Disabled       bool          `json:"disabled"`
+	DisabledReason string        `json:"disabled_reason,omitempty"`
+	Cooldown       time.Duration `json:"cooldown"`
+	InFlight       int           `json:"in_flight"`
+	Used           int64         `json:"used"`
+	LastError      string        `json:"last_error,omitempty"`
+	Quota          *QuotaStatus  `json:"quota,omitempty"`
+}
+
+// KeyPool distributes upstream requests over several OpenRouter API keys
+type KeyPool struct {
+	mu       sync.Mutex
+	keys     []*PoolKey
+	strategy string
+	next     int
+}
+
+// loadAPIKeys collects API keys from OPENROUTER_API_KEYS (comma or newline separated),
+// OPENROUTER_API_KEY and the deprecated OPENAI_API_KEY
+func loadAPIKeys() []string {
+	var keys []string
+	seen := make(map[string]bool)
+	add := func(k string) {
+		k = strings.TrimSpace(k)
+		if k != "" && !seen[k] {
+			seen[k] = true
+			keys = append(keys, k)
+		}
+	}
+
+	for _, k := range strings.FieldsFunc(os.Getenv("OPENROUTER_API_KEYS"), func(r rune) bool {
+		return r == ',' || r == '\n'
+	}) {
+		add(k)
+	}
+	add(os.Getenv("OPENROUTER_API_KEY"))
+	if len(keys) == 0 {
+		if k := os.Getenv("OPENAI_API_KEY"); k != "" {
+			slog.Warn("Using deprecated OPENAI_API_KEY env var. Please use OPENROUTER_API_KEY instead.")
+			add(k)
+		}
+	}
+	return keys
+}
+
+func NewKeyPool(secrets []string, strategy string) (*KeyPool, error) {
+	if len(secrets) == 0 {
+		return nil, fmt.Errorf("no API keys configured")
+	}
+	switch strategy {
+	case "":
+		strategy = KeyStrategyRoundRobin
+	case KeyStrategyRoundRobin, KeyStrategyLeastUsed:
+	default:
+		return nil, fmt.Errorf("unknown key strategy %q", strategy)
+	}
+
+	pool := &KeyPool{strategy: strategy}
+	for _, secret := range secrets {
+		pool.keys = append(pool.keys, &PoolKey{
+			ID:      keyFingerprint(secret),
+			secret:  secret,
+			client:  newOpenrouterClient(secret),
+			limiter: NewRateLimiter(),
+		})
+	}
+	return pool, nil
+}
+
+// EnableQuota attaches a daily quota tracker to every key
+func (p *KeyPool) EnableQuota(dbPath string) error {
+	for _, k := range p.keys {
+		q, err := NewQuotaTracker(dbPath, k.secret)
+		if err != nil {
+			return err
+		}
+		k.quota = q
+	}
+	return nil
+}
+
+// StartQuotaSync periodically syncs every key's quota with OpenRouter until ctx
+// is done. Keys that are rejected by the key info endpoint are disabled and no
+// longer synced.
+func (p *KeyPool) StartQuotaSync(ctx context.Context, interval time.Duration) {
+	for _, k := range p.keys {
+		if k.quota == nil {
+			continue
+		}
+		go p.syncQuota(ctx, k, interval)
+	}
+}
+
+func (p *KeyPool) syncQuota(ctx context.Context, k *PoolKey, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if k.isDisabled() {
+			slog.Info("stopped quota sync of disabled key", "key", k.ID)
+			return
+		}
+		if err := k.quota.Sync(k.secret); err != nil {
+			slog.Warn("failed to sync quota with OpenRouter", "key", k.ID, "error", err)
+			p.disableUnusable(k, err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (k *PoolKey) isDisabled() bool {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	return k.disabled
+}
+
+func (p *KeyPool) Close() error {
+	var errs []error
+	for _, k := range p.keys {
+		if k.quota != nil {
+			errs = append(errs, k.quota.Close())
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (p *KeyPool) Len() int { return len(p.keys) }
+
+// AnyKey returns the secret of an enabled key for auxiliary calls like the model list
+func (p *KeyPool) AnyKey() string {
+	for _, k := range p.keys {
+		k.mu.Lock()
+		disabled := k.disabled
+		k.mu.Unlock()
+		if !disabled {
+			return k.secret
+		}
+	}
+	return p.keys[0].secret
+}
+
+// Acquire picks the next usable key according to the pool strategy, skipping keys
+// in tried. If every remaining key is out of free quota the earliest resetting
+// *QuotaExceededError is returned. For metered requests a request is reserved
+// from the key's quota; the caller records it once sent.
+func (p *KeyPool) Acquire(tried map[string]bool, metered bool) (*PoolKey, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var best *PoolKey
+	var bestInFlight int
+	var bestUsed int64
+	var quotaErr *QuotaExceededError
+	var minCooldown time.Duration
+	n := len(p.keys)
+	for i := 0; i < n; i++ {
+		idx := (p.next + i) % n
+		k := p.keys[idx]
+		if tried[k.ID] {
+			continue
+		}
+
+		k.mu.Lock()
+		disabled, inFlight, used := k.disabled, k.inFlight, k.used
+		k.mu.Unlock()
+		if disabled {
+			continue
+		}
+		if cd := k.limiter.BackoffRemaining(); cd > 0 {
+			if minCooldown == 0 || cd < minCooldown {
+				minCooldown = cd
+			}
+			continue
+		}
+		if k.quota != nil {
+			if err := k.quota.Check(); err != nil {
+				var qerr *QuotaExceededError
+				if errors.As(err, &qerr) && (quotaErr == nil || qerr.ResetAt.Before(quotaErr.ResetAt)) {
+					quotaErr = qerr
+				}
+				continue
+			}
+		}
+
+		if p.strategy == KeyStrategyRoundRobin {
+			best = k
+			p.next = (idx + 1) % n
+			break
+		}
+		if best == nil || inFlight < bestInFlight || (inFlight == bestInFlight && used < bestUsed) {
+			best, bestInFlight, bestUsed = k, inFlight, used
+		}
+	}
+
+	if best == nil {
+		if quotaErr != nil {
+			return nil, quotaErr
+		}
+		if minCooldown > 0 {
+			return nil, fmt.Errorf("all API keys are rate limited, retry in %s", minCooldown.Round(time.Second))
+		}
+		return nil, fmt.Errorf("no usable API keys (all disabled)")
+	}
+	if metered && best.quota != nil {
+		if err := best.quota.Reserve(); err != nil {
+			return nil, err
+		}
+	}
+
+	best.mu.Lock()
+	best.inFlight++
+	best.used++
+	best.mu.Unlock()
+	return best, nil
+}
+
+// CheckQuota returns the earliest resetting *QuotaExceededError when every enabled
+// key is out of free quota, and nil otherwise
+func (p *KeyPool) CheckQuota() error {
+	var quotaErr *QuotaExceededError
+	for _, k := range p.keys {
+		k.mu.Lock()
+		disabled := k.disabled
+		k.mu.Unlock()
+		if disabled {
+			continue
+		}
+		if k.quota == nil {
+			return nil
+		}
+		err := k.quota.Check()
+		if err == nil {
+			return nil
+		}
+		var qerr *QuotaExceededError
+		if errors.As(err, &qerr) && (quotaErr == nil || qerr.ResetAt.Before(quotaErr.ResetAt)) {
+			quotaErr = qerr
+		}
+	}
+	if quotaErr == nil {
+		return nil
+	}
+	return quotaErr
+}
+
+// Release returns a key after a request and updates its health from the result
+func (p *KeyPool) Release(k *PoolKey, err error) {
+	k.mu.Lock()
+	k.inFlight--
+	if err != nil {
+		k.lastError = err.Error()
+	}
+	k.mu.Unlock()
+
+	if err == nil {
+		k.limiter.RecordSuccess()
+		return
+	}
+
+	if p.disableUnusable(k, err) {
+		return
+	}
+	if apiStatusCode(err) == http.StatusTooManyRequests {
+		if isUpstreamRateLimit(err) {
+			return // the model's provider is busy, not this key
+		}
+		if k.quota != nil && isDailyQuotaError(err) {
+			k.quota.MarkExhausted()
+		}
+		k.limiter.RecordFailure(err)
+		slog.Warn("API key rate limited, rotating", "key", k.ID, "cooldown", k.limiter.BackoffRemaining())
+	}
+}
+
+// disableUnusable disables a key that OpenRouter rejected as revoked or out of
+// credits, and reports whether it did
+func (p *KeyPool) disableUnusable(k *PoolKey, err error) bool {
+	switch apiStatusCode(err) {
+	case http.StatusUnauthorized:
+		p.disable(k, "unauthorized (revoked or invalid key)")
+	case http.StatusPaymentRequired:
+		p.disable(k, "insufficient credits")
+	default:
+		return false
+	}
+	return true
+}
+
+func (p *KeyPool) disable(k *PoolKey, reason string) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if k.disabled {
+		return
+	}
+	k.disabled = true
+	k.disabledReason = reason
+	slog.Error("API key disabled", "key", k.ID, "reason", reason)
+}
+
+// Status returns the health of every key in the pool
+func (p *KeyPool) Status() []KeyStatus {
+	statuses := make([]KeyStatus, 0, len(p.keys))
+	for _, k := range p.keys {
+		k.mu.Lock()
+		st := KeyStatus{
+			ID:             k.ID,
+			Disabled:       k.disabled,
+			DisabledReason: k.disabledReason,
+			InFlight:       k.inFlight,
+			Used:           k.used,
+			LastError:      k.lastError,
+		}
+		k.mu.Unlock()
+		st.Cooldown = k.limiter.BackoffRemaining()
+		if k.quota != nil {
+			qs := k.quota.Status()
+			st.Quota = &qs
+		}
+		statuses = append(statuses, st)
+	}
+	return statuses
+}
+
+// apiStatusCode extracts the HTTP status code from a go-openai error, or 0
+func apiStatusCode(err error) int {
+	var apiErr *openai.APIError
+	if errors.As(err, &apiErr) {
+		return apiErr.HTTPStatusCode
+	}
+	var reqErr *openai.RequestError
+	if errors.As(err, &reqErr) {
+		return reqErr.HTTPStatusCode
+	}
+	return 0
+}
+
+// isUpstreamRateLimit checks if a 429 came from the model's upstream provider
+// ("temporarily rate-limited upstream") rather than from OpenRouter's per-key limits
+func isUpstreamRateLimit(err error) bool {
+	return strings.Contains(strings.ToLower(err.Error()), "upstream")
+}
+
+// isKeyError reports whether an error is tied to the API key rather than the model,
+// meaning the request is worth retrying with another key
+func isKeyError(err error) bool {
+	switch apiStatusCode(err) {
+	case http.StatusUnauthorized, http.StatusPaymentRequired:
+		return true
+	case http.StatusTooManyRequests:
+		return !isUpstreamRateLimit(err)
+	}
+	return false
+}
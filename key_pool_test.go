@@ -0,0 +1,222 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/sashabaranov/go-openai"
+)
+
+func newTestKeyPool(t *testing.T, strategy string, n int) *KeyPool {
+	t.Helper()
+	var secrets []string
+	for i := 0; i < n; i++ {
+		secrets = append(secrets, "sk-test-"+string(rune('a'+i)))
+	}
+	p, err := NewKeyPool(secrets, strategy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestKeyPoolRoundRobin(t *testing.T) {
+	p := newTestKeyPool(t, KeyStrategyRoundRobin, 3)
+	for i := 0; i < 6; i++ {
+		k, err := p.Acquire(map[string]bool{}, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := p.keys[i%3]; k != want {
+			t.Errorf("request %d got key %s, want %s", i, k.ID, want.ID)
+		}
+		p.Release(k, nil)
+	}
+}
+
+func TestKeyPoolLeastUsed(t *testing.T) {
+	p := newTestKeyPool(t, KeyStrategyLeastUsed, 2)
+	first, err := p.Acquire(map[string]bool{}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := p.Acquire(map[string]bool{}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first == second {
+		t.Error("key in flight was picked over an idle one")
+	}
+}
+
+func TestKeyPoolSkipsTriedKeys(t *testing.T) {
+	p := newTestKeyPool(t, KeyStrategyRoundRobin, 2)
+	tried := map[string]bool{p.keys[0].ID: true}
+	for i := 0; i < 2; i++ {
+		k, err := p.Acquire(tried, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if k != p.keys[1] {
+			t.Errorf("got tried key %s", k.ID)
+		}
+		p.Release(k, nil)
+	}
+	tried[p.keys[1].ID] = true
+	if _, err := p.Acquire(tried, false); err == nil {
+		t.Error("Acquire() succeeded with every key tried")
+	}
+}
+
+func TestKeyPoolRelease(t *testing.T) {
+	tests := []struct {
+		name         string
+		err          error
+		wantDisabled bool
+		wantCooldown bool
+	}{
+		{name: "success"},
+		{name: "unauthorized", err: &openai.APIError{HTTPStatusCode: http.StatusUnauthorized, Message: "invalid key"}, wantDisabled: true},
+		{name: "no credits", err: &openai.APIError{HTTPStatusCode: http.StatusPaymentRequired, Message: "insufficient credits"}, wantDisabled: true},
+		{name: "key rate limit", err: &openai.APIError{HTTPStatusCode: http.StatusTooManyRequests, Message: "rate limit exceeded"}, wantCooldown: true},
+		{name: "provider rate limit", err: &openai.APIError{HTTPStatusCode: http.StatusTooManyRequests, Message: "temporarily rate-limited upstream"}},
+		{name: "server error", err: &openai.APIError{HTTPStatusCode: http.StatusInternalServerError, Message: "boom"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newTestKeyPool(t, KeyStrategyRoundRobin, 2)
+			k, err := p.Acquire(map[string]bool{}, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			p.Release(k, tt.err)
+
+			if k.inFlight != 0 {
+				t.Errorf("in flight = %d after release", k.inFlight)
+			}
+			if k.isDisabled() != tt.wantDisabled {
+				t.Errorf("disabled = %v, want %v", k.isDisabled(), tt.wantDisabled)
+			}
+			if got := k.limiter.BackoffRemaining() > 0; got != tt.wantCooldown {
+				t.Errorf("cooling down = %v, want %v", got, tt.wantCooldown)
+			}
+			// A disabled or cooling down key is skipped
+			next, err := p.Acquire(map[string]bool{}, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if unusable := tt.wantDisabled || tt.wantCooldown; unusable && next == k {
+				t.Error("unusable key acquired again")
+			}
+		})
+	}
+}
+
+func TestKeyPoolAllDisabled(t *testing.T) {
+	p := newTestKeyPool(t, KeyStrategyRoundRobin, 2)
+	for _, k := range p.keys {
+		p.disable(k, "test")
+	}
+	if _, err := p.Acquire(map[string]bool{}, false); err == nil {
+		t.Error("Acquire() succeeded with every key disabled")
+	}
+}
+
+// startQuotaSync syncs a one-key pool against a fake key info endpoint and
+// returns the number of requests it received
+func startQuotaSync(t *testing.T, ctx context.Context, status int) (*PoolKey, *atomic.Int32) {
+	t.Helper()
+	var requests atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		w.WriteHeader(status)
+		w.Write([]byte(`{"data":{"is_free_tier":true}}`))
+	}))
+	t.Cleanup(srv.Close)
+	useConfig(t, func(c *Config) { c.Upstream.BaseURL = srv.URL })
+
+	p := newTestKeyPool(t, KeyStrategyRoundRobin, 1)
+	if err := p.EnableQuota(filepath.Join(t.TempDir(), "quota.db")); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { p.Close() })
+	p.StartQuotaSync(ctx, 5*time.Millisecond)
+	return p.keys[0], &requests
+}
+
+func TestQuotaSyncStopsOnShutdown(t *testing.T) {
+	ctx, stop := context.WithCancel(context.Background())
+	_, requests := startQuotaSync(t, ctx, http.StatusOK)
+	time.Sleep(30 * time.Millisecond)
+	if requests.Load() < 2 {
+		t.Fatalf("synced %d times, want periodic syncs", requests.Load())
+	}
+	stop()
+	time.Sleep(10 * time.Millisecond)
+	n := requests.Load()
+	time.Sleep(30 * time.Millisecond)
+	if requests.Load() != n {
+		t.Error("quota still synced after shutdown")
+	}
+}
+
+func TestQuotaSyncStopsOnDisabledKey(t *testing.T) {
+	ctx, stop := context.WithCancel(context.Background())
+	defer stop()
+	k, requests := startQuotaSync(t, ctx, http.StatusUnauthorized)
+	time.Sleep(30 * time.Millisecond)
+	if !k.isDisabled() {
+		t.Fatal("key rejected by the key info endpoint not disabled")
+	}
+	if n := requests.Load(); n != 1 {
+		t.Errorf("disabled key synced %d times, want 1", n)
+	}
+}
+
+func TestChatStreamReleasesKeyWithError(t *testing.T) {
+	tests := []struct {
+		name    string
+		body    string
+		wantErr bool
+	}{
+		{name: "complete", body: "data: {\"choices\":[{\"delta\":{\"content\":\"hi\"}}]}\n\ndata: [DONE]\n\n"},
+		{name: "broken chunk", body: "data: {\"choices\":[{\"delta\":{\"content\":\"hi\"}}]}\n\ndata: {broken\n\n", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "text/event-stream")
+				w.Write([]byte(tt.body))
+			}))
+			defer srv.Close()
+			useConfig(t, func(c *Config) { c.Upstream.BaseURL = srv.URL })
+			p := newTestKeyPool(t, KeyStrategyRoundRobin, 1)
+			provider := NewOpenrouterProvider(p, nil)
+
+			msgs := []openai.ChatCompletionMessage{{Role: openai.ChatMessageRoleUser, Content: "hi"}}
+			stream, err := provider.ChatStream(context.Background(), msgs, "openai/gpt-4o")
+			if err != nil {
+				t.Fatal(err)
+			}
+			for {
+				if _, err := stream.Recv(); err != nil {
+					break
+				}
+			}
+			stream.Close()
+
+			k := p.keys[0]
+			if k.inFlight != 0 {
+				t.Errorf("in flight = %d after close", k.inFlight)
+			}
+			if got := k.lastError != ""; got != tt.wantErr {
+				t.Errorf("key error recorded = %v (%q), want %v", got, k.lastError, tt.wantErr)
+			}
+		})
+	}
+}
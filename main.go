@@ -1,7 +1,6 @@
 package main
 
 import (
-	"bufio"
 	"context"
 	"encoding/json"
 	"errors"
@@ -11,65 +10,68 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"strconv"
 	"strings"
 	"syscall"
 	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	openai "github.com/sashabaranov/go-openai"
 )
 
-var modelFilter map[string]struct{}
-var freeModels []string
 var failureStore *FailureStore
 var freeMode bool
 var globalRateLimiter *GlobalRateLimiter
 var permanentFailures *PermanentFailureTracker
-var apiKey string // Global API key for OpenRouter
-
-func loadModelFilter(path string) (map[string]struct{}, error) {
-	file, err := os.Open(path)
-	if err != nil {
-		return nil, err
-	}
-	defer file.Close()
+var modelOverrides *ModelOverrideStore // Models disabled or pinned through the admin API
+var keyPool *KeyPool // Pool of OpenRouter API keys
+var modelCatalog *CatalogService // Cached OpenRouter model metadata
+var responseCache *ResponseCache // Cached chat responses, nil when disabled
+
+// databasePath returns the SQLite database shared by the failure store, quota
+// tracking and client keys
+func databasePath() string {
+	return currentConfig().Storage.Database
+}
 
-	scanner := bufio.NewScanner(file)
-	filter := make(map[string]struct{})
+func main() {
+	// Configure structured logging
+	logger := slog.New(slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{Level: &logLevel}))
+	slog.SetDefault(logger)
 
-	for scanner.Scan() {
-		line := strings.TrimSpace(scanner.Text())
-		if line != "" {
-			filter[line] = struct{}{}
-		}
+	// Subcommands for managing the proxy without starting the server
+	if len(os.Args) > 1 && os.Args[1] == "config" {
+		os.Exit(runConfigCommand(os.Args[2:]))
 	}
 
-	if err := scanner.Err(); err != nil {
-		return nil, err
+	configFile := configPath()
+	cfg, err := loadConfig(configFile)
+	if err != nil {
+		slog.Error("invalid configuration", "file", configFile, "error", err)
+		os.Exit(1)
 	}
+	proxyConfig.Store(cfg)
+	logLevel.Set(cfg.slogLevel())
 
-	return filter, nil
-}
-
-func main() {
-	// Configure structured logging
-	logLevel := os.Getenv("LOG_LEVEL")
-	if logLevel == "" {
-		logLevel = "info"
+	if len(os.Args) > 1 && os.Args[1] == "keys" {
+		os.Exit(runKeysCommand(os.Args[2:]))
 	}
-	var level slog.Level
-	switch strings.ToLower(logLevel) {
-	case "debug":
-		level = slog.LevelDebug
-	case "warn":
-		level = slog.LevelWarn
-	case "error":
-		level = slog.LevelError
-	default:
-		level = slog.LevelInfo
+
+	// Tracing is disabled unless an exporter is configured
+	shutdownTracing, err := initTracing(context.Background(), cfg.Tracing)
+	if err != nil {
+		slog.Error("failed to initialize tracing", "error", err)
+		os.Exit(1)
 	}
-	logger := slog.New(slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{Level: level}))
-	slog.SetDefault(logger)
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := shutdownTracing(ctx); err != nil {
+			slog.Error("failed to flush traces", "error", err)
+		}
+	}()
 
 	// Configure Gin with custom middleware
 	if os.Getenv("GIN_MODE") == "" {
@@ -77,77 +79,225 @@ func main() {
 	}
 	r := gin.New()
 	r.Use(gin.Recovery())
-	r.Use(gin.Logger())
-	// Load the API key from environment variables.
-	// Support both OPENROUTER_API_KEY (preferred) and OPENAI_API_KEY (backward compatibility)
-	apiKey = os.Getenv("OPENROUTER_API_KEY")
-	if apiKey == "" {
-		apiKey = os.Getenv("OPENAI_API_KEY") // Fallback for backward compatibility
-		if apiKey != "" {
-			slog.Warn("Using deprecated OPENAI_API_KEY env var. Please use OPENROUTER_API_KEY instead.")
+	r.Use(gin.LoggerWithFormatter(func(param gin.LogFormatterParams) string {
+		// Same as gin's default log line, tagged with the authenticated client
+		client, _ := param.Keys["client"].(string)
+		if client == "" {
+			client = "-"
 		}
+		return fmt.Sprintf("[GIN] %v | %3d | %13v | %15s | %-7s %#v | client=%s\n%s",
+			param.TimeStamp.Format("2006/01/02 - 15:04:05"),
+			param.StatusCode,
+			param.Latency,
+			param.ClientIP,
+			param.Method,
+			param.Path,
+			client,
+			param.ErrorMessage,
+		)
+	}))
+	r.Use(metricsMiddleware())
+	r.Use(tracingMiddleware())
+
+	// Upstream traffic can be recorded to a cassette file, or replayed from one
+	// without contacting OpenRouter
+	if err := initCassette(cfg.Cassette); err != nil {
+		slog.Error("failed to load cassette", "path", cfg.Cassette.Path, "error", err)
+		os.Exit(1)
 	}
-	if apiKey == "" {
-		slog.Error("OPENROUTER_API_KEY environment variable not set.")
+	defer func() {
+		if err := closeCassette(); err != nil {
+			slog.Error("failed to close cassette", "path", cfg.Cassette.Path, "error", err)
+		}
+	}()
+	// API keys come from upstream.api_keys or the OPENROUTER_API_KEYS,
+	// OPENROUTER_API_KEY and OPENAI_API_KEY environment variables
+	apiKeys := cfg.Upstream.APIKeys
+	if cfg.Cassette.Mode == CassetteReplay && len(apiKeys) == 0 {
+		// Replayed requests are never sent, so no key is needed
+		apiKeys = []string{"cassette-replay"}
+	}
+	keyPool, err = NewKeyPool(apiKeys, cfg.Upstream.KeyStrategy)
+	if err != nil {
+		slog.Error("OPENROUTER_API_KEY environment variable or upstream.api_keys not set.", "error", err)
 		os.Exit(1)
 	}
+	defer func() {
+		if err := keyPool.Close(); err != nil {
+			slog.Error("failed to close key pool", "error", err)
+		}
+	}()
+	if keyPool.Len() > 1 {
+		slog.Info("API key pool enabled", "keys", keyPool.Len(), "strategy", keyPool.strategy)
+	}
 
-	freeMode = strings.ToLower(os.Getenv("FREE_MODE")) != "false"
+	freeMode = cfg.Routing.FreeMode
+	dbFile := cfg.Storage.Database
 	
 	// Initialize global components
 	globalRateLimiter = NewGlobalRateLimiter()
 	permanentFailures = NewPermanentFailureTracker()
 
-	if freeMode {
-		var err error
-		cacheFile := os.Getenv("FREE_MODELS_CACHE")
-		if cacheFile == "" {
-			cacheFile = "free-models"
+	// Failures are recorded in both modes; free mode skips models in cooldown
+	// and shows them in the admin API
+	failureStore, err = NewFailureStore(dbFile)
+	if err != nil {
+		slog.Error("failed to init failure store", "error", err)
+		os.Exit(1)
+	}
+	defer func() {
+		if err := failureStore.Close(); err != nil {
+			slog.Error("failed to close failure store", "error", err)
 		}
-		freeModels, err = ensureFreeModelFile(apiKey, cacheFile)
-		if err != nil {
+	}()
+
+	cacheFile := cfg.Routing.CatalogCache
+	modelCatalog = NewCatalogService(cacheFile, cfg.Routing.CatalogTTL, keyPool.AnyKey)
+	if freeMode {
+		// Free-mode discovery follows every catalog refresh
+		modelCatalog.OnChange(func(catalog *ModelCatalog) { loadFreeModels(catalog) })
+		if _, err := modelCatalog.Load(); err != nil {
 			slog.Error("failed to load free models", "error", err)
 			os.Exit(1)
 		}
-		dbFile := os.Getenv("FAILURE_DB")
-		if dbFile == "" {
-			dbFile = "failures.db"
+		modelCatalog.Start()
+		if err := keyPool.EnableQuota(dbFile); err != nil {
+			slog.Error("failed to init quota tracker", "error", err)
+			os.Exit(1)
 		}
-		failureStore, err = NewFailureStore(dbFile)
+		modelOverrides, err = NewModelOverrideStore(dbFile)
 		if err != nil {
-			slog.Error("failed to init failure store", "error", err)
+			slog.Error("failed to init model overrides", "error", err)
 			os.Exit(1)
 		}
 		defer func() {
-			if err := failureStore.Close(); err != nil {
-				slog.Error("failed to close failure store", "error", err)
+			if err := modelOverrides.Close(); err != nil {
+				slog.Error("failed to close model overrides", "error", err)
 			}
 		}()
-		slog.Info("Free mode enabled", "models", len(freeModels), "cache_file", cacheFile, "db_file", dbFile)
+		// Replayed requests use no quota, and polling key info would only miss the cassette
+		if cfg.Upstream.QuotaSync && cfg.Cassette.Mode != CassetteReplay {
+			// Stopped before the quota trackers are closed
+			syncCtx, stopSync := context.WithCancel(context.Background())
+			defer stopSync()
+			keyPool.StartQuotaSync(syncCtx, 15*time.Minute)
+		}
+		slog.Info("Free mode enabled", "models", len(currentFreeModels()), "cache_file", cacheFile, "cache_ttl", cfg.Routing.CatalogTTL, "db_file", dbFile)
+	}
+
+	provider := NewOpenrouterProvider(keyPool, modelCatalog)
+
+	filterPath := cfg.Routing.ModelFilter
+	if err := reloadModelFilter(filterPath); err != nil {
+		slog.Error("Error loading models filter", "error", err, "path", filterPath)
+		os.Exit(1)
+	}
+	if currentModelFilter().Len() == 0 {
+		slog.Debug("models-filter file not found, all models will be available", "path", filterPath)
+	} else {
+		slog.Info("Model filter loaded", "patterns", currentModelFilter().Rules(), "path", filterPath)
 	}
 
-	provider := NewOpenrouterProvider(apiKey)
+	// Reload the filter and the config file on SIGHUP or when they change,
+	// keeping the previous version if the new one is invalid
+	reloader := NewConfigReloader()
+	reloader.Register("model filter", filterPath, func() error { return reloadModelFilter(filterPath) })
+	if configFile != "" {
+		reloader.Register("config file", configFile, func() error {
+			toolUseOnly := currentConfig().Routing.ToolUseOnly
+			if err := reloadConfig(configFile); err != nil {
+				return err
+			}
+			// The free list depends on tool_use_only, recompute it from the current catalog
+			if freeMode && currentConfig().Routing.ToolUseOnly != toolUseOnly {
+				if catalog, err := modelCatalog.Get(); err == nil {
+					loadFreeModels(catalog)
+				}
+			}
+			return nil
+		})
+	}
+	reloader.Start(cfg.Routing.ConfigWatch)
 
-	filterPath := os.Getenv("MODEL_FILTER_PATH")
-	if filterPath == "" {
-		filterPath = "/models-filter/filter"
+	clientKeys, err := NewClientKeyStore(dbFile)
+	if err != nil {
+		slog.Error("failed to init client key store", "error", err)
+		os.Exit(1)
 	}
-	filter, err := loadModelFilter(filterPath)
+	defer func() {
+		if err := clientKeys.Close(); err != nil {
+			slog.Error("failed to close client key store", "error", err)
+		}
+	}()
+
+	usageStore, err := NewUsageStore(dbFile)
 	if err != nil {
-		if os.IsNotExist(err) {
-			slog.Debug("models-filter file not found, all models will be available", "path", filterPath)
-			modelFilter = make(map[string]struct{})
-		} else {
-			slog.Error("Error loading models filter", "error", err, "path", filterPath)
+		slog.Error("failed to init usage store", "error", err)
+		os.Exit(1)
+	}
+	defer func() {
+		if err := usageStore.Close(); err != nil {
+			slog.Error("failed to close usage store", "error", err)
+		}
+	}()
+
+	spendStore, err := NewSpendStore(dbFile)
+	if err != nil {
+		slog.Error("failed to init spend store", "error", err)
+		os.Exit(1)
+	}
+	defer func() {
+		if err := spendStore.Close(); err != nil {
+			slog.Error("failed to close spend store", "error", err)
+		}
+	}()
+
+	if cfg.ResponseCache.Enabled {
+		responseCache, err = NewResponseCache(dbFile)
+		if err != nil {
+			slog.Error("failed to init response cache", "error", err)
 			os.Exit(1)
 		}
-	} else {
-		modelFilter = filter
-		filterPatterns := make([]string, 0, len(modelFilter))
-		for pattern := range modelFilter {
-			filterPatterns = append(filterPatterns, pattern)
+		defer func() {
+			if err := responseCache.Close(); err != nil {
+				slog.Error("failed to close response cache", "error", err)
+			}
+		}()
+		slog.Info("Response cache enabled", "ttl", cfg.ResponseCache.TTL, "max_entries", cfg.ResponseCache.MaxEntries, "max_size_mb", cfg.ResponseCache.MaxSizeMB)
+	}
+
+	retention := time.Duration(cfg.Storage.RequestLogRetentionDays) * 24 * time.Hour
+	requestLog, err := NewRequestLogStore(dbFile, retention)
+	if err != nil {
+		slog.Error("failed to init request log", "error", err)
+		os.Exit(1)
+	}
+	defer func() {
+		if err := requestLog.Close(); err != nil {
+			slog.Error("failed to close request log", "error", err)
+		}
+	}()
+	requestLog.StartPruning()
+
+	// Optional inbound authentication for the model and chat endpoints
+	api := r.Group("/")
+	if cfg.Auth.Enabled {
+		authHeader := cfg.Auth.Header
+		api.Use(clientAuthMiddleware(clientKeys, authHeader))
+		slog.Info("Client authentication enabled", "header", authHeader)
+	}
+
+	// Admin API, only available when a token is configured
+	if adminToken := cfg.Auth.AdminAPIKey; adminToken != "" {
+		admin := r.Group("/admin", adminAuthMiddleware(adminToken))
+		registerClientKeyRoutes(admin, clientKeys)
+		registerUsageRoutes(admin, usageStore)
+		registerSpendRoutes(admin, spendStore)
+		registerRequestLogRoutes(admin, requestLog)
+		if freeMode {
+			registerModelAdminRoutes(admin, filterPath)
 		}
-		slog.Info("Model filter loaded", "patterns", filterPatterns, "path", filterPath)
+		registerDashboardRoutes(r, admin)
 	}
 
 	// Health check endpoint with metrics
@@ -155,6 +305,9 @@ func main() {
 		c.String(http.StatusOK, "Ollama is running")
 	})
 	
+	// Prometheus metrics
+	r.GET("/metrics", gin.WrapH(promhttp.Handler()))
+
 	// Simple health endpoint
 	r.GET("/health", func(c *gin.Context) {
 		c.JSON(http.StatusOK, gin.H{"status": "ok"})
@@ -163,16 +316,18 @@ func main() {
 		c.String(http.StatusOK, "")
 	})
 
-	r.GET("/api/tags", func(c *gin.Context) {
+	api.GET("/api/tags", func(c *gin.Context) {
 		var newModels []map[string]interface{}
+		client := clientFromContext(c.Request.Context())
 		
 		// Check if tool use filtering is enabled
-		toolUseOnly := strings.ToLower(os.Getenv("TOOL_USE_ONLY")) == "true"
+		toolUseOnly := currentConfig().Routing.ToolUseOnly
 
 		if freeMode {
 			// In free mode, show only available free models
 			currentTime := time.Now().Format(time.RFC3339)
-			for _, freeModel := range freeModels {
+			names := listingNames(freeModelCandidates())
+			for _, freeModel := range routingOrder() {
 				// Check if model should be skipped due to recent failures
 				skip, err := failureStore.ShouldSkip(freeModel)
 				if err != nil {
@@ -183,14 +338,16 @@ func main() {
 					continue // Skip recently failed models
 				}
 
-				// Extract display name from full model name
-				parts := strings.Split(freeModel, "/")
-				displayName := parts[len(parts)-1]
+				// Display name, qualified with the vendor when it is shared
+				displayName := names.name(freeModel)
 
 				// Apply model filter if it exists
-				if !isModelInFilter(displayName, modelFilter) {
+				if !currentModelFilter().Allows(freeModel) {
 					continue // Skip models not in filter
 				}
+				if !client.AllowsModel(freeModel) {
+					continue
+				}
 
 				newModels = append(newModels, map[string]interface{}{
 					"name":        displayName,
@@ -211,52 +368,33 @@ func main() {
 		} else {
 			// Non-free mode: use original logic
 			if toolUseOnly {
-				// If tool use filtering is enabled, we need to fetch full model details from OpenRouter
-				req, err := http.NewRequest("GET", "https://openrouter.ai/api/v1/models", nil)
-				if err != nil {
-					slog.Error("Error creating request for models", "Error", err)
-					c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-					return
-				}
-				req.Header.Set("Authorization", "Bearer "+apiKey)
-				
-				resp, err := http.DefaultClient.Do(req)
+				// Tool support is only known from the full model details in the catalog cache
+				catalog, err := modelCatalog.Get()
 				if err != nil {
 					slog.Error("Error fetching models from OpenRouter", "Error", err)
 					c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 					return
 				}
-				defer resp.Body.Close()
-				
-				if resp.StatusCode != http.StatusOK {
-					slog.Error("Unexpected status from OpenRouter", "status", resp.Status)
-					c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch models"})
-					return
-				}
-				
-				var result orModels
-				if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
-					slog.Error("Error decoding models response", "Error", err)
-					c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-					return
-				}
 				
 				// Filter models based on tool use support and model filter
 				currentTime := time.Now().Format(time.RFC3339)
-				newModels = make([]map[string]interface{}, 0, len(result.Data))
-				for _, m := range result.Data {
+				newModels = make([]map[string]interface{}, 0, len(catalog.Models))
+				names := listingNames(catalog.IDs())
+				for _, m := range catalog.Models {
 					if !supportsToolUse(m.SupportedParameters) {
 						continue // Skip models that don't support tool use
 					}
 					
-					// Extract display name from full model name
-					parts := strings.Split(m.ID, "/")
-					displayName := parts[len(parts)-1]
+					// Display name, qualified with the vendor when it is shared
+					displayName := names.name(m.ID)
 					
 					// Apply model filter if it exists
-					if !isModelInFilter(displayName, modelFilter) {
+					if !currentModelFilter().AllowsRecord(m) {
 						continue // Skip models not in filter
 					}
+					if !client.AllowsModel(m.ID) {
+						continue
+					}
 					
 					newModels = append(newModels, map[string]interface{}{
 						"name":        displayName,
@@ -282,14 +420,14 @@ func main() {
 					c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 					return
 				}
-				filter := modelFilter
 				newModels = make([]map[string]interface{}, 0, len(models))
 				for _, m := range models {
 					// Если фильтр пустой, значит пропускаем проверку и берём все модели
-					if len(filter) > 0 {
-						if _, ok := filter[m.Model]; !ok {
-							continue
-						}
+					if !currentModelFilter().Allows(m.ID) {
+						continue
+					}
+					if !client.AllowsModel(m.ID) {
+						continue
 					}
 					newModels = append(newModels, map[string]interface{}{
 						"name":        m.Name,
@@ -303,10 +441,12 @@ func main() {
 			}
 		}
 
+		newModels = append(newModels, virtualModelTags()...)
+		newModels = append(newModels, aliasTags(client)...)
 		c.JSON(http.StatusOK, gin.H{"models": newModels})
 	})
 
-	r.POST("/api/show", func(c *gin.Context) {
+	api.POST("/api/show", func(c *gin.Context) {
 		var request map[string]string
 		if err := c.BindJSON(&request); err != nil {
 			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid JSON payload"})
@@ -328,19 +468,26 @@ func main() {
 		c.JSON(http.StatusOK, details)
 	})
 
-	r.POST("/api/chat", func(c *gin.Context) {
+	api.POST("/api/chat", requestLogMiddleware(requestLog), usageMiddleware(usageStore), spendMiddleware(spendStore), fallbackMiddleware(), func(c *gin.Context) {
 		var request struct {
 			Model    string                         `json:"model"`
 			Messages []openai.ChatCompletionMessage `json:"messages"`
 			Stream   *bool                          `json:"stream"` // Добавим поле Stream
+			Options  *ollamaOptions                 `json:"options"`
 		}
 
 		// Parse the JSON request with validation
-		if err := c.ShouldBindJSON(&request); err != nil {
+		if err := c.ShouldBindBodyWith(&request, binding.JSON); err != nil {
 			slog.Warn("Invalid JSON in chat request", "error", err)
 			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid JSON payload: " + err.Error()})
 			return
 		}
+		// OpenRouter request fields are passed through to the upstream request
+		extras, err := requestExtras(c)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
 		
 		// Validate required fields
 		if request.Model == "" {
@@ -351,6 +498,16 @@ func main() {
 			c.JSON(http.StatusBadRequest, gin.H{"error": "Messages array cannot be empty"})
 			return
 		}
+		client := clientFromContext(c.Request.Context())
+		if !allowsRequestedModel(client, request.Model) {
+			respondError(c, http.StatusForbidden, "permission_denied", fmt.Sprintf("model %q is not allowed for this API key", request.Model))
+			return
+		}
+		if denied := extras.deniedModel(client); denied != "" {
+			respondError(c, http.StatusForbidden, "permission_denied", fmt.Sprintf("model %q is not allowed for this API key", denied))
+			return
+		}
+		c.Request = c.Request.WithContext(withUpstreamExtras(c.Request.Context(), extras))
 
 		// Определяем, нужен ли стриминг (по умолчанию true, если не указано для /api/chat)
 		// ВАЖНО: Open WebUI может НЕ передавать "stream": true для /api/chat, подразумевая это.
@@ -359,6 +516,27 @@ func main() {
 		if request.Stream != nil {
 			streamRequested = *request.Stream
 		}
+		describeRequest(c.Request.Context(), request.Model, streamRequested)
+
+		cacheKey := chatRequestKey(c, request.Model, request.Messages, request.Options.sampling())
+		if cached := responseCache.Lookup(c, cacheKey); cached != nil {
+			writeCachedOllama(c, cached, streamRequested)
+			return
+		}
+		// Identical requests in flight share one upstream call
+		flight, leader := coalescer.Join(cacheKey)
+		if !leader && flight.Follow(c, false, streamRequested, false) {
+			return
+		}
+		if leader {
+			defer flight.Done()
+			// Followers still need the response if this client goes away
+			ctx, cancel := flight.Context(c.Request.Context())
+			defer cancel()
+			c.Request = c.Request.WithContext(ctx)
+		} else {
+			flight = nil
+		}
 
 		// Если стриминг не запрошен, нужно будет реализовать отдельную логику
 		// для сбора полного ответа и отправки его одним JSON.
@@ -368,10 +546,18 @@ func main() {
 			var fullModelName string
 			var err error
 			if freeMode {
-				response, fullModelName, err = getFreeChatForModel(provider, request.Messages, request.Model)
+				response, fullModelName, err = getFreeChatForModel(c.Request.Context(), provider, request.Messages, request.Model)
 				if err != nil {
 					slog.Error("free mode failed", "error", err, "requested_model", request.Model)
-					if strings.Contains(err.Error(), "no free models available") {
+					recordError(c.Request.Context(), err)
+					if isUnresolvedModel(err) {
+						respondUnresolvedModel(c, err, false)
+						return
+					}
+					var quotaErr *QuotaExceededError
+					if errors.As(err, &quotaErr) {
+						respondQuotaExceeded(c, quotaErr, false)
+					} else if strings.Contains(err.Error(), "no free models available") {
 						c.JSON(http.StatusServiceUnavailable, gin.H{"error": "No free models currently available, please try again later"})
 					} else {
 						c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
@@ -379,21 +565,30 @@ func main() {
 					return
 				}
 			} else {
-				fullModelName, err = provider.GetFullModelName(request.Model)
+				var targets []string
+				targets, err = resolveModelTargets(provider, request.Model)
 				if err != nil {
 					slog.Error("Error getting full model name", "Error", err)
+					recordError(c.Request.Context(), err)
 					// Ollama returns 404 for invalid model names
-					c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+					respondUnresolvedModel(c, err, false)
 					return
 				}
-				response, err = provider.Chat(request.Messages, fullModelName)
+				response, fullModelName, err = getChatForModels(c.Request.Context(), provider, request.Messages, request.Model, targets)
 				if err != nil {
 					slog.Error("Failed to get chat response", "Error", err)
+					recordError(c.Request.Context(), err)
+					if respondModelNotAllowed(c, err) {
+						return
+					}
 					c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 					return
 				}
 			}
 
+			// Price and report the model that actually answered
+			fullModelName = servedModel(fullModelName, response.Model)
+
 			// Format the response according to Ollama's format
 			if len(response.Choices) == 0 {
 				c.JSON(http.StatusInternalServerError, gin.H{"error": "No response from model"})
@@ -428,46 +623,64 @@ func main() {
 				"eval_count":        response.Usage.CompletionTokens,
 				"eval_duration":     response.Usage.CompletionTokens * 10, // Approximate duration based on token count
 			}
+			cost := setUsage(c, fullModelName, response.Usage)
+			ollamaResponse["cost"] = cost
+			responseCache.Store(cacheKey, CachedResponse{Model: fullModelName, Content: content, FinishReason: finishReason, Usage: response.Usage})
+			flight.Start(fullModelName)
+			flight.Write(content)
+			flight.Finish(finishReason, response.Usage)
 
-			slog.Info("Used model", "model", fullModelName)
+			c.Header(servedModelHeader, fullModelName)
+			c.Header(requestCostHeader, formatCost(cost))
+			slog.Info("Used model", "model", fullModelName, "client", client.ClientName(), "cost", cost)
 
 			c.JSON(http.StatusOK, ollamaResponse)
 			return
 		}
 
-		slog.Info("Requested model", "model", request.Model)
-		var stream *openai.ChatCompletionStream
+		slog.Info("Requested model", "model", request.Model, "client", client.ClientName())
+		var stream *ChatStream
 		var fullModelName string
-		var err error
 		if freeMode {
-			stream, fullModelName, err = getFreeStreamForModel(provider, request.Messages, request.Model)
+			stream, fullModelName, err = getFreeStreamForModel(c.Request.Context(), provider, request.Messages, request.Model)
 			if err != nil {
 				slog.Error("free mode failed", "error", err)
+				recordError(c.Request.Context(), err)
+				if isUnresolvedModel(err) {
+					respondUnresolvedModel(c, err, false)
+					return
+				}
+				var quotaErr *QuotaExceededError
+				if errors.As(err, &quotaErr) {
+					respondQuotaExceeded(c, quotaErr, false)
+					return
+				}
 				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 				return
 			}
 		} else {
-			fullModelName, err = provider.GetFullModelName(request.Model)
+			var targets []string
+			targets, err = resolveModelTargets(provider, request.Model)
 			if err != nil {
 				slog.Error("Error getting full model name", "Error", err, "model", request.Model)
-				c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+				recordError(c.Request.Context(), err)
+				respondUnresolvedModel(c, err, false)
 				return
 			}
-			stream, err = provider.ChatStream(request.Messages, fullModelName)
+			stream, fullModelName, err = getStreamForModels(c.Request.Context(), provider, request.Messages, request.Model, targets)
 			if err != nil {
 				slog.Error("Failed to create stream", "Error", err)
+				recordError(c.Request.Context(), err)
+				if respondModelNotAllowed(c, err) {
+					return
+				}
 				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 				return
 			}
 		}
 		slog.Info("Using model", "fullModelName", fullModelName)
-		// Call ChatStream to get the stream
-		if err != nil {
-			slog.Error("Failed to create stream", "Error", err)
-			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-			return
-		}
 		defer stream.Close() // Ensure stream closure
+		flight.Start(fullModelName)
 
 		// --- ИСПРАВЛЕНИЯ для NDJSON (Ollama-style) ---
 
@@ -475,7 +688,9 @@ func main() {
 		c.Writer.Header().Set("Content-Type", "application/x-ndjson") // <--- КЛЮЧЕВОЕ ИЗМЕНЕНИЕ
 		c.Writer.Header().Set("Cache-Control", "no-cache")
 		c.Writer.Header().Set("Connection", "keep-alive")
+		c.Writer.Header().Set(servedModelHeader, fullModelName)
 		// Transfer-Encoding: chunked устанавливается Gin автоматически
+		defer trackStream(c)()
 
 		w := c.Writer // Получаем ResponseWriter
 		flusher, ok := w.(http.Flusher)
@@ -486,6 +701,8 @@ func main() {
 		}
 
 		var lastFinishReason string
+		var usage openai.Usage
+		var content strings.Builder
 
 		// Stream responses back to the client
 		for {
@@ -496,6 +713,7 @@ func main() {
 			}
 			if err != nil {
 				slog.Error("Backend stream error", "Error", err)
+				recordError(c.Request.Context(), err)
 				// Попытка отправить ошибку в формате NDJSON
 				// Ollama обычно просто обрывает соединение или шлет 500 перед этим
 				errorMsg := map[string]string{"error": "Stream error: " + err.Error()}
@@ -505,11 +723,29 @@ func main() {
 				return
 			}
 
+			if model := servedModel(fullModelName, response.Model); model != fullModelName {
+				fullModelName = model
+				w.Header().Set(servedModelHeader, model)
+				flight.Start(model)
+			}
+
+			// The usage chunk requested via stream_options carries no choices
+			if response.Usage != nil {
+				usage = *response.Usage
+			}
+			if len(response.Choices) == 0 {
+				continue
+			}
+			markFirstToken(c.Request.Context())
+
 			// Сохраняем причину остановки, если она есть в чанке
 			if len(response.Choices) > 0 && response.Choices[0].FinishReason != "" {
 				lastFinishReason = string(response.Choices[0].FinishReason)
 			}
 
+			content.WriteString(response.Choices[0].Delta.Content)
+			flight.Write(response.Choices[0].Delta.Content)
+
 			// Build JSON response structure for intermediate chunks (Ollama chat format)
 			responseJSON := map[string]interface{}{
 				"model":      fullModelName,
@@ -555,9 +791,10 @@ func main() {
 			"finish_reason":     lastFinishReason, // Необязательно для /api/chat Ollama, но не вредит
 			"total_duration":    0,
 			"load_duration":     0,
-			"prompt_eval_count": 0, // <--- ИЗМЕНЕНО: nil заменен на 0
-			"eval_count":        0, // <--- ИЗМЕНЕНО: nil заменен на 0
+			"prompt_eval_count": usage.PromptTokens,
+			"eval_count":        usage.CompletionTokens,
 			"eval_duration":     0,
+			"cost":              setUsage(c, fullModelName, usage),
 		}
 
 		finalJsonData, err := json.Marshal(finalResponse)
@@ -569,6 +806,8 @@ func main() {
 		// Отправляем финальный JSON-объект + newline
 		fmt.Fprintf(w, "%s\n", string(finalJsonData)) // <--- ИЗМЕНЕНО: Формат NDJSON
 		flusher.Flush()
+		responseCache.Store(cacheKey, CachedResponse{Model: fullModelName, Content: content.String(), FinishReason: lastFinishReason, Usage: usage})
+		flight.Finish(lastFinishReason, usage)
 
 		// ВАЖНО: Для NDJSON НЕТ 'data: [DONE]' маркера.
 		// Клиент понимает конец потока по получению объекта с "done": true
@@ -578,48 +817,105 @@ func main() {
 	})
 
 	// Add OpenAI-compatible endpoint for tools like Goose
-	r.POST("/v1/chat/completions", func(c *gin.Context) {
+	api.POST("/v1/chat/completions", requestLogMiddleware(requestLog), usageMiddleware(usageStore), spendMiddleware(spendStore), fallbackMiddleware(), func(c *gin.Context) {
 		var request openai.ChatCompletionRequest
-		if err := c.ShouldBindJSON(&request); err != nil {
+		if err := c.ShouldBindBodyWith(&request, binding.JSON); err != nil {
 			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid JSON payload"})
 			return
 		}
+		// OpenRouter request fields are passed through to the upstream request
+		extras, err := requestExtras(c)
+		if err != nil {
+			respondError(c, http.StatusBadRequest, "invalid_request_error", err.Error())
+			return
+		}
 
-		slog.Info("OpenAI API request", "model", request.Model, "stream", request.Stream)
+		client := clientFromContext(c.Request.Context())
+		slog.Info("OpenAI API request", "model", request.Model, "stream", request.Stream, "client", client.ClientName())
+		describeRequest(c.Request.Context(), request.Model, request.Stream)
+		if !allowsRequestedModel(client, request.Model) {
+			respondError(c, http.StatusForbidden, "permission_denied", fmt.Sprintf("model %q is not allowed for this API key", request.Model))
+			return
+		}
+		if denied := extras.deniedModel(client); denied != "" {
+			respondError(c, http.StatusForbidden, "permission_denied", fmt.Sprintf("model %q is not allowed for this API key", denied))
+			return
+		}
+		c.Request = c.Request.WithContext(withUpstreamExtras(c.Request.Context(), extras))
+
+		includeUsage := request.StreamOptions != nil && request.StreamOptions.IncludeUsage
+		cacheKey := chatRequestKey(c, request.Model, request.Messages, openAISampling(request))
+		if cached := responseCache.Lookup(c, cacheKey); cached != nil {
+			writeCachedOpenAI(c, cached, request.Stream, includeUsage)
+			return
+		}
+		// Identical requests in flight share one upstream call
+		flight, leader := coalescer.Join(cacheKey)
+		if !leader && flight.Follow(c, true, request.Stream, includeUsage) {
+			return
+		}
+		if leader {
+			defer flight.Done()
+			// Followers still need the response if this client goes away
+			ctx, cancel := flight.Context(c.Request.Context())
+			defer cancel()
+			c.Request = c.Request.WithContext(ctx)
+		} else {
+			flight = nil
+		}
 
 		if request.Stream {
 			// Handle streaming request
-			var stream *openai.ChatCompletionStream
+			var stream *ChatStream
 			var fullModelName string
 			var err error
 
 			if freeMode {
-				stream, fullModelName, err = getFreeStreamForModel(provider, request.Messages, request.Model)
+				stream, fullModelName, err = getFreeStreamForModel(c.Request.Context(), provider, request.Messages, request.Model)
 				if err != nil {
 					slog.Error("free mode streaming failed", "error", err)
+					recordError(c.Request.Context(), err)
+					if isUnresolvedModel(err) {
+						respondUnresolvedModel(c, err, true)
+						return
+					}
+					var quotaErr *QuotaExceededError
+					if errors.As(err, &quotaErr) {
+						respondQuotaExceeded(c, quotaErr, true)
+						return
+					}
 					c.JSON(http.StatusInternalServerError, gin.H{"error": gin.H{"message": err.Error()}})
 					return
 				}
 			} else {
-				fullModelName, err = provider.GetFullModelName(request.Model)
+				var targets []string
+				targets, err = resolveModelTargets(provider, request.Model)
 				if err != nil {
 					slog.Error("Error getting full model name", "Error", err, "model", request.Model)
-					c.JSON(http.StatusNotFound, gin.H{"error": gin.H{"message": err.Error()}})
+					recordError(c.Request.Context(), err)
+					respondUnresolvedModel(c, err, true)
 					return
 				}
-				stream, err = provider.ChatStream(request.Messages, fullModelName)
+				stream, fullModelName, err = getStreamForModels(c.Request.Context(), provider, request.Messages, request.Model, targets)
 				if err != nil {
 					slog.Error("Failed to create stream", "Error", err)
+					recordError(c.Request.Context(), err)
+					if respondModelNotAllowed(c, err) {
+						return
+					}
 					c.JSON(http.StatusInternalServerError, gin.H{"error": gin.H{"message": err.Error()}})
 					return
 				}
 			}
 			defer stream.Close()
+			flight.Start(fullModelName)
 
 			// Set headers for Server-Sent Events (OpenAI format)
 			c.Writer.Header().Set("Content-Type", "text/event-stream")
 			c.Writer.Header().Set("Cache-Control", "no-cache")
 			c.Writer.Header().Set("Connection", "keep-alive")
+			c.Writer.Header().Set(servedModelHeader, fullModelName)
+			defer trackStream(c)()
 
 			w := c.Writer
 			flusher, ok := w.(http.Flusher)
@@ -629,19 +925,59 @@ func main() {
 			}
 
 			// Stream responses in OpenAI format
+			var usage openai.Usage
+			var content strings.Builder
+			var finishReason string
+			completed := false
 			for {
 				response, err := stream.Recv()
 				if errors.Is(err, io.EOF) {
 					// Send final [DONE] message
 					fmt.Fprintf(w, "data: [DONE]\n\n")
 					flusher.Flush()
+					completed = true
 					break
 				}
 				if err != nil {
 					slog.Error("Stream error", "Error", err)
+					recordError(c.Request.Context(), err)
 					break
 				}
 
+				if model := servedModel(fullModelName, response.Model); model != fullModelName {
+					fullModelName = model
+					w.Header().Set(servedModelHeader, model)
+					flight.Start(model)
+				}
+
+				// The usage chunk carries no choices, only forward it if the client asked for it
+				if len(response.Choices) == 0 {
+					if response.Usage == nil {
+						continue
+					}
+					usage = *response.Usage
+					cost := setUsage(c, fullModelName, usage)
+					if request.StreamOptions == nil || !request.StreamOptions.IncludeUsage {
+						continue
+					}
+					usageChunk := streamUsageWithCost{
+						ChatCompletionStreamResponse: openai.ChatCompletionStreamResponse{
+							ID:      "chatcmpl-" + fmt.Sprintf("%d", time.Now().Unix()),
+							Object:  "chat.completion.chunk",
+							Created: time.Now().Unix(),
+							Model:   fullModelName,
+							Choices: []openai.ChatCompletionStreamChoice{},
+						},
+						Usage: costUsage{Usage: usage, Cost: cost},
+					}
+					if jsonData, err := json.Marshal(usageChunk); err == nil {
+						fmt.Fprintf(w, "data: %s\n\n", string(jsonData))
+						flusher.Flush()
+					}
+					continue
+				}
+				markFirstToken(c.Request.Context())
+
 				// Convert to OpenAI response format
 				openaiResponse := openai.ChatCompletionStreamResponse{
 					ID:      "chatcmpl-" + fmt.Sprintf("%d", time.Now().Unix()),
@@ -661,7 +997,10 @@ func main() {
 				// Add finish reason if present
 				if len(response.Choices) > 0 && response.Choices[0].FinishReason != "" {
 					openaiResponse.Choices[0].FinishReason = response.Choices[0].FinishReason
+					finishReason = string(response.Choices[0].FinishReason)
 				}
+				content.WriteString(response.Choices[0].Delta.Content)
+				flight.Write(response.Choices[0].Delta.Content)
 
 				jsonData, err := json.Marshal(openaiResponse)
 				if err != nil {
@@ -672,6 +1011,13 @@ func main() {
 				fmt.Fprintf(w, "data: %s\n\n", string(jsonData))
 				flusher.Flush()
 			}
+			if c.GetString("served_model") == "" {
+				setUsage(c, fullModelName, usage)
+			}
+			if completed {
+				responseCache.Store(cacheKey, CachedResponse{Model: fullModelName, Content: content.String(), FinishReason: finishReason, Usage: usage})
+				flight.Finish(finishReason, usage)
+			}
 		} else {
 			// Handle non-streaming request
 			var response openai.ChatCompletionResponse
@@ -679,48 +1025,87 @@ func main() {
 			var err error
 
 			if freeMode {
-				response, fullModelName, err = getFreeChatForModel(provider, request.Messages, request.Model)
+				response, fullModelName, err = getFreeChatForModel(c.Request.Context(), provider, request.Messages, request.Model)
 				if err != nil {
 					slog.Error("free mode failed", "error", err)
+					recordError(c.Request.Context(), err)
+					if isUnresolvedModel(err) {
+						respondUnresolvedModel(c, err, true)
+						return
+					}
+					var quotaErr *QuotaExceededError
+					if errors.As(err, &quotaErr) {
+						respondQuotaExceeded(c, quotaErr, true)
+						return
+					}
 					c.JSON(http.StatusInternalServerError, gin.H{"error": gin.H{"message": err.Error()}})
 					return
 				}
 			} else {
-				fullModelName, err = provider.GetFullModelName(request.Model)
+				var targets []string
+				targets, err = resolveModelTargets(provider, request.Model)
 				if err != nil {
 					slog.Error("Error getting full model name", "Error", err)
-					c.JSON(http.StatusNotFound, gin.H{"error": gin.H{"message": err.Error()}})
+					recordError(c.Request.Context(), err)
+					respondUnresolvedModel(c, err, true)
 					return
 				}
-				response, err = provider.Chat(request.Messages, fullModelName)
+				response, fullModelName, err = getChatForModels(c.Request.Context(), provider, request.Messages, request.Model, targets)
 				if err != nil {
 					slog.Error("Failed to get chat response", "Error", err)
+					recordError(c.Request.Context(), err)
+					if respondModelNotAllowed(c, err) {
+						return
+					}
 					c.JSON(http.StatusInternalServerError, gin.H{"error": gin.H{"message": err.Error()}})
 					return
 				}
 			}
 
+			// Price and report the model that actually answered
+			fullModelName = servedModel(fullModelName, response.Model)
+
 			// Return OpenAI-compatible response
 			response.ID = "chatcmpl-" + fmt.Sprintf("%d", time.Now().Unix())
 			response.Object = "chat.completion"
 			response.Created = time.Now().Unix()
 			response.Model = fullModelName
 
-			slog.Info("Used model", "model", fullModelName)
-			c.JSON(http.StatusOK, response)
+			cost := setUsage(c, fullModelName, response.Usage)
+			c.Header(servedModelHeader, fullModelName)
+			c.Header(requestCostHeader, formatCost(cost))
+			slog.Info("Used model", "model", fullModelName, "client", client.ClientName(), "cost", cost)
+			c.JSON(http.StatusOK, chatResponseWithCost{
+				ChatCompletionResponse: response,
+				Usage:                  costUsage{Usage: response.Usage, Cost: cost},
+			})
+			if len(response.Choices) > 0 {
+				responseCache.Store(cacheKey, CachedResponse{
+					Model:        fullModelName,
+					Content:      response.Choices[0].Message.Content,
+					FinishReason: string(response.Choices[0].FinishReason),
+					Usage:        response.Usage,
+				})
+				flight.Start(fullModelName)
+				flight.Write(response.Choices[0].Message.Content)
+				flight.Finish(string(response.Choices[0].FinishReason), response.Usage)
+			}
 		}
 	})
 
 	// Add OpenAI-compatible models endpoint
-	r.GET("/v1/models", func(c *gin.Context) {
+	api.GET("/v1/models", func(c *gin.Context) {
 		var models []gin.H
+		client := clientFromContext(c.Request.Context())
 		
 		// Check if tool use filtering is enabled
-		toolUseOnly := strings.ToLower(os.Getenv("TOOL_USE_ONLY")) == "true"
+		toolUseOnly := currentConfig().Routing.ToolUseOnly
 
 		if freeMode {
 			// In free mode, show only available free models
-			slog.Info("Free mode enabled for /v1/models", "totalFreeModels", len(freeModels), "filterSize", len(modelFilter))
+			freeModels := routingOrder()
+			names := listingNames(freeModelCandidates())
+			slog.Info("Free mode enabled for /v1/models", "totalFreeModels", len(freeModels), "filterSize", currentModelFilter().Len())
 			if len(freeModels) > 0 {
 				slog.Info("Sample free models:", "first", freeModels[0], "count", min(len(freeModels), 3))
 			}
@@ -734,17 +1119,19 @@ func main() {
 					continue
 				}
 
-				parts := strings.Split(freeModel, "/")
-				displayName := parts[len(parts)-1]
+				displayName := names.name(freeModel)
 
 				// Apply model filter if it exists
-				if !isModelInFilter(displayName, modelFilter) {
+				if !currentModelFilter().Allows(freeModel) {
 					slog.Info("Skipping model not in filter", "displayName", displayName, "fullModel", freeModel)
 					continue // Skip models not in filter
 				}
-				if len(modelFilter) > 0 {
+				if currentModelFilter().Len() > 0 {
 					slog.Info("Model passed filter", "displayName", displayName, "fullModel", freeModel)
 				}
+				if !client.AllowsModel(freeModel) {
+					continue
+				}
 
 				slog.Debug("Adding model to /v1/models", "model", displayName, "fullModel", freeModel)
 				models = append(models, gin.H{
@@ -757,50 +1144,31 @@ func main() {
 		} else {
 			// Non-free mode: get all models from provider
 			if toolUseOnly {
-				// If tool use filtering is enabled, we need to fetch full model details from OpenRouter
-				req, err := http.NewRequest("GET", "https://openrouter.ai/api/v1/models", nil)
-				if err != nil {
-					slog.Error("Error creating request for models", "Error", err)
-					c.JSON(http.StatusInternalServerError, gin.H{"error": gin.H{"message": err.Error()}})
-					return
-				}
-				req.Header.Set("Authorization", "Bearer "+apiKey)
-				
-				resp, err := http.DefaultClient.Do(req)
+				// Tool support is only known from the full model details in the catalog cache
+				catalog, err := modelCatalog.Get()
 				if err != nil {
 					slog.Error("Error fetching models from OpenRouter", "Error", err)
 					c.JSON(http.StatusInternalServerError, gin.H{"error": gin.H{"message": err.Error()}})
 					return
 				}
-				defer resp.Body.Close()
-				
-				if resp.StatusCode != http.StatusOK {
-					slog.Error("Unexpected status from OpenRouter", "status", resp.Status)
-					c.JSON(http.StatusInternalServerError, gin.H{"error": gin.H{"message": "Failed to fetch models"}})
-					return
-				}
-				
-				var result orModels
-				if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
-					slog.Error("Error decoding models response", "Error", err)
-					c.JSON(http.StatusInternalServerError, gin.H{"error": gin.H{"message": err.Error()}})
-					return
-				}
 				
 				// Filter models based on tool use support and model filter
-				for _, m := range result.Data {
+				names := listingNames(catalog.IDs())
+				for _, m := range catalog.Models {
 					if !supportsToolUse(m.SupportedParameters) {
 						continue // Skip models that don't support tool use
 					}
 					
-					// Extract display name from full model name
-					parts := strings.Split(m.ID, "/")
-					displayName := parts[len(parts)-1]
+					// Display name, qualified with the vendor when it is shared
+					displayName := names.name(m.ID)
 					
 					// Apply model filter if it exists
-					if !isModelInFilter(displayName, modelFilter) {
+					if !currentModelFilter().AllowsRecord(m) {
 						continue // Skip models not in filter
 					}
+					if !client.AllowsModel(m.ID) {
+						continue
+					}
 					
 					models = append(models, gin.H{
 						"id":       displayName,
@@ -819,10 +1187,11 @@ func main() {
 				}
 
 				for _, m := range providerModels {
-					if len(modelFilter) > 0 {
-						if _, ok := modelFilter[m.Model]; !ok {
-							continue
-						}
+					if !currentModelFilter().Allows(m.ID) {
+						continue
+					}
+					if !client.AllowsModel(m.ID) {
+						continue
 					}
 					models = append(models, gin.H{
 						"id":       m.Model,
@@ -834,6 +1203,8 @@ func main() {
 			}
 		}
 
+		models = append(models, virtualModelEntries()...)
+		models = append(models, aliasModels(client)...)
 		slog.Info("Returning models response", "modelCount", len(models))
 		c.JSON(http.StatusOK, gin.H{
 			"object": "list",
@@ -842,18 +1213,15 @@ func main() {
 	})
 
 	// Configure server port
-	port := os.Getenv("PORT")
-	if port == "" {
-		port = "11434"
-	}
+	port := strconv.Itoa(cfg.Listen.Port)
 	
 	// Add graceful shutdown
 	srv := &http.Server{
 		Addr:         ":" + port,
 		Handler:      r,
-		ReadTimeout:  30 * time.Second,
-		WriteTimeout: 30 * time.Second,
-		IdleTimeout:  120 * time.Second,
+		ReadTimeout:  cfg.Timeouts.ServerRead,
+		WriteTimeout: cfg.Timeouts.ServerWrite,
+		IdleTimeout:  cfg.Timeouts.ServerIdle,
 	}
 	
 	// Graceful shutdown setup
@@ -873,7 +1241,7 @@ func main() {
 	slog.Info("Shutting down server...")
 	
 	// Graceful shutdown with timeout
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.Timeouts.Shutdown)
 	defer cancel()
 	
 	if err := srv.Shutdown(ctx); err != nil {
@@ -883,27 +1251,33 @@ func main() {
 	slog.Info("Server shutdown complete")
 }
 
-func getFreeChat(provider *OpenrouterProvider, msgs []openai.ChatCompletionMessage) (openai.ChatCompletionResponse, string, error) {
+// getFreeChat tries the free models in routing order until one answers. A
+// policy, e.g. of a virtual model, further restricts the models; nil allows all.
+func getFreeChat(ctx context.Context, provider *OpenrouterProvider, msgs []openai.ChatCompletionMessage, policy *ModelFilter) (openai.ChatCompletionResponse, string, error) {
 	var resp openai.ChatCompletionResponse
 	var lastError error
 	attemptedModels := 0
 	availableModels := 0
+	client := clientFromContext(ctx)
 	
-	for _, m := range freeModels {
+	models := routingOrder()
+	for _, m := range models {
 		// Skip permanently failed models first
 		if permanentFailures.IsPermanentlyFailed(m) {
 			continue // Skip permanently failed models
 		}
 		
 		// Apply model filter if it exists
-		parts := strings.Split(m, "/")
-		displayName := parts[len(parts)-1]
-		if !isModelInFilter(displayName, modelFilter) {
+		if !currentModelFilter().Allows(m) || !policy.Allows(m) {
 			continue // Skip models not in filter
 		}
+		// Only fall back to models the client key is allowed to use
+		if !client.AllowsModel(m) {
+			continue
+		}
 		availableModels++
 
-		skip, err := failureStore.ShouldSkip(m)
+		skip, err := shouldSkipModel(ctx, m)
 		if err != nil {
 			slog.Debug("db error checking model", "error", err, "model", m)
 			// Continue trying even if DB check fails
@@ -913,19 +1287,32 @@ func getFreeChat(provider *OpenrouterProvider, msgs []openai.ChatCompletionMessa
 			continue
 		}
 		
+		// Stop cycling through models once the daily/minute quota is used up
+		if err := keyPool.CheckQuota(); err != nil {
+			return resp, "", err
+		}
+
 		attemptedModels++
 		slog.Debug("attempting model", "model", m, "attempt", attemptedModels)
 		
+		attemptCtx, span := startAttemptSpan(ctx, m, attemptedModels)
+
 		// Apply rate limiting
 		limiter := globalRateLimiter.GetLimiter(m)
-		limiter.Wait()
-		globalRateLimiter.WaitGlobal()
+		waitRateLimits(attemptCtx, limiter)
 		
-		resp, err = provider.Chat(msgs, m)
+		resp, err = provider.Chat(attemptCtx, msgs, m)
+		endSpan(span, err)
 		if err != nil {
 			lastError = err
 			limiter.RecordFailure(err)
 			
+			// Every key is out of quota, or the cassette has no response:
+			// every other free model would fail too
+			if endsRouting(err) {
+				return resp, "", err
+			}
+
 			// Check if this is a permanent failure (404, model not found)
 			if isPermanentError(err) {
 				permanentFailures.MarkPermanentFailure(m)
@@ -933,12 +1320,12 @@ func getFreeChat(provider *OpenrouterProvider, msgs []openai.ChatCompletionMessa
 			} else if isRateLimitError(err) {
 				slog.Warn("rate limit hit, backing off", "model", m, "error", err)
 				// Mark failure but with shorter cooldown for rate limits
-				_ = failureStore.MarkFailureWithType(m, "rate_limit")
+				_ = failureStore.MarkFailureWithError(m, "rate_limit", err)
 				// Add small delay before trying next model
 				time.Sleep(500 * time.Millisecond)
 			} else {
-				slog.Warn("model failed, trying next", "model", m, "error", err, "remaining", len(freeModels)-attemptedModels)
-				_ = failureStore.MarkFailure(m)
+				slog.Warn("model failed, trying next", "model", m, "error", err, "remaining", len(models)-attemptedModels)
+				_ = failureStore.MarkFailureWithError(m, "general", err)
 			}
 			continue
 		}
@@ -954,7 +1341,7 @@ func getFreeChat(provider *OpenrouterProvider, msgs []openai.ChatCompletionMessa
 	permCount, tempCount := permanentFailures.GetStats()
 	if availableModels == 0 {
 		if permCount > 0 {
-			return resp, "", fmt.Errorf("no models available (%d permanently failed, %d filtered out)", permCount, len(freeModels)-permCount)
+			return resp, "", fmt.Errorf("no models available (%d permanently failed, %d filtered out)", permCount, len(models)-permCount)
 		}
 		return resp, "", fmt.Errorf("no models match the current filter")
 	}
@@ -964,26 +1351,31 @@ func getFreeChat(provider *OpenrouterProvider, msgs []openai.ChatCompletionMessa
 	return resp, "", fmt.Errorf("no free models available (all %d models in cooldown, permanent failures: %d)", availableModels, permCount)
 }
 
-func getFreeStream(provider *OpenrouterProvider, msgs []openai.ChatCompletionMessage) (*openai.ChatCompletionStream, string, error) {
+// getFreeStream is the streaming variant of getFreeChat
+func getFreeStream(ctx context.Context, provider *OpenrouterProvider, msgs []openai.ChatCompletionMessage, policy *ModelFilter) (*ChatStream, string, error) {
 	var lastError error
 	attemptedModels := 0
 	availableModels := 0
+	client := clientFromContext(ctx)
 	
-	for _, m := range freeModels {
+	models := routingOrder()
+	for _, m := range models {
 		// Skip permanently failed models first
 		if permanentFailures.IsPermanentlyFailed(m) {
 			continue // Skip permanently failed models
 		}
 		
 		// Apply model filter if it exists
-		parts := strings.Split(m, "/")
-		displayName := parts[len(parts)-1]
-		if !isModelInFilter(displayName, modelFilter) {
+		if !currentModelFilter().Allows(m) || !policy.Allows(m) {
 			continue // Skip models not in filter
 		}
+		// Only fall back to models the client key is allowed to use
+		if !client.AllowsModel(m) {
+			continue
+		}
 		availableModels++
 
-		skip, err := failureStore.ShouldSkip(m)
+		skip, err := shouldSkipModel(ctx, m)
 		if err != nil {
 			slog.Debug("db error checking model", "error", err, "model", m)
 			// Continue trying even if DB check fails
@@ -993,19 +1385,32 @@ func getFreeStream(provider *OpenrouterProvider, msgs []openai.ChatCompletionMes
 			continue
 		}
 		
+		// Stop cycling through models once the daily/minute quota is used up
+		if err := keyPool.CheckQuota(); err != nil {
+			return nil, "", err
+		}
+
 		attemptedModels++
 		slog.Debug("attempting model", "model", m, "attempt", attemptedModels)
 		
+		attemptCtx, span := startAttemptSpan(ctx, m, attemptedModels)
+
 		// Apply rate limiting
 		limiter := globalRateLimiter.GetLimiter(m)
-		limiter.Wait()
-		globalRateLimiter.WaitGlobal()
+		waitRateLimits(attemptCtx, limiter)
 		
-		stream, err := provider.ChatStream(msgs, m)
+		stream, err := provider.ChatStream(attemptCtx, msgs, m)
+		endSpan(span, err)
 		if err != nil {
 			lastError = err
 			limiter.RecordFailure(err)
 			
+			// Every key is out of quota, or the cassette has no response:
+			// every other free model would fail too
+			if endsRouting(err) {
+				return nil, "", err
+			}
+
 			// Check if this is a permanent failure (404, model not found)
 			if isPermanentError(err) {
 				permanentFailures.MarkPermanentFailure(m)
@@ -1013,12 +1418,12 @@ func getFreeStream(provider *OpenrouterProvider, msgs []openai.ChatCompletionMes
 			} else if isRateLimitError(err) {
 				slog.Warn("rate limit hit, backing off", "model", m, "error", err)
 				// Mark failure but with shorter cooldown for rate limits
-				_ = failureStore.MarkFailureWithType(m, "rate_limit")
+				_ = failureStore.MarkFailureWithError(m, "rate_limit", err)
 				// Add small delay before trying next model
 				time.Sleep(500 * time.Millisecond)
 			} else {
-				slog.Warn("model failed, trying next", "model", m, "error", err, "remaining", len(freeModels)-attemptedModels)
-				_ = failureStore.MarkFailure(m)
+				slog.Warn("model failed, trying next", "model", m, "error", err, "remaining", len(models)-attemptedModels)
+				_ = failureStore.MarkFailureWithError(m, "general", err)
 			}
 			continue
 		}
@@ -1040,83 +1445,84 @@ func getFreeStream(provider *OpenrouterProvider, msgs []openai.ChatCompletionMes
 	return nil, "", fmt.Errorf("no free models available (all %d models in cooldown)", availableModels)
 }
 
-// resolveDisplayNameToFullModel resolves a display name back to the full model name
-func resolveDisplayNameToFullModel(displayName string) string {
-	for _, fullModel := range freeModels {
-		parts := strings.Split(fullModel, "/")
-		modelDisplayName := parts[len(parts)-1]
-		if modelDisplayName == displayName {
-			// Apply model filter if it exists
-			if !isModelInFilter(displayName, modelFilter) {
-				continue // Skip models not in filter
-			}
-			return fullModel
-		}
-	}
-	return displayName // fallback to original name if not found
-}
-
-// getFreeChatForModel tries to use a specific model first, then falls back to any available free model
-func getFreeChatForModel(provider *OpenrouterProvider, msgs []openai.ChatCompletionMessage, requestedModel string) (openai.ChatCompletionResponse, string, error) {
+// getFreeChatForModel routes a request for a model in free mode, falling back
+// as configured; see routeFreeRequest
+func getFreeChatForModel(ctx context.Context, provider *OpenrouterProvider, msgs []openai.ChatCompletionMessage, requestedModel string) (openai.ChatCompletionResponse, string, error) {
 	var resp openai.ChatCompletionResponse
-	var triedRequestedModel bool
-
-	// First try the requested model if it's in our free models list
-	fullModelName := resolveDisplayNameToFullModel(requestedModel)
-	if fullModelName != requestedModel || contains(freeModels, fullModelName) {
-		skip, err := failureStore.ShouldSkip(fullModelName)
-		if err == nil && !skip {
-			triedRequestedModel = true
-			slog.Debug("trying requested model first", "model", fullModelName)
-			resp, err = provider.Chat(msgs, fullModelName)
-			if err == nil {
-				_ = failureStore.ClearFailure(fullModelName)
-				slog.Info("successfully used requested model", "model", fullModelName)
-				return resp, fullModelName, nil
-			}
-			slog.Warn("requested model failed, will try fallbacks", "model", fullModelName, "error", err)
-			_ = failureStore.MarkFailure(fullModelName)
-		} else if skip {
-			slog.Debug("requested model is in cooldown", "model", fullModelName)
-		}
-	}
+	model, err := routeFreeRequest(ctx, requestedModel,
+		func(ctx context.Context, model string) error {
+			var err error
+			resp, err = provider.Chat(ctx, msgs, model)
+			return err
+		},
+		func(policy *ModelFilter) (string, error) {
+			var model string
+			var err error
+			resp, model, err = getFreeChat(ctx, provider, msgs, policy)
+			return model, err
+		})
+	return resp, model, err
+}
 
-	// Fallback to any available free model, but skip the one we just tried
-	if triedRequestedModel {
-		slog.Info("falling back to other free models", "skipping", fullModelName)
+// getFreeStreamForModel is the streaming variant of getFreeChatForModel
+func getFreeStreamForModel(ctx context.Context, provider *OpenrouterProvider, msgs []openai.ChatCompletionMessage, requestedModel string) (*ChatStream, string, error) {
+	var stream *ChatStream
+	model, err := routeFreeRequest(ctx, requestedModel,
+		func(ctx context.Context, model string) error {
+			var err error
+			stream, err = provider.ChatStream(ctx, msgs, model)
+			return err
+		},
+		func(policy *ModelFilter) (string, error) {
+			var model string
+			var err error
+			stream, model, err = getFreeStream(ctx, provider, msgs, policy)
+			return model, err
+		})
+	if err != nil {
+		return nil, "", err
 	}
-	return getFreeChat(provider, msgs)
+	return stream, model, nil
 }
 
-// getFreeStreamForModel tries to use a specific model first, then falls back to any available free model
-func getFreeStreamForModel(provider *OpenrouterProvider, msgs []openai.ChatCompletionMessage, requestedModel string) (*openai.ChatCompletionStream, string, error) {
-	var triedRequestedModel bool
-	
-	// First try the requested model if it's in our free models list
-	fullModelName := resolveDisplayNameToFullModel(requestedModel)
-	if fullModelName != requestedModel || contains(freeModels, fullModelName) {
-		skip, err := failureStore.ShouldSkip(fullModelName)
-		if err == nil && !skip {
-			triedRequestedModel = true
-			slog.Debug("trying requested model first", "model", fullModelName)
-			stream, err := provider.ChatStream(msgs, fullModelName)
-			if err == nil {
-				_ = failureStore.ClearFailure(fullModelName)
-				slog.Info("successfully used requested model", "model", fullModelName)
-				return stream, fullModelName, nil
-			}
-			slog.Warn("requested model failed, will try fallbacks", "model", fullModelName, "error", err)
-			_ = failureStore.MarkFailure(fullModelName)
-		} else if skip {
-			slog.Debug("requested model is in cooldown", "model", fullModelName)
+// resolveModelTargets resolves the requested model, or each target of an alias,
+// to full OpenRouter IDs for paid mode
+func resolveModelTargets(provider *OpenrouterProvider, requestedModel string) ([]string, error) {
+	var models []string
+	for _, requested := range requestedModels(requestedModel) {
+		fullModelName, err := provider.GetFullModelName(requested)
+		if err != nil {
+			return nil, err
 		}
+		models = append(models, fullModelName)
 	}
+	return models, nil
+}
 
-	// Fallback to any available free model, but skip the one we just tried
-	if triedRequestedModel {
-		slog.Info("falling back to other free models", "skipping", fullModelName)
+// getChatForModels tries the targets of the requested model in order, then its
+// fallback chain, and returns the first response
+func getChatForModels(ctx context.Context, provider *OpenrouterProvider, msgs []openai.ChatCompletionMessage, requestedModel string, models []string) (openai.ChatCompletionResponse, string, error) {
+	var resp openai.ChatCompletionResponse
+	model, err := routePaidRequest(ctx, provider, requestedModel, models, func(ctx context.Context, model string) error {
+		var err error
+		resp, err = provider.Chat(ctx, msgs, model)
+		return err
+	})
+	return resp, model, err
+}
+
+// getStreamForModels is the streaming variant of getChatForModels
+func getStreamForModels(ctx context.Context, provider *OpenrouterProvider, msgs []openai.ChatCompletionMessage, requestedModel string, models []string) (*ChatStream, string, error) {
+	var stream *ChatStream
+	model, err := routePaidRequest(ctx, provider, requestedModel, models, func(ctx context.Context, model string) error {
+		var err error
+		stream, err = provider.ChatStream(ctx, msgs, model)
+		return err
+	})
+	if err != nil {
+		return nil, "", err
 	}
-	return getFreeStream(provider, msgs)
+	return stream, model, nil
 }
 
 // contains checks if a slice contains a string
@@ -1128,17 +1534,3 @@ func contains(slice []string, item string) bool {
 	}
 	return false
 }
-
-// isModelInFilter checks if a model name matches any filter pattern (supports partial matches)
-func isModelInFilter(modelName string, filter map[string]struct{}) bool {
-	if len(filter) == 0 {
-		return true // No filter means all models are allowed
-	}
-	
-	for filterPattern := range filter {
-		if strings.Contains(modelName, filterPattern) {
-			return true
-		}
-	}
-	return false
-}
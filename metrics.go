@@ -0,0 +1,271 @@
+package main
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/sashabaranov/go-openai"
+)
+
+var (
+	httpRequestsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "proxy_http_requests_total",
+		Help: "HTTP requests handled by the proxy, by endpoint, method and status.",
+	}, []string{"endpoint", "method", "status"})
+
+	httpRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "proxy_http_request_duration_seconds",
+		Help:    "Latency of HTTP requests, by endpoint.",
+		Buckets: []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 120},
+	}, []string{"endpoint"})
+
+	chatRequestsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "proxy_chat_requests_total",
+		Help: "Chat requests by endpoint, requested model, model that served them and status.",
+	}, []string{"endpoint", "requested_model", "model", "status"})
+
+	chatTTFT = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "proxy_chat_ttft_seconds",
+		Help:    "Time to first token of chat requests, by endpoint and model.",
+		Buckets: []float64{0.1, 0.25, 0.5, 1, 2, 4, 8, 15, 30, 60},
+	}, []string{"endpoint", "model"})
+
+	chatTokensTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "proxy_chat_tokens_total",
+		Help: "Tokens processed, by model and type (prompt or completion).",
+	}, []string{"model", "type"})
+
+	chatCostTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "proxy_chat_cost_usd_total",
+		Help: "Cost in USD of chat requests from catalog pricing, by model.",
+	}, []string{"model"})
+
+	responseCacheTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "proxy_response_cache_total",
+		Help: "Chat requests looked up in the response cache, by result (hit, miss or bypass).",
+	}, []string{"result"})
+
+	coalescedRequestsTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "proxy_coalesced_requests_total",
+		Help: "Chat requests answered by an identical request already in flight.",
+	})
+
+	chatAttempts = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "proxy_chat_attempts",
+		Help:    "Upstream model attempts needed per chat request, including fallbacks.",
+		Buckets: []float64{1, 2, 3, 5, 8, 13, 21},
+	}, []string{"endpoint"})
+
+	upstreamAttemptsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "proxy_upstream_attempts_total",
+		Help: "Upstream chat attempts by model and outcome (ok or error category).",
+	}, []string{"model", "outcome"})
+
+	rateLimiterWait = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "proxy_rate_limiter_wait_seconds",
+		Help:    "Time spent sleeping in the rate limiters, by scope (model or global).",
+		Buckets: []float64{0.001, 0.01, 0.05, 0.1, 0.5, 1, 2.5, 5, 10},
+	}, []string{"scope"})
+
+	activeStreams = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "proxy_active_streams",
+		Help: "Streaming responses currently being sent, by endpoint.",
+	}, []string{"endpoint"})
+)
+
+// Free model states reported by proxy_free_model_state
+var freeModelStates = []string{"available", "cooldown", "circuit_open", "permanent_failure", "disabled"}
+
+// freeModelCollector reports the health of every free model at scrape time
+type freeModelCollector struct {
+	state     *prometheus.Desc
+	available *prometheus.Desc
+	keys      *prometheus.Desc
+}
+
+func newFreeModelCollector() *freeModelCollector {
+	return &freeModelCollector{
+		state: prometheus.NewDesc("proxy_free_model_state",
+			"Current state of each free model (1 for the active state).", []string{"model", "state"}, nil),
+		available: prometheus.NewDesc("proxy_free_models_available",
+			"Free models that pass the filter and are not in cooldown or permanently failed.", nil, nil),
+		keys: prometheus.NewDesc("proxy_api_keys",
+			"OpenRouter API keys in the pool, by state.", []string{"state"}, nil),
+	}
+}
+
+func (f *freeModelCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- f.state
+	ch <- f.available
+	ch <- f.keys
+}
+
+func (f *freeModelCollector) Collect(ch chan<- prometheus.Metric) {
+	if keyPool != nil {
+		counts := map[string]int{"active": 0, "cooldown": 0, "disabled": 0}
+		for _, st := range keyPool.Status() {
+			switch {
+			case st.Disabled:
+				counts["disabled"]++
+			case st.Cooldown > 0:
+				counts["cooldown"]++
+			default:
+				counts["active"]++
+			}
+		}
+		for state, n := range counts {
+			ch <- prometheus.MustNewConstMetric(f.keys, prometheus.GaugeValue, float64(n), state)
+		}
+	}
+
+	if !freeMode || failureStore == nil {
+		return
+	}
+	available := 0
+	for _, m := range currentFreeModels() {
+		if !currentModelFilter().Allows(m) {
+			continue
+		}
+		state := freeModelState(m)
+		if state == "available" {
+			available++
+		}
+		for _, s := range freeModelStates {
+			value := 0.0
+			if s == state {
+				value = 1
+			}
+			ch <- prometheus.MustNewConstMetric(f.state, prometheus.GaugeValue, value, m, s)
+		}
+	}
+	ch <- prometheus.MustNewConstMetric(f.available, prometheus.GaugeValue, float64(available))
+}
+
+// freeModelState returns the routing state of a free model
+func freeModelState(model string) string {
+	if modelOverrides.IsDisabled(model) {
+		return "disabled"
+	}
+	if permanentFailures.IsPermanentlyFailed(model) {
+		return "permanent_failure"
+	}
+	if skip, err := failureStore.ShouldSkip(model); err == nil && skip {
+		return "cooldown"
+	}
+	if globalRateLimiter.BackoffRemaining(model) > 0 {
+		return "circuit_open"
+	}
+	return "available"
+}
+
+func init() {
+	prometheus.MustRegister(newFreeModelCollector())
+}
+
+// observeUpstreamAttempt counts one upstream attempt for a model
+func observeUpstreamAttempt(model string, err error) {
+	outcome := "ok"
+	if err != nil {
+		outcome = errorCategory(err)
+	}
+	upstreamAttemptsTotal.WithLabelValues(catalogModelLabel(model), outcome).Inc()
+}
+
+// otherModelLabel stands for model names outside the catalog, so clients
+// cannot create label values at will
+const otherModelLabel = "other"
+
+// catalogModelLabel returns a model ID as a metric label if it is in the catalog
+func catalogModelLabel(id string) string {
+	if id == "" {
+		return ""
+	}
+	if _, ok := modelCatalog.Lookup(id); ok {
+		return id
+	}
+	return otherModelLabel
+}
+
+// requestedModelLabel returns a requested name as a metric label: aliases and
+// virtual models as requested, other names as the catalog model they resolve to
+func requestedModelLabel(name string) string {
+	if name == "" {
+		return ""
+	}
+	if _, ok := lookupAlias(name); ok {
+		return name
+	}
+	if _, ok := lookupVirtualModel(name); ok {
+		return name
+	}
+	if modelCatalog == nil {
+		return otherModelLabel
+	}
+	id, err := modelCatalog.Resolve(name)
+	if err != nil {
+		return otherModelLabel
+	}
+	return catalogModelLabel(id)
+}
+
+// observeRateLimitWait records time slept in a rate limiter
+func observeRateLimitWait(scope string, d time.Duration) {
+	rateLimiterWait.WithLabelValues(scope).Observe(d.Seconds())
+}
+
+// trackStream counts an active stream until the returned func is called
+func trackStream(c *gin.Context) func() {
+	gauge := activeStreams.WithLabelValues(c.FullPath())
+	gauge.Inc()
+	return gauge.Dec
+}
+
+// metricsMiddleware records per-endpoint request metrics, and for chat requests
+// the per-model details collected on the request record
+func metricsMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		c.Next()
+
+		endpoint := c.FullPath()
+		if endpoint == "" {
+			endpoint = "unmatched"
+		}
+		status := strconv.Itoa(c.Writer.Status())
+		httpRequestsTotal.WithLabelValues(endpoint, c.Request.Method, status).Inc()
+		httpRequestDuration.WithLabelValues(endpoint).Observe(time.Since(start).Seconds())
+
+		rec := requestRecordFromContext(c.Request.Context())
+		if rec == nil {
+			return
+		}
+		rec.mu.Lock()
+		requested, resolved, attempts, firstToken := rec.RequestedModel, rec.ResolvedModel, rec.Attempts, rec.firstToken
+		rec.mu.Unlock()
+
+		chatRequestsTotal.WithLabelValues(endpoint, requestedModelLabel(requested), resolved, status).Inc()
+		if attempts > 0 {
+			chatAttempts.WithLabelValues(endpoint).Observe(float64(attempts))
+		}
+		if resolved == "" {
+			return
+		}
+		ttft := time.Since(start)
+		if !firstToken.IsZero() {
+			ttft = firstToken.Sub(start)
+		}
+		chatTTFT.WithLabelValues(endpoint, resolved).Observe(ttft.Seconds())
+		if value, ok := c.Get("usage"); ok {
+			if usage, ok := value.(openai.Usage); ok {
+				chatTokensTotal.WithLabelValues(resolved, "prompt").Add(float64(usage.PromptTokens))
+				chatTokensTotal.WithLabelValues(resolved, "completion").Add(float64(usage.CompletionTokens))
+			}
+		}
+		if cost := c.GetFloat64("cost"); cost > 0 {
+			chatCostTotal.WithLabelValues(resolved).Add(cost)
+		}
+	}
+}
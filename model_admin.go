@@ -0,0 +1,201 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ModelHealth is the routing state of a free model as shown by the admin API
+type ModelHealth struct {
+	Model          string         `json:"model"`
+	DisplayName    string         `json:"display_name"`
+	State          string         `json:"state"`
+	InFilter       bool           `json:"in_filter"`
+	Override       *ModelOverride `json:"override,omitempty"`
+	PermanentSince *time.Time     `json:"permanent_failure_since,omitempty"`
+	CircuitOpenFor float64        `json:"circuit_open_seconds,omitempty"`
+	FailureType    string         `json:"failure_type,omitempty"`
+	FailureCount   int            `json:"failure_count"`
+	LastFailureAt  *time.Time     `json:"last_failure_at,omitempty"`
+	LastError      string         `json:"last_error,omitempty"`
+	CooldownUntil  *time.Time     `json:"cooldown_until,omitempty"`
+}
+
+// modelHealth collects the state of every free model, in routing order
+func modelHealth() ([]ModelHealth, error) {
+	failures, err := failureStore.ListFailures()
+	if err != nil {
+		return nil, err
+	}
+
+	var list []ModelHealth
+	for _, m := range currentFreeModels() {
+		parts := strings.Split(m, "/")
+		h := ModelHealth{
+			Model:       m,
+			DisplayName: parts[len(parts)-1],
+			State:       freeModelState(m),
+		}
+		h.InFilter = currentModelFilter().Allows(m)
+		if o, ok := modelOverrides.Get(m); ok {
+			h.Override = &o
+		}
+		if since, ok := permanentFailures.PermanentlyFailedSince(m); ok {
+			h.PermanentSince = &since
+		}
+		h.CircuitOpenFor = globalRateLimiter.BackoffRemaining(m).Seconds()
+		if f, ok := failures[m]; ok {
+			h.FailureType = f.FailureType
+			h.FailureCount = f.FailureCount
+			h.LastFailureAt = &f.FailedAt
+			h.LastError = f.LastError
+			h.CooldownUntil = f.CooldownUntil
+		}
+		list = append(list, h)
+	}
+	// Pinned models first, like the router tries them
+	sort.SliceStable(list, func(i, j int) bool {
+		return isPinned(list[i].Override) && !isPinned(list[j].Override)
+	})
+	return list, nil
+}
+
+func isPinned(o *ModelOverride) bool {
+	return o != nil && o.State == OverridePinned
+}
+
+// resolveAdminModel accepts a full model ID or a display name. Unknown names
+// are used as is so that models which left the catalog can be managed.
+func resolveAdminModel(name string) (string, error) {
+	model, err := resolveModelName(name, currentFreeModels())
+	var notFound *ModelNotFoundError
+	if errors.As(err, &notFound) {
+		return name, nil
+	}
+	return model, err
+}
+
+// registerModelAdminRoutes adds the free model health and management endpoints.
+// Models are passed as ?model= since their IDs contain slashes.
+func registerModelAdminRoutes(admin *gin.RouterGroup, filterPath string) {
+	admin.GET("/models", func(c *gin.Context) {
+		models, err := modelHealth()
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"models": models})
+	})
+
+	// Clears cooldowns, permanent failures and open circuits of one model, or
+	// of every model when no model is given
+	admin.DELETE("/failures", func(c *gin.Context) {
+		if name := c.Query("model"); name != "" {
+			model, err := resolveAdminModel(name)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+			if err := failureStore.ResetFailure(model); err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+			permanentFailures.Clear(model)
+			globalRateLimiter.Reset(model)
+			slog.Info("failures cleared by admin", "model", model)
+			c.Status(http.StatusNoContent)
+			return
+		}
+		if err := failureStore.ResetAllFailures(); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		permanentFailures.ClearAll()
+		globalRateLimiter.ResetAll()
+		slog.Info("all model failures cleared by admin")
+		c.Status(http.StatusNoContent)
+	})
+
+	admin.GET("/overrides", func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{"overrides": modelOverrides.List()})
+	})
+
+	admin.PUT("/overrides", func(c *gin.Context) {
+		var req struct {
+			Model  string `json:"model" binding:"required"`
+			State  string `json:"state" binding:"required"`
+			Reason string `json:"reason"`
+		}
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid JSON payload: " + err.Error()})
+			return
+		}
+		model, err := resolveAdminModel(req.Model)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		o, err := modelOverrides.Set(model, req.State, req.Reason)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		slog.Info("model override set by admin", "model", o.Model, "state", o.State)
+		c.JSON(http.StatusOK, o)
+	})
+
+	admin.DELETE("/overrides", func(c *gin.Context) {
+		name := c.Query("model")
+		if name == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "model is required"})
+			return
+		}
+		model, err := resolveAdminModel(name)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if err := modelOverrides.Remove(model); err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				c.JSON(http.StatusNotFound, gin.H{"error": "no override for " + model})
+				return
+			}
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		slog.Info("model override removed by admin", "model", model)
+		c.Status(http.StatusNoContent)
+	})
+
+	admin.POST("/models/refresh", func(c *gin.Context) {
+		if _, err := modelCatalog.Refresh(); err != nil {
+			c.JSON(http.StatusBadGateway, gin.H{"error": "failed to refresh free models: " + err.Error()})
+			return
+		}
+		models := currentFreeModels()
+		slog.Info("free models refreshed by admin", "models", len(models))
+		c.JSON(http.StatusOK, gin.H{"models": models})
+	})
+
+	admin.GET("/filter", func(c *gin.Context) {
+		matching := make([]string, 0)
+		for _, m := range currentFreeModels() {
+			if currentModelFilter().Allows(m) {
+				matching = append(matching, m)
+			}
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"path":     filterPath,
+			"active":   currentModelFilter().Len() > 0,
+			"patterns": currentModelFilter().Rules(),
+			"matching": matching,
+		})
+	})
+}
@@ -0,0 +1,305 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// ModelFilter decides which models are listed and routed to, with the same
+// semantics in free and paid mode. Each line of the filter file is one rule:
+//
+//	gemini              substring of the display name or full ID
+//	gemini-2.*-flash*   glob, matching the whole display name or full ID
+//	/^llama-3\.[13]/    regular expression
+//	vendor:google       match one field only: id, name (display name) or vendor
+//	!preview            exclude models matching a rule
+//	has:tools           capability predicate: has:tools, has:vision, has:reasoning
+//	is:free             models costing nothing
+//	context>=32000      context length predicate (>=, >, <=, <, =)
+//
+// A model is allowed when it matches at least one name rule (or there are
+// none), satisfies every predicate and matches no exclusion. Blank lines and
+// lines starting with # are ignored.
+type ModelFilter struct {
+	include    []filterRule
+	predicates []filterRule
+	exclude    []filterRule
+	source     []string
+}
+
+type filterRule struct {
+	source string
+	match  func(m ModelRecord) bool
+}
+
+// modelFilter is the active filter. It is swapped as a whole when the filter
+// file is reloaded, so readers always see one consistent version.
+var modelFilter atomic.Pointer[ModelFilter]
+
+// currentModelFilter returns the active filter; nil allows every model
+func currentModelFilter() *ModelFilter {
+	return modelFilter.Load()
+}
+
+// reloadModelFilter parses the filter file and swaps it in if it is valid. A
+// missing file means no filter, as at startup.
+func reloadModelFilter(path string) error {
+	f, err := loadModelFilter(path)
+	if os.IsNotExist(err) {
+		f = &ModelFilter{}
+	} else if err != nil {
+		return err
+	}
+	modelFilter.Store(f)
+	return nil
+}
+
+var contextPredicate = regexp.MustCompile(`^context\s*(>=|<=|>|<|=)\s*(\d+)$`)
+
+// loadModelFilter reads a filter file
+func loadModelFilter(path string) (*ModelFilter, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return parseModelFilter(file)
+}
+
+// parseModelFilter parses filter rules, one per line
+func parseModelFilter(r io.Reader) (*ModelFilter, error) {
+	f := &ModelFilter{}
+	scanner := bufio.NewScanner(r)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if err := f.add(line); err != nil {
+			return nil, fmt.Errorf("line %d: %w", lineNo, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *ModelFilter) add(line string) error {
+	f.source = append(f.source, line)
+
+	exclude := strings.HasPrefix(line, "!")
+	expr := strings.TrimSpace(strings.TrimPrefix(line, "!"))
+	if expr == "" {
+		return fmt.Errorf("empty exclusion")
+	}
+
+	rule := filterRule{source: line}
+	predicate := true
+	switch {
+	case expr == "has:tools":
+		rule.match = func(m ModelRecord) bool { return supportsToolUse(m.SupportedParameters) }
+	case expr == "has:vision":
+		rule.match = func(m ModelRecord) bool { return contains(m.InputModalities, "image") }
+	case expr == "has:reasoning":
+		rule.match = func(m ModelRecord) bool { return contains(m.SupportedParameters, "reasoning") }
+	case expr == "is:free":
+		rule.match = ModelRecord.IsFree
+	case strings.HasPrefix(expr, "has:") || strings.HasPrefix(expr, "is:"):
+		return fmt.Errorf("unknown predicate %q", expr)
+	case contextPredicate.MatchString(expr):
+		parts := contextPredicate.FindStringSubmatch(expr)
+		op := parts[1]
+		limit, err := strconv.Atoi(parts[2])
+		if err != nil {
+			return fmt.Errorf("invalid context length %q", parts[2])
+		}
+		rule.match = func(m ModelRecord) bool { return compareInt(m.ContextLength, op, limit) }
+	default:
+		predicate = false
+		match, err := compileNameRule(expr)
+		if err != nil {
+			return err
+		}
+		rule.match = match
+	}
+
+	switch {
+	case exclude:
+		f.exclude = append(f.exclude, rule)
+	case predicate:
+		f.predicates = append(f.predicates, rule)
+	default:
+		f.include = append(f.include, rule)
+	}
+	return nil
+}
+
+// compileNameRule builds the matcher of a text rule with an optional field prefix
+func compileNameRule(expr string) (func(m ModelRecord) bool, error) {
+	fields := []func(id string) string{modelDisplayName, func(id string) string { return id }}
+	for prefix, field := range map[string]func(id string) string{
+		"id:":     func(id string) string { return id },
+		"name:":   modelDisplayName,
+		"vendor:": modelVendor,
+	} {
+		if strings.HasPrefix(expr, prefix) {
+			fields = []func(id string) string{field}
+			expr = strings.TrimPrefix(expr, prefix)
+			break
+		}
+	}
+	if expr == "" {
+		return nil, fmt.Errorf("empty pattern")
+	}
+
+	var match func(s string) bool
+	switch {
+	case len(expr) > 2 && strings.HasPrefix(expr, "/") && strings.HasSuffix(expr, "/"):
+		re, err := regexp.Compile(expr[1 : len(expr)-1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid regular expression %q: %w", expr, err)
+		}
+		match = re.MatchString
+	case strings.ContainsAny(expr, "*?["):
+		re, err := globToRegexp(expr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid glob %q: %w", expr, err)
+		}
+		match = re.MatchString
+	default:
+		pattern := expr
+		match = func(s string) bool { return strings.Contains(s, pattern) }
+	}
+
+	return func(m ModelRecord) bool {
+		for _, field := range fields {
+			if match(field(m.ID)) {
+				return true
+			}
+		}
+		return false
+	}, nil
+}
+
+// globToRegexp converts a glob where * and ? also match slashes
+func globToRegexp(glob string) (*regexp.Regexp, error) {
+	var b strings.Builder
+	b.WriteString("^")
+	for i := 0; i < len(glob); i++ {
+		switch c := glob[i]; c {
+		case '*':
+			b.WriteString(".*")
+		case '?':
+			b.WriteString(".")
+		case '[':
+			end := strings.IndexByte(glob[i:], ']')
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated character class")
+			}
+			class := glob[i : i+end+1]
+			// Globs negate a class with [!...], regular expressions with [^...]
+			if strings.HasPrefix(class, "[!") {
+				class = "[^" + class[2:]
+			}
+			b.WriteString(class)
+			i += end
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	b.WriteString("$")
+	return regexp.Compile(b.String())
+}
+
+func compareInt(value int, op string, limit int) bool {
+	switch op {
+	case ">=":
+		return value >= limit
+	case ">":
+		return value > limit
+	case "<=":
+		return value <= limit
+	case "<":
+		return value < limit
+	default:
+		return value == limit
+	}
+}
+
+// modelDisplayName returns the part of a model ID after the vendor
+func modelDisplayName(id string) string {
+	parts := strings.Split(id, "/")
+	return parts[len(parts)-1]
+}
+
+// modelVendor returns the vendor part of a model ID, e.g. "google"
+func modelVendor(id string) string {
+	if i := strings.Index(id, "/"); i >= 0 {
+		return id[:i]
+	}
+	return ""
+}
+
+// Len returns the number of rules; an empty filter allows every model
+func (f *ModelFilter) Len() int {
+	if f == nil {
+		return 0
+	}
+	return len(f.source)
+}
+
+// Rules returns the filter lines as written
+func (f *ModelFilter) Rules() []string {
+	if f == nil {
+		return nil
+	}
+	return f.source
+}
+
+// Allows reports whether the model with the given full ID passes the filter.
+// Capability predicates use the catalog metadata of the model.
+func (f *ModelFilter) Allows(id string) bool {
+	if f.Len() == 0 {
+		return true // No filter means all models are allowed
+	}
+	record, ok := modelCatalog.Lookup(id)
+	if !ok {
+		record = ModelRecord{ID: id}
+	}
+	return f.AllowsRecord(record)
+}
+
+// AllowsRecord reports whether a catalog model passes the filter
+func (f *ModelFilter) AllowsRecord(m ModelRecord) bool {
+	if f.Len() == 0 {
+		return true
+	}
+	for _, rule := range f.exclude {
+		if rule.match(m) {
+			return false
+		}
+	}
+	for _, rule := range f.predicates {
+		if !rule.match(m) {
+			return false
+		}
+	}
+	if len(f.include) == 0 {
+		return true
+	}
+	for _, rule := range f.include {
+		if rule.match(m) {
+			return true
+		}
+	}
+	return false
+}
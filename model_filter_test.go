@@ -0,0 +1,79 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseModelFilter(t *testing.T) {
+	flash := ModelRecord{ID: "google/gemini-2.0-flash-exp:free", ContextLength: 1000000, Pricing: ModelPricing{Prompt: "0", Completion: "0"},
+		SupportedParameters: []string{"tools"}, InputModalities: []string{"text", "image"}}
+	llama := ModelRecord{ID: "meta-llama/llama-3.1-8b-instruct:free", ContextLength: 8192, Pricing: ModelPricing{Prompt: "0", Completion: "0"}}
+	gpt := ModelRecord{ID: "openai/gpt-4o", ContextLength: 128000, Pricing: ModelPricing{Prompt: "0.0000025", Completion: "0.00001"},
+		SupportedParameters: []string{"tools", "reasoning"}}
+	freeform := ModelRecord{ID: "acme/freeform-7b", ContextLength: 4096, Pricing: ModelPricing{Prompt: "0.000001", Completion: "0.000001"}}
+	models := []ModelRecord{flash, llama, gpt, freeform}
+
+	tests := []struct {
+		name  string
+		rules string
+		want  []string
+	}{
+		{name: "empty", rules: "", want: []string{flash.ID, llama.ID, gpt.ID, freeform.ID}},
+		{name: "comments and blank lines", rules: "# gemini\n\nllama", want: []string{llama.ID}},
+		{name: "substring", rules: "gemini", want: []string{flash.ID}},
+		{name: "bare word is a substring", rules: "free", want: []string{flash.ID, llama.ID, freeform.ID}},
+		{name: "bare tools is a substring", rules: "tools", want: nil},
+		{name: "is:free", rules: "is:free", want: []string{flash.ID, llama.ID}},
+		{name: "has:tools", rules: "has:tools", want: []string{flash.ID, gpt.ID}},
+		{name: "has:vision", rules: "has:vision", want: []string{flash.ID}},
+		{name: "has:reasoning", rules: "has:reasoning", want: []string{gpt.ID}},
+		{name: "glob", rules: "gemini-2.*-flash*", want: []string{flash.ID}},
+		{name: "glob class", rules: "gpt-[0-9]o", want: []string{gpt.ID}},
+		{name: "negated glob class", rules: "id:[!o]*", want: []string{flash.ID, llama.ID, freeform.ID}},
+		{name: "regexp", rules: `/^llama-3\.[13]/`, want: []string{llama.ID}},
+		{name: "vendor", rules: "vendor:openai", want: []string{gpt.ID}},
+		{name: "exclusion", rules: "!preview\n!llama", want: []string{flash.ID, gpt.ID, freeform.ID}},
+		{name: "predicate exclusion", rules: "!is:free", want: []string{gpt.ID, freeform.ID}},
+		{name: "context", rules: "context>=100000", want: []string{flash.ID, gpt.ID}},
+		{name: "names and predicates", rules: "gemini\ngpt\nhas:tools\ncontext<500000", want: []string{gpt.ID}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, err := parseModelFilter(strings.NewReader(tt.rules))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, m := range models {
+				if f.AllowsRecord(m) {
+					got = append(got, m.ID)
+				}
+			}
+			if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+				t.Errorf("allowed %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseModelFilterErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		rules string
+		want  string
+	}{
+		{name: "empty exclusion", rules: "!", want: "line 1"},
+		{name: "unknown predicate", rules: "gemini\nhas:wings", want: "line 2"},
+		{name: "unterminated class", rules: "gpt-[0-9", want: "line 1"},
+		{name: "invalid regexp", rules: "/(/", want: "line 1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parseModelFilter(strings.NewReader(tt.rules))
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("error = %v, want one mentioning %q", err, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// Manual model overrides set through the admin API
+const (
+	OverrideDisabled = "disabled" // never routed to or listed
+	OverridePinned   = "pinned"   // tried before every other free model
+)
+
+// ModelOverride is a manual routing decision for one model
+type ModelOverride struct {
+	Model     string    `json:"model"`
+	State     string    `json:"state"`
+	Reason    string    `json:"reason,omitempty"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// ModelOverrideStore persists model overrides and keeps them in memory, since
+// they are consulted for every routed request
+type ModelOverrideStore struct {
+	db        *sql.DB
+	mu        sync.RWMutex
+	overrides map[string]ModelOverride
+}
+
+func NewModelOverrideStore(path string) (*ModelOverrideStore, error) {
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = db.Exec(`CREATE TABLE IF NOT EXISTS model_overrides (
+		model TEXT PRIMARY KEY,
+		state TEXT NOT NULL,
+		reason TEXT DEFAULT '',
+		updated_at INTEGER
+	)`); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	s := &ModelOverrideStore{db: db, overrides: make(map[string]ModelOverride)}
+	rows, err := db.Query(`SELECT model, state, reason, updated_at FROM model_overrides`)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var o ModelOverride
+		var ts int64
+		if err := rows.Scan(&o.Model, &o.State, &o.Reason, &ts); err != nil {
+			db.Close()
+			return nil, err
+		}
+		o.UpdatedAt = time.Unix(ts, 0).UTC()
+		s.overrides[o.Model] = o
+	}
+	if err := rows.Err(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *ModelOverrideStore) Close() error { return s.db.Close() }
+
+// Set disables or pins a model
+func (s *ModelOverrideStore) Set(model, state, reason string) (ModelOverride, error) {
+	if model == "" {
+		return ModelOverride{}, fmt.Errorf("model is required")
+	}
+	if state != OverrideDisabled && state != OverridePinned {
+		return ModelOverride{}, fmt.Errorf("state must be %q or %q", OverrideDisabled, OverridePinned)
+	}
+	o := ModelOverride{Model: model, State: state, Reason: reason, UpdatedAt: time.Now().UTC()}
+	if _, err := s.db.Exec(`
+		INSERT INTO model_overrides(model, state, reason, updated_at) VALUES(?, ?, ?, ?)
+		ON CONFLICT(model) DO UPDATE SET state=excluded.state, reason=excluded.reason, updated_at=excluded.updated_at
+	`, o.Model, o.State, o.Reason, o.UpdatedAt.Unix()); err != nil {
+		return ModelOverride{}, err
+	}
+
+	s.mu.Lock()
+	s.overrides[model] = o
+	s.mu.Unlock()
+	return o, nil
+}
+
+// Remove drops the override of a model
+func (s *ModelOverrideStore) Remove(model string) error {
+	res, err := s.db.Exec(`DELETE FROM model_overrides WHERE model=?`, model)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+
+	s.mu.Lock()
+	delete(s.overrides, model)
+	s.mu.Unlock()
+	return nil
+}
+
+// Get returns the override of a model, nil-safe
+func (s *ModelOverrideStore) Get(model string) (ModelOverride, bool) {
+	if s == nil {
+		return ModelOverride{}, false
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	o, ok := s.overrides[model]
+	return o, ok
+}
+
+// IsDisabled reports whether a model was disabled by an admin
+func (s *ModelOverrideStore) IsDisabled(model string) bool {
+	o, ok := s.Get(model)
+	return ok && o.State == OverrideDisabled
+}
+
+// List returns all overrides sorted by model
+func (s *ModelOverrideStore) List() []ModelOverride {
+	if s == nil {
+		return nil
+	}
+	s.mu.RLock()
+	list := make([]ModelOverride, 0, len(s.overrides))
+	for _, o := range s.overrides {
+		list = append(list, o)
+	}
+	s.mu.RUnlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].Model < list[j].Model })
+	return list
+}
+
+// routingOrder returns the free models to try, pinned models first and
+// disabled models removed
+func routingOrder() []string {
+	models := currentFreeModels()
+	pinned := make([]string, 0)
+	rest := make([]string, 0, len(models))
+	for _, m := range models {
+		o, ok := modelOverrides.Get(m)
+		switch {
+		case ok && o.State == OverrideDisabled:
+			continue
+		case ok && o.State == OverridePinned:
+			pinned = append(pinned, m)
+		default:
+			rest = append(rest, m)
+		}
+	}
+	return append(pinned, rest...)
+}
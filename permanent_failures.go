@@ -72,6 +72,30 @@ func (p *PermanentFailureTracker) ClearTemporaryFailure(model string) {
 	delete(p.temporaryFailed, model)
 }
 
+// PermanentlyFailedSince returns when a model was marked permanently failed
+func (p *PermanentFailureTracker) PermanentlyFailedSince(model string) (time.Time, bool) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	at, exists := p.permanentFailed[model]
+	return at, exists
+}
+
+// Clear forgets all failures of a model
+func (p *PermanentFailureTracker) Clear(model string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.permanentFailed, model)
+	delete(p.temporaryFailed, model)
+}
+
+// ClearAll forgets every recorded failure
+func (p *PermanentFailureTracker) ClearAll() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.permanentFailed = make(map[string]time.Time)
+	p.temporaryFailed = make(map[string]time.Time)
+}
+
 // GetStats returns statistics about failures
 func (p *PermanentFailureTracker) GetStats() (permanent int, temporary int) {
 	p.mu.RLock()
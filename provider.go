@@ -2,37 +2,118 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"io"
+	"log/slog"
 	"net/http"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/sashabaranov/go-openai"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type OpenrouterProvider struct {
-	client     *openai.Client
-	modelNames []string // Shared storage for model names
+	keys    *KeyPool
+	catalog *CatalogService // Shared model metadata, also used to resolve names
 }
 
-func NewOpenrouterProvider(apiKey string) *OpenrouterProvider {
+func newOpenrouterClient(apiKey string) *openai.Client {
 	config := openai.DefaultConfig(apiKey)
-	config.BaseURL = "https://openrouter.ai/api/v1/"
-	
-	// Add timeout configuration
-	if config.HTTPClient == nil {
-		config.HTTPClient = &http.Client{
-			Timeout: 30 * time.Second,
-		}
-	}
-	
+	config.BaseURL = upstreamURL("")
+	// Chat requests can carry OpenRouter fields the OpenAI request type lacks.
+	// Timeouts are set per call, as streams get a longer one.
+	config.HTTPClient = &http.Client{Transport: &extrasTransport{base: upstreamTransport}}
+	return openai.NewClientWithConfig(config)
+}
+
+// upstreamURL returns the OpenRouter API URL of path
+func upstreamURL(path string) string {
+	return strings.TrimSuffix(currentConfig().Upstream.BaseURL, "/") + "/" + path
+}
+
+func NewOpenrouterProvider(keys *KeyPool, catalog *CatalogService) *OpenrouterProvider {
 	return &OpenrouterProvider{
-		client:     openai.NewClientWithConfig(config),
-		modelNames: []string{},
+		keys:    keys,
+		catalog: catalog,
 	}
 }
 
-func (o *OpenrouterProvider) Chat(messages []openai.ChatCompletionMessage, modelName string) (openai.ChatCompletionResponse, error) {
+// ChatStream wraps an upstream stream so that closing it also releases its context
+type ChatStream struct {
+	*openai.ChatCompletionStream
+	cancel  context.CancelFunc
+	release func(err error) // returns the key to the pool
+	once    sync.Once
+	err     error // the error that ended the stream, if any
+}
+
+// Recv reads the next chunk, remembering an error that ended the stream early
+func (s *ChatStream) Recv() (openai.ChatCompletionStreamResponse, error) {
+	resp, err := s.ChatCompletionStream.Recv()
+	if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, context.Canceled) {
+		s.err = err
+	}
+	return resp, err
+}
+
+// Close ends the stream and returns its key, which counts as in flight until
+// then, along with the error that ended the stream
+func (s *ChatStream) Close() error {
+	defer s.once.Do(func() {
+		s.cancel()
+		s.release(s.err)
+	})
+	return s.ChatCompletionStream.Close()
+}
+
+// withKey runs call with a key from the pool, rotating to the next key when the
+// upstream rejects the current one (401/402/429). Metered calls count against
+// the key's free model quota. With hold, a successful call keeps the key and
+// must release it, e.g. when a stream is closed.
+func (o *OpenrouterProvider) withKey(metered, hold bool, call func(k *PoolKey) error) error {
+	tried := make(map[string]bool)
+	var lastErr error
+	for {
+		key, err := o.keys.Acquire(tried, metered)
+		if err != nil {
+			// Prefer a clear quota error over the last key's raw 429
+			if quotaErr := o.keys.CheckQuota(); quotaErr != nil {
+				return quotaErr
+			}
+			if lastErr != nil {
+				return lastErr
+			}
+			return err
+		}
+		tried[key.ID] = true
+
+		err = call(key)
+		if metered && key.quota != nil {
+			// Only requests OpenRouter answered count against the quota
+			if err == nil || apiStatusCode(err) != 0 {
+				if qerr := key.quota.Record(); qerr != nil {
+					slog.Debug("db error recording quota usage", "error", qerr)
+				}
+			} else {
+				key.quota.Cancel()
+			}
+		}
+		if err != nil || !hold {
+			o.keys.Release(key, err)
+		}
+		if err == nil || !isKeyError(err) {
+			return err
+		}
+		lastErr = err
+		slog.Warn("API key rejected request, trying next key", "key", key.ID, "error", err)
+	}
+}
+
+func (o *OpenrouterProvider) Chat(ctx context.Context, messages []openai.ChatCompletionMessage, modelName string) (openai.ChatCompletionResponse, error) {
 	// Validate inputs
 	if modelName == "" {
 		return openai.ChatCompletionResponse{}, fmt.Errorf("model name cannot be empty")
@@ -41,19 +122,34 @@ func (o *OpenrouterProvider) Chat(messages []openai.ChatCompletionMessage, model
 		return openai.ChatCompletionResponse{}, fmt.Errorf("messages cannot be empty")
 	}
 	
-	// Create a chat completion request with timeout
-	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
-	defer cancel()
-	
 	req := openai.ChatCompletionRequest{
 		Model:    modelName,
 		Messages: messages,
 		Stream:   false,
 	}
 
-	// Call the OpenAI API to get a complete response
-	resp, err := o.client.CreateChatCompletion(ctx, req)
+	ctx, span := tracer.Start(ctx, "openrouter.chat", trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attribute.String("proxy.model", modelName), attribute.Bool("proxy.stream", false)))
+	var resp openai.ChatCompletionResponse
+	err := o.withKey(true, false, func(k *PoolKey) error {
+		span.SetAttributes(attribute.String("proxy.api_key", k.ID))
+		// Create a chat completion request with timeout
+		ctx, cancel := context.WithTimeout(ctx, currentConfig().Timeouts.Request)
+		defer cancel()
+
+		// Call the OpenAI API to get a complete response
+		var err error
+		resp, err = k.client.CreateChatCompletion(ctx, req)
+		return err
+	})
+	recordAttempt(ctx, modelName, err)
+	observeUpstreamAttempt(modelName, err)
+	endSpan(span, err)
 	if err != nil {
+		var quotaErr *QuotaExceededError
+		if errors.As(err, &quotaErr) {
+			return openai.ChatCompletionResponse{}, err
+		}
 		return openai.ChatCompletionResponse{}, fmt.Errorf("chat completion failed: %w", err)
 	}
 
@@ -61,7 +157,7 @@ func (o *OpenrouterProvider) Chat(messages []openai.ChatCompletionMessage, model
 	return resp, nil
 }
 
-func (o *OpenrouterProvider) ChatStream(messages []openai.ChatCompletionMessage, modelName string) (*openai.ChatCompletionStream, error) {
+func (o *OpenrouterProvider) ChatStream(ctx context.Context, messages []openai.ChatCompletionMessage, modelName string) (*ChatStream, error) {
 	// Validate inputs
 	if modelName == "" {
 		return nil, fmt.Errorf("model name cannot be empty")
@@ -70,20 +166,40 @@ func (o *OpenrouterProvider) ChatStream(messages []openai.ChatCompletionMessage,
 		return nil, fmt.Errorf("messages cannot be empty")
 	}
 	
-	// Create a chat completion request with timeout
-	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
-	// Note: Don't defer cancel here as the stream needs the context to remain valid
-	
 	req := openai.ChatCompletionRequest{
 		Model:    modelName,
 		Messages: messages,
 		Stream:   true,
+		// Ask for a final usage chunk so streamed requests can be accounted
+		StreamOptions: &openai.StreamOptions{IncludeUsage: true},
 	}
 
-	// Call the OpenAI API to get a streaming response
-	stream, err := o.client.CreateChatCompletionStream(ctx, req)
+	ctx, span := tracer.Start(ctx, "openrouter.chat", trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attribute.String("proxy.model", modelName), attribute.Bool("proxy.stream", true)))
+	var stream *ChatStream
+	err := o.withKey(true, true, func(k *PoolKey) error {
+		span.SetAttributes(attribute.String("proxy.api_key", k.ID))
+		// Create a chat completion request with timeout. The context must stay
+		// valid while the stream is read, so it is released by ChatStream.Close.
+		ctx, cancel := context.WithTimeout(ctx, currentConfig().Timeouts.Stream)
+
+		// Call the OpenAI API to get a streaming response
+		s, err := k.client.CreateChatCompletionStream(ctx, req)
+		if err != nil {
+			cancel()
+			return err
+		}
+		stream = &ChatStream{ChatCompletionStream: s, cancel: cancel, release: func(err error) { o.keys.Release(k, err) }}
+		return nil
+	})
+	recordAttempt(ctx, modelName, err)
+	observeUpstreamAttempt(modelName, err)
+	endSpan(span, err)
 	if err != nil {
-		cancel()
+		var quotaErr *QuotaExceededError
+		if errors.As(err, &quotaErr) {
+			return nil, err
+		}
 		return nil, fmt.Errorf("stream creation failed: %w", err)
 	}
 
@@ -101,6 +217,7 @@ type ModelDetails struct {
 }
 
 type Model struct {
+	ID         string       `json:"-"` // Full OpenRouter ID, e.g. "openai/gpt-4o"
 	Name       string       `json:"name"`
 	Model      string       `json:"model,omitempty"`
 	ModifiedAt string       `json:"modified_at,omitempty"`
@@ -112,29 +229,20 @@ type Model struct {
 func (o *OpenrouterProvider) GetModels() ([]Model, error) {
 	currentTime := time.Now().Format(time.RFC3339)
 
-	// Fetch models from the OpenAI API with timeout
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
-	
-	modelsResponse, err := o.client.ListModels(ctx)
+	catalog, err := o.catalog.Get()
 	if err != nil {
 		return nil, fmt.Errorf("failed to list models: %w", err)
 	}
 
-	// Clear shared model storage
-	o.modelNames = []string{}
-
+	// Display names shared by several vendors are listed with the vendor
+	names := listingNames(catalog.IDs())
 	var models []Model
-	for _, apiModel := range modelsResponse.Models {
-		// Split model name
-		parts := strings.Split(apiModel.ID, "/")
-		name := parts[len(parts)-1]
-
-		// Store name in shared storage
-		o.modelNames = append(o.modelNames, apiModel.ID)
+	for _, apiModel := range catalog.Models {
+		name := names.name(apiModel.ID)
 
 		// Create model struct
 		model := Model{
+			ID:         apiModel.ID,
 			Name:       name,
 			Model:      name,
 			ModifiedAt: currentTime,
@@ -175,30 +283,9 @@ func (o *OpenrouterProvider) GetModelDetails(modelName string) (map[string]inter
 	}, nil
 }
 
+// GetFullModelName resolves a full ID or an unambiguous display name. Full
+// IDs that are not in the catalog are used as is, which allows direct use of
+// models missing from the list.
 func (o *OpenrouterProvider) GetFullModelName(alias string) (string, error) {
-	// If modelNames is empty or not populated yet, try to get models first
-	if len(o.modelNames) == 0 {
-		_, err := o.GetModels()
-		if err != nil {
-			return "", fmt.Errorf("failed to get models: %w", err)
-		}
-	}
-
-	// First try exact match
-	for _, fullName := range o.modelNames {
-		if fullName == alias {
-			return fullName, nil
-		}
-	}
-
-	// Then try suffix match
-	for _, fullName := range o.modelNames {
-		if strings.HasSuffix(fullName, alias) {
-			return fullName, nil
-		}
-	}
-
-	// If no match found, just use the alias as is
-	// This allows direct use of model names that might not be in the list
-	return alias, nil
+	return o.catalog.Resolve(alias)
 }
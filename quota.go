@@ -0,0 +1,329 @@
+package main
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sashabaranov/go-openai"
+)
+
+// OpenRouter defaults for free model usage: 50 requests/day without purchased
+// credits, 1000 requests/day with credits, and 20 requests/minute.
+const (
+	freeTierDailyLimit = 50
+	paidTierDailyLimit = 1000
+	freeMinuteLimit    = 20
+)
+
+// QuotaExceededError is returned when the free model quota is (nearly) used up
+type QuotaExceededError struct {
+	Scope   string // "daily" or "minute"
+	Used    int
+	Limit   int
+	ResetAt time.Time
+}
+
+func (e *QuotaExceededError) Error() string {
+	return fmt.Sprintf("free model %s quota exhausted (%d/%d requests used), resets at %s",
+		e.Scope, e.Used, e.Limit, e.ResetAt.UTC().Format(time.RFC3339))
+}
+
+// RetryAfter returns how long the client should wait before retrying
+func (e *QuotaExceededError) RetryAfter() time.Duration {
+	if d := time.Until(e.ResetAt); d > 0 {
+		return d
+	}
+	return 0
+}
+
+// QuotaStatus is a snapshot of the current quota usage
+type QuotaStatus struct {
+	Account     string    `json:"account"`
+	Day         string    `json:"day"`
+	Used        int       `json:"used"`
+	Limit       int       `json:"limit"`
+	Remaining   int       `json:"remaining"`
+	MinuteUsed  int       `json:"minute_used"`
+	MinuteLimit int       `json:"minute_limit"`
+	ResetAt     time.Time `json:"reset_at"`
+	SyncedAt    time.Time `json:"synced_at,omitempty"`
+}
+
+// QuotaTracker counts free model requests per UTC day for one OpenRouter account
+type QuotaTracker struct {
+	db             *sql.DB
+	mu             sync.Mutex
+	account        string
+	dailyLimit     int
+	minuteLimit    int
+	reserve        int
+	limitFixed     bool        // daily limit set in the configuration, not synced
+	recent         []time.Time // request timestamps within the last minute
+	pending        int         // reserved requests not yet recorded in the database
+	exhaustedUntil time.Time   // set when upstream reports the daily cap was hit
+	syncedAt       time.Time
+}
+
+func NewQuotaTracker(path, apiKey string) (*QuotaTracker, error) {
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = db.Exec(`CREATE TABLE IF NOT EXISTS quota_usage (
+		account TEXT NOT NULL,
+		day TEXT NOT NULL,
+		requests INTEGER DEFAULT 0,
+		PRIMARY KEY (account, day)
+	)`); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	q := &QuotaTracker{
+		db:          db,
+		account:     keyFingerprint(apiKey),
+		dailyLimit:  freeTierDailyLimit,
+		minuteLimit: freeMinuteLimit,
+	}
+	limits := currentConfig().Limits
+	if limits.FreeDailyLimit > 0 {
+		q.dailyLimit = limits.FreeDailyLimit
+		q.limitFixed = true
+	}
+	q.minuteLimit = limits.FreeMinuteLimit
+	q.reserve = limits.QuotaReserve
+	return q, nil
+}
+
+func (q *QuotaTracker) Close() error { return q.db.Close() }
+
+// keyFingerprint returns a short, non-reversible identifier for an API key
+func keyFingerprint(apiKey string) string {
+	sum := sha256.Sum256([]byte(apiKey))
+	return hex.EncodeToString(sum[:])[:12]
+}
+
+func quotaDay(t time.Time) string {
+	return t.UTC().Format("2006-01-02")
+}
+
+// nextQuotaReset returns the next UTC midnight, when OpenRouter resets daily quotas
+func nextQuotaReset(t time.Time) time.Time {
+	y, m, d := t.UTC().Date()
+	return time.Date(y, m, d+1, 0, 0, 0, 0, time.UTC)
+}
+
+func (q *QuotaTracker) usedToday() (int, error) {
+	var used int
+	err := q.db.QueryRow(`SELECT requests FROM quota_usage WHERE account=? AND day=?`,
+		q.account, quotaDay(time.Now())).Scan(&used)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return used, err
+}
+
+// pruneRecent drops request timestamps older than one minute. Caller holds q.mu.
+func (q *QuotaTracker) pruneRecent(now time.Time) {
+	i := 0
+	for i < len(q.recent) && now.Sub(q.recent[i]) >= time.Minute {
+		i++
+	}
+	q.recent = q.recent[i:]
+}
+
+// Reserve takes one request from the quota, or returns a *QuotaExceededError.
+// The request counts right away, so concurrent requests cannot overshoot the
+// caps between checking and recording them; Record then stores it.
+func (q *QuotaTracker) Reserve() error {
+	now := time.Now()
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if err := q.check(now); err != nil {
+		return err
+	}
+	q.pending++
+	q.recent = append(q.recent, now)
+	return nil
+}
+
+// Record counts a reserved upstream request against today's quota
+func (q *QuotaTracker) Record() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.pending = max(q.pending-1, 0)
+	_, err := q.db.Exec(`
+		INSERT INTO quota_usage(account, day, requests) VALUES(?, ?, 1)
+		ON CONFLICT(account, day) DO UPDATE SET requests=requests+1
+	`, q.account, quotaDay(time.Now()))
+	return err
+}
+
+// Cancel returns the reservation of a request that never got a response, e.g.
+// after a transport error or timeout
+func (q *QuotaTracker) Cancel() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.pending == 0 {
+		return
+	}
+	q.pending--
+	if n := len(q.recent); n > 0 {
+		q.recent = q.recent[:n-1]
+	}
+}
+
+// Check returns a *QuotaExceededError if another free request would exceed the quota
+func (q *QuotaTracker) Check() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.check(time.Now())
+}
+
+// check counts the requests of today and the last minute, including reserved
+// ones. Caller holds q.mu, so no request is reserved or recorded meanwhile.
+func (q *QuotaTracker) check(now time.Time) error {
+	used, err := q.usedToday()
+	if err != nil {
+		// Don't block traffic on a bookkeeping failure
+		slog.Debug("db error reading quota usage", "error", err)
+	}
+	used += q.pending
+
+	if now.Before(q.exhaustedUntil) {
+		return &QuotaExceededError{Scope: "daily", Used: max(used, q.dailyLimit), Limit: q.dailyLimit, ResetAt: q.exhaustedUntil}
+	}
+	if used >= q.dailyLimit-q.reserve {
+		return &QuotaExceededError{Scope: "daily", Used: used, Limit: q.dailyLimit, ResetAt: nextQuotaReset(now)}
+	}
+
+	q.pruneRecent(now)
+	if q.minuteLimit > 0 && len(q.recent) >= q.minuteLimit {
+		return &QuotaExceededError{Scope: "minute", Used: len(q.recent), Limit: q.minuteLimit, ResetAt: q.recent[0].Add(time.Minute)}
+	}
+	return nil
+}
+
+// MarkExhausted blocks free requests until the next daily reset. It is used when
+// OpenRouter reports the cap was hit before our own counter reached it.
+func (q *QuotaTracker) MarkExhausted() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.exhaustedUntil = nextQuotaReset(time.Now())
+	slog.Warn("free model daily quota exhausted upstream", "account", q.account, "reset_at", q.exhaustedUntil.Format(time.RFC3339))
+}
+
+// Status returns a snapshot of the current quota usage
+func (q *QuotaTracker) Status() QuotaStatus {
+	now := time.Now()
+	used, _ := q.usedToday()
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	used += q.pending
+	q.pruneRecent(now)
+	if now.Before(q.exhaustedUntil) {
+		used = max(used, q.dailyLimit)
+	}
+	return QuotaStatus{
+		Account:     q.account,
+		Day:         quotaDay(now),
+		Used:        used,
+		Limit:       q.dailyLimit,
+		Remaining:   max(q.dailyLimit-used, 0),
+		MinuteUsed:  len(q.recent),
+		MinuteLimit: q.minuteLimit,
+		ResetAt:     nextQuotaReset(now),
+		SyncedAt:    q.syncedAt,
+	}
+}
+
+// keyInfo is the subset of OpenRouter's /auth/key response we care about
+type keyInfo struct {
+	Data struct {
+		Label      string   `json:"label"`
+		Usage      float64  `json:"usage"`
+		Limit      *float64 `json:"limit"`
+		IsFreeTier bool     `json:"is_free_tier"`
+	} `json:"data"`
+}
+
+// Sync fetches the key info from OpenRouter and adjusts the daily limit to the
+// account tier, unless FREE_DAILY_LIMIT was set explicitly
+func (q *QuotaTracker) Sync(apiKey string) error {
+	client := &http.Client{
+		Transport: upstreamTransport,
+		Timeout:   currentConfig().Timeouts.Catalog,
+	}
+
+	req, err := http.NewRequest("GET", upstreamURL("auth/key"), nil)
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+apiKey)
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to fetch key info: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		// Keep the status for apiStatusCode, e.g. to disable revoked keys
+		return &openai.RequestError{HTTPStatus: resp.Status, HTTPStatusCode: resp.StatusCode, Err: fmt.Errorf("unexpected status: %s", resp.Status)}
+	}
+	var info keyInfo
+	if err := json.NewDecoder(resp.Body).Decode(&info); err != nil {
+		return err
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if !q.limitFixed {
+		if info.Data.IsFreeTier {
+			q.dailyLimit = freeTierDailyLimit
+		} else {
+			q.dailyLimit = paidTierDailyLimit
+		}
+	}
+	q.syncedAt = time.Now()
+	slog.Info("quota synced with OpenRouter", "account", q.account, "free_tier", info.Data.IsFreeTier, "daily_limit", q.dailyLimit)
+	return nil
+}
+
+// isDailyQuotaError checks if an upstream error reports the free daily cap was hit
+func isDailyQuotaError(err error) bool {
+	if err == nil {
+		return false
+	}
+	errStr := strings.ToLower(err.Error())
+	return strings.Contains(errStr, "free-models-per-day")
+}
+
+// respondQuotaExceeded writes a 429 with the reset time in the error shape of the
+// calling API (Ollama uses a plain string, OpenAI a nested object)
+func respondQuotaExceeded(c *gin.Context, err *QuotaExceededError, openAIStyle bool) {
+	c.Header("Retry-After", strconv.Itoa(int(err.RetryAfter().Seconds())+1))
+	c.Header("X-RateLimit-Limit", strconv.Itoa(err.Limit))
+	c.Header("X-RateLimit-Remaining", strconv.Itoa(max(err.Limit-err.Used, 0)))
+	c.Header("X-RateLimit-Reset", strconv.FormatInt(err.ResetAt.Unix(), 10))
+	if openAIStyle {
+		c.JSON(http.StatusTooManyRequests, gin.H{"error": gin.H{
+			"message": err.Error(),
+			"type":    "rate_limit_exceeded",
+			"code":    "free_quota_exhausted",
+		}})
+		return
+	}
+	c.JSON(http.StatusTooManyRequests, gin.H{"error": err.Error()})
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sashabaranov/go-openai"
+)
+
+func newTestQuotaTracker(t *testing.T) *QuotaTracker {
+	t.Helper()
+	q, err := NewQuotaTracker(filepath.Join(t.TempDir(), "quota.db"), "test-key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { q.Close() })
+	return q
+}
+
+func TestQuotaWindow(t *testing.T) {
+	now := time.Now()
+	ago := func(d ...time.Duration) []time.Time {
+		var ts []time.Time
+		for _, v := range d {
+			ts = append(ts, now.Add(-v))
+		}
+		return ts
+	}
+	tests := []struct {
+		name        string
+		dailyLimit  int
+		minuteLimit int
+		reserve     int
+		pending     int
+		recent      []time.Time
+		exhausted   bool
+		wantScope   string // "" when a request is allowed
+		wantResetAt time.Time
+	}{
+		{name: "empty", dailyLimit: 50, minuteLimit: 2},
+		{name: "old requests leave the window", dailyLimit: 50, minuteLimit: 2, recent: ago(90*time.Second, 61*time.Second, 5*time.Second)},
+		{name: "minute limit reached", dailyLimit: 50, minuteLimit: 2, recent: ago(30*time.Second, 5*time.Second),
+			wantScope: "minute", wantResetAt: now.Add(30 * time.Second)},
+		{name: "no minute limit", dailyLimit: 50, minuteLimit: 0, recent: ago(3*time.Second, 2*time.Second, time.Second)},
+		{name: "daily limit reached", dailyLimit: 5, minuteLimit: 20, pending: 5, wantScope: "daily"},
+		{name: "reserve kept back", dailyLimit: 10, minuteLimit: 20, reserve: 2, pending: 8, wantScope: "daily"},
+		{name: "below reserve", dailyLimit: 10, minuteLimit: 20, reserve: 2, pending: 7},
+		{name: "exhausted upstream", dailyLimit: 50, minuteLimit: 20, exhausted: true, wantScope: "daily"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := newTestQuotaTracker(t)
+			q.dailyLimit, q.minuteLimit, q.reserve, q.pending, q.recent = tt.dailyLimit, tt.minuteLimit, tt.reserve, tt.pending, tt.recent
+			if tt.exhausted {
+				q.MarkExhausted()
+			}
+			err := q.Check()
+			if tt.wantScope == "" {
+				if err != nil {
+					t.Fatalf("Check() = %v, want nil", err)
+				}
+				return
+			}
+			var quotaErr *QuotaExceededError
+			if !errors.As(err, &quotaErr) || quotaErr.Scope != tt.wantScope {
+				t.Fatalf("Check() = %v, want %s quota exceeded", err, tt.wantScope)
+			}
+			if !tt.wantResetAt.IsZero() && !quotaErr.ResetAt.Equal(tt.wantResetAt) {
+				t.Errorf("ResetAt = %v, want %v", quotaErr.ResetAt, tt.wantResetAt)
+			}
+		})
+	}
+}
+
+func TestQuotaReserveConcurrent(t *testing.T) {
+	q := newTestQuotaTracker(t)
+	q.dailyLimit, q.minuteLimit = 5, 0
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	granted := 0
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if q.Reserve() != nil {
+				return
+			}
+			if err := q.Record(); err != nil {
+				t.Error(err)
+			}
+			mu.Lock()
+			granted++
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+	if granted != 5 {
+		t.Errorf("granted %d requests, want 5", granted)
+	}
+	if used := q.Status().Used; used != 5 {
+		t.Errorf("recorded %d requests, want 5", used)
+	}
+}
+
+func TestQuotaCancel(t *testing.T) {
+	q := newTestQuotaTracker(t)
+	q.dailyLimit, q.minuteLimit = 5, 1
+	if err := q.Reserve(); err != nil {
+		t.Fatal(err)
+	}
+	if q.Check() == nil {
+		t.Fatal("reservation not counted")
+	}
+	q.Cancel()
+	if err := q.Check(); err != nil {
+		t.Errorf("Check() after Cancel() = %v, want nil", err)
+	}
+	if s := q.Status(); s.Used != 0 || s.MinuteUsed != 0 {
+		t.Errorf("status after Cancel() = %+v, want nothing used", s)
+	}
+	q.Cancel() // nothing reserved
+	if q.pending != 0 {
+		t.Errorf("pending = %d, want 0", q.pending)
+	}
+}
+
+func TestChatRecordsAnsweredRequests(t *testing.T) {
+	tests := []struct {
+		name     string
+		handler  http.HandlerFunc // nil when OpenRouter cannot be reached
+		wantUsed int
+	}{
+		{name: "answered", handler: func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(`{"choices":[{"message":{"role":"assistant","content":"hi"}}]}`))
+		}, wantUsed: 1},
+		{name: "error response", handler: func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, `{"error":{"message":"boom"}}`, http.StatusInternalServerError)
+		}, wantUsed: 1},
+		{name: "transport error", wantUsed: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := httptest.NewServer(tt.handler)
+			if tt.handler == nil {
+				srv.Close()
+			} else {
+				defer srv.Close()
+			}
+			useConfig(t, func(c *Config) { c.Upstream.BaseURL = srv.URL })
+			p := newTestKeyPool(t, KeyStrategyRoundRobin, 1)
+			q := newTestQuotaTracker(t)
+			p.keys[0].quota = q
+
+			msgs := []openai.ChatCompletionMessage{{Role: openai.ChatMessageRoleUser, Content: "hi"}}
+			NewOpenrouterProvider(p, nil).Chat(context.Background(), msgs, "openai/gpt-4o:free")
+			if s := q.Status(); s.Used != tt.wantUsed || q.pending != 0 {
+				t.Errorf("used = %d, pending = %d, want %d used and nothing pending", s.Used, q.pending, tt.wantUsed)
+			}
+		})
+	}
+}
@@ -1,8 +1,11 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"log/slog"
 	"math"
+	"net/http"
 	"strings"
 	"sync"
 	"time"
@@ -36,12 +39,15 @@ func (r *RateLimiter) Wait() {
 	defer r.mu.Unlock()
 
 	now := time.Now()
+	var waited time.Duration
+	defer func() { observeRateLimitWait("model", waited) }()
 
 	// Check if we're in backoff period
 	if now.Before(r.backoffUntil) {
 		waitTime := r.backoffUntil.Sub(now)
 		slog.Debug("rate limiter waiting", "duration", waitTime)
 		time.Sleep(waitTime)
+		waited = waitTime
 		return
 	}
 
@@ -51,6 +57,7 @@ func (r *RateLimiter) Wait() {
 		waitTime := minInterval - elapsed
 		slog.Debug("rate limiting", "wait", waitTime)
 		time.Sleep(waitTime)
+		waited = waitTime
 	}
 
 	r.lastRequestTime = time.Now()
@@ -87,8 +94,13 @@ func (r *RateLimiter) RecordFailure(err error) {
 
 // calculateBackoff returns the backoff duration using exponential backoff with jitter
 func (r *RateLimiter) calculateBackoff() time.Duration {
-	// Exponential backoff: baseDelay * 2^(failureCount-1)
-	multiplier := math.Pow(2, float64(r.failureCount-1))
+	return r.backoff(r.failureCount)
+}
+
+// backoff returns the exponential backoff with jitter after failures failures
+func (r *RateLimiter) backoff(failures int) time.Duration {
+	// Exponential backoff: baseDelay * 2^(failures-1)
+	multiplier := math.Pow(2, float64(failures-1))
 	backoff := time.Duration(float64(r.baseDelay) * multiplier)
 	
 	// Cap at maxDelay
@@ -103,12 +115,37 @@ func (r *RateLimiter) calculateBackoff() time.Duration {
 	return backoff
 }
 
-// ShouldRetry returns true if we should retry after a failure
-func (r *RateLimiter) ShouldRetry() bool {
+// ShouldRetry returns true if a request that failed attempt times may be
+// retried. Attempts are counted per request, as the limiter is shared.
+func (r *RateLimiter) ShouldRetry(attempt int) bool {
 	r.mu.RLock()
 	defer r.mu.RUnlock()
 	
-	return r.failureCount < r.maxRetries
+	return attempt < r.maxRetries
+}
+
+// RetryDelay returns how long to wait before retrying a request that failed
+// attempt times. While a rate limit backoff is running Wait already sleeps, so
+// there is no extra delay.
+func (r *RateLimiter) RetryDelay(attempt int) time.Duration {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if time.Now().Before(r.backoffUntil) {
+		return 0
+	}
+	return r.backoff(attempt)
+}
+
+// BackoffRemaining returns how long this limiter is still backing off
+func (r *RateLimiter) BackoffRemaining() time.Duration {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if d := time.Until(r.backoffUntil); d > 0 {
+		return d
+	}
+	return 0
 }
 
 // isRateLimitError checks if an error is a rate limit error
@@ -124,6 +161,19 @@ func isRateLimitError(err error) bool {
 		strings.Contains(errStr, "quota exceeded")
 }
 
+// isRetryableError checks if retrying the same model may succeed: rate limits,
+// server errors, timeouts and connection failures
+func isRetryableError(err error) bool {
+	var quotaErr *QuotaExceededError
+	if err == nil || errors.As(err, &quotaErr) || errors.Is(err, context.Canceled) || isPermanentError(err) {
+		return false
+	}
+	if code := apiStatusCode(err); code != 0 {
+		return code == http.StatusTooManyRequests || code >= http.StatusInternalServerError
+	}
+	return isTemporaryError(err)
+}
+
 // GlobalRateLimiter manages rate limiting across all models
 type GlobalRateLimiter struct {
 	mu         sync.RWMutex
@@ -154,17 +204,47 @@ func (g *GlobalRateLimiter) GetLimiter(model string) *RateLimiter {
 	return limiter
 }
 
+// BackoffRemaining returns how long the limiter of a model is still backing off,
+// without creating a limiter for models that were never used
+func (g *GlobalRateLimiter) BackoffRemaining(model string) time.Duration {
+	g.mu.RLock()
+	limiter, exists := g.limiters[model]
+	g.mu.RUnlock()
+
+	if !exists {
+		return 0
+	}
+	return limiter.BackoffRemaining()
+}
+
+// Reset drops the limiter of a model, closing its circuit
+func (g *GlobalRateLimiter) Reset(model string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	delete(g.limiters, model)
+}
+
+// ResetAll drops every per-model limiter
+func (g *GlobalRateLimiter) ResetAll() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.limiters = make(map[string]*RateLimiter)
+}
+
 // WaitGlobal ensures global rate limiting across all models
 func (g *GlobalRateLimiter) WaitGlobal() {
 	g.mu.Lock()
 	defer g.mu.Unlock()
 	
 	now := time.Now()
+	var waited time.Duration
 	if elapsed := now.Sub(g.lastGlobal); elapsed < g.globalWait {
 		waitTime := g.globalWait - elapsed
 		time.Sleep(waitTime)
+		waited = waitTime
 	}
 	g.lastGlobal = time.Now()
+	observeRateLimitWait("global", waited)
 }
 
 // RecordRateLimitHeaders updates rate limit info from response headers
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// reloadable is a configuration file that can be re-read at runtime. load must
+// parse and validate the file and only swap in the result when it is valid.
+type reloadable struct {
+	name    string
+	path    string
+	load    func() error
+	stamp   fileStamp
+	lastErr error
+}
+
+// fileStamp identifies a version of a file; the zero value means missing
+type fileStamp struct {
+	modTime time.Time
+	size    int64
+}
+
+func statFile(path string) fileStamp {
+	info, err := os.Stat(path)
+	if err != nil {
+		return fileStamp{}
+	}
+	return fileStamp{modTime: info.ModTime(), size: info.Size()}
+}
+
+// ConfigReloader reloads registered configuration files on SIGHUP and when
+// they change on disk. A file that fails to load leaves the previous
+// configuration in place.
+type ConfigReloader struct {
+	mu    sync.Mutex
+	items []*reloadable
+}
+
+func NewConfigReloader() *ConfigReloader {
+	return &ConfigReloader{}
+}
+
+// Register adds a file that was already loaded at startup
+func (r *ConfigReloader) Register(name, path string, load func() error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.items = append(r.items, &reloadable{name: name, path: path, load: load, stamp: statFile(path)})
+}
+
+func (r *ConfigReloader) reload(item *reloadable, reason string) error {
+	item.stamp = statFile(item.path)
+	if err := item.load(); err != nil {
+		item.lastErr = err
+		slog.Error("failed to reload configuration, keeping previous version", "config", item.name, "path", item.path, "reason", reason, "error", err)
+		return err
+	}
+	item.lastErr = nil
+	slog.Info("configuration reloaded", "config", item.name, "path", item.path, "reason", reason)
+	return nil
+}
+
+// ReloadAll reloads every registered file
+func (r *ConfigReloader) ReloadAll(reason string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var errs []error
+	for _, item := range r.items {
+		errs = append(errs, r.reload(item, reason))
+	}
+	return errors.Join(errs...)
+}
+
+// check reloads the files whose modification time or size changed
+func (r *ConfigReloader) check() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, item := range r.items {
+		if statFile(item.path) != item.stamp {
+			_ = r.reload(item, "file changed")
+		}
+	}
+}
+
+// Start reloads on SIGHUP and, when interval is positive, polls the files for
+// changes. Polling also works on bind mounts where file events are not delivered.
+func (r *ConfigReloader) Start(interval time.Duration) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			_ = r.ReloadAll("SIGHUP")
+		}
+	}()
+
+	if interval <= 0 {
+		return
+	}
+	go func() {
+		for {
+			time.Sleep(interval)
+			r.check()
+		}
+	}()
+}
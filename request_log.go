@@ -0,0 +1,412 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sashabaranov/go-openai"
+)
+
+// RequestRecord describes one completed chat request
+type RequestRecord struct {
+	ID               int64     `json:"id"`
+	Timestamp        time.Time `json:"timestamp"`
+	Client           string    `json:"client"`
+	Endpoint         string    `json:"endpoint"`
+	RequestedModel   string    `json:"requested_model"`
+	ResolvedModel    string    `json:"resolved_model,omitempty"`
+	Stream           bool      `json:"stream"`
+	Attempts         int       `json:"attempts"`
+	FallbackChain    []string  `json:"fallback_chain,omitempty"`
+	Status           int       `json:"status"`
+	PromptTokens     int       `json:"prompt_tokens"`
+	CompletionTokens int       `json:"completion_tokens"`
+	Cost             float64   `json:"cost"`
+	LatencyMs        int64     `json:"latency_ms"`
+	TTFTMs           int64     `json:"ttft_ms"`
+	ErrorCategory    string    `json:"error_category,omitempty"`
+	Error            string    `json:"error,omitempty"`
+
+	mu         sync.Mutex
+	firstToken time.Time
+}
+
+type requestRecordContextKey struct{}
+
+func requestRecordFromContext(ctx context.Context) *RequestRecord {
+	rec, _ := ctx.Value(requestRecordContextKey{}).(*RequestRecord)
+	return rec
+}
+
+// describeRequest stores what the client asked for on the request's record
+func describeRequest(ctx context.Context, model string, stream bool) {
+	if rec := requestRecordFromContext(ctx); rec != nil {
+		rec.mu.Lock()
+		rec.RequestedModel = model
+		rec.Stream = stream
+		rec.mu.Unlock()
+	}
+}
+
+// recordAttempt adds one upstream model attempt to the request's record
+func recordAttempt(ctx context.Context, model string, err error) {
+	rec := requestRecordFromContext(ctx)
+	if rec == nil {
+		return
+	}
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	rec.Attempts++
+	rec.FallbackChain = append(rec.FallbackChain, model)
+	if err == nil {
+		rec.ResolvedModel = model
+		rec.ErrorCategory = ""
+		rec.Error = ""
+		return
+	}
+	rec.ErrorCategory = errorCategory(err)
+	rec.Error = err.Error()
+}
+
+// recordError stores the error that ended a request
+func recordError(ctx context.Context, err error) {
+	if rec := requestRecordFromContext(ctx); rec != nil && err != nil {
+		rec.mu.Lock()
+		rec.ErrorCategory = errorCategory(err)
+		rec.Error = err.Error()
+		rec.mu.Unlock()
+	}
+}
+
+// markFirstToken records the time to first token of a streamed response
+func markFirstToken(ctx context.Context) {
+	if rec := requestRecordFromContext(ctx); rec != nil {
+		rec.mu.Lock()
+		if rec.firstToken.IsZero() {
+			rec.firstToken = time.Now()
+		}
+		rec.mu.Unlock()
+	}
+}
+
+// errorCategory buckets an error for the request log
+func errorCategory(err error) string {
+	var quotaErr *QuotaExceededError
+	var limitErr *ClientLimitError
+	var ambiguousErr *AmbiguousModelError
+	var notFoundErr *ModelNotFoundError
+	var fallbackErr *FallbackDisabledError
+	var capErr *SpendCapError
+	var missErr *CassetteMissError
+	var deniedErr *ModelNotAllowedError
+	switch {
+	case err == nil:
+		return ""
+	case errors.As(err, &quotaErr):
+		return "quota"
+	case errors.As(err, &ambiguousErr):
+		return "model_ambiguous"
+	case errors.As(err, &notFoundErr):
+		return "model_not_found"
+	case errors.As(err, &limitErr):
+		return "client_limit"
+	case errors.As(err, &capErr):
+		return "spend_cap"
+	case errors.As(err, &missErr):
+		return "cassette_miss"
+	case errors.As(err, &deniedErr):
+		return "permission_denied"
+	case errors.As(err, &fallbackErr) && fallbackErr.Err == nil:
+		return "no_models"
+	case errors.Is(err, context.Canceled):
+		return "canceled"
+	}
+	switch apiStatusCode(err) {
+	case http.StatusUnauthorized, http.StatusPaymentRequired:
+		return "auth"
+	}
+	switch {
+	case isRateLimitError(err):
+		return "rate_limit"
+	case isPermanentError(err):
+		return "model_unavailable"
+	case strings.Contains(strings.ToLower(err.Error()), "timeout"), errors.Is(err, context.DeadlineExceeded):
+		return "timeout"
+	case strings.Contains(err.Error(), "no free models available"), strings.Contains(err.Error(), "no models"):
+		return "no_models"
+	}
+	return "upstream"
+}
+
+// RequestLogStore keeps a persistent log of chat requests in SQLite
+type RequestLogStore struct {
+	db        *sql.DB
+	retention time.Duration
+}
+
+func NewRequestLogStore(path string, retention time.Duration) (*RequestLogStore, error) {
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = db.Exec(`CREATE TABLE IF NOT EXISTS request_log (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		ts INTEGER NOT NULL,
+		client TEXT,
+		endpoint TEXT,
+		requested_model TEXT,
+		resolved_model TEXT,
+		stream INTEGER DEFAULT 0,
+		attempts INTEGER DEFAULT 0,
+		fallback_chain TEXT,
+		status INTEGER,
+		prompt_tokens INTEGER DEFAULT 0,
+		completion_tokens INTEGER DEFAULT 0,
+		cost REAL DEFAULT 0,
+		latency_ms INTEGER DEFAULT 0,
+		ttft_ms INTEGER DEFAULT 0,
+		error_category TEXT,
+		error TEXT
+	)`); err != nil {
+		db.Close()
+		return nil, err
+	}
+	// Logs created before costs were tracked lack the column
+	if _, err = db.Exec(`ALTER TABLE request_log ADD COLUMN cost REAL DEFAULT 0`); err != nil && !strings.Contains(err.Error(), "duplicate column") {
+		db.Close()
+		return nil, err
+	}
+	if _, err = db.Exec(`CREATE INDEX IF NOT EXISTS request_log_ts ON request_log(ts)`); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &RequestLogStore{db: db, retention: retention}, nil
+}
+
+func (s *RequestLogStore) Close() error { return s.db.Close() }
+
+// Insert appends a record to the log
+func (s *RequestLogStore) Insert(rec *RequestRecord) error {
+	chain, _ := json.Marshal(rec.FallbackChain)
+	_, err := s.db.Exec(`INSERT INTO request_log(ts, client, endpoint, requested_model, resolved_model, stream, attempts, fallback_chain, status, prompt_tokens, completion_tokens, cost, latency_ms, ttft_ms, error_category, error)
+		VALUES(?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		rec.Timestamp.UnixMilli(), rec.Client, rec.Endpoint, rec.RequestedModel, rec.ResolvedModel, rec.Stream, rec.Attempts, string(chain),
+		rec.Status, rec.PromptTokens, rec.CompletionTokens, rec.Cost, rec.LatencyMs, rec.TTFTMs, rec.ErrorCategory, rec.Error)
+	return err
+}
+
+// Prune deletes records older than the retention period
+func (s *RequestLogStore) Prune() error {
+	if s.retention <= 0 {
+		return nil
+	}
+	_, err := s.db.Exec(`DELETE FROM request_log WHERE ts < ?`, time.Now().Add(-s.retention).UnixMilli())
+	return err
+}
+
+// StartPruning prunes the log now and then every hour in the background
+func (s *RequestLogStore) StartPruning() {
+	go func() {
+		for {
+			if err := s.Prune(); err != nil {
+				slog.Warn("failed to prune request log", "error", err)
+			}
+			time.Sleep(time.Hour)
+		}
+	}()
+}
+
+// RequestLogQuery selects records from the log; zero values match everything
+type RequestLogQuery struct {
+	From   time.Time
+	To     time.Time
+	Model  string // matches either the requested or the resolved model
+	Client string
+	Limit  int
+}
+
+// Query returns matching records, newest first
+func (s *RequestLogStore) Query(q RequestLogQuery) ([]*RequestRecord, error) {
+	query := `SELECT id, ts, client, endpoint, requested_model, resolved_model, stream, attempts, fallback_chain, status, prompt_tokens, completion_tokens, cost, latency_ms, ttft_ms, error_category, error FROM request_log WHERE 1=1`
+	var args []any
+	if !q.From.IsZero() {
+		query += ` AND ts >= ?`
+		args = append(args, q.From.UnixMilli())
+	}
+	if !q.To.IsZero() {
+		query += ` AND ts < ?`
+		args = append(args, q.To.UnixMilli())
+	}
+	if q.Model != "" {
+		query += ` AND (requested_model = ? OR resolved_model = ?)`
+		args = append(args, q.Model, q.Model)
+	}
+	if q.Client != "" {
+		query += ` AND client = ?`
+		args = append(args, q.Client)
+	}
+	query += ` ORDER BY ts DESC`
+	if q.Limit > 0 {
+		query += ` LIMIT ?`
+		args = append(args, q.Limit)
+	}
+
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var records []*RequestRecord
+	for rows.Next() {
+		rec := &RequestRecord{}
+		var ts int64
+		var chain string
+		if err := rows.Scan(&rec.ID, &ts, &rec.Client, &rec.Endpoint, &rec.RequestedModel, &rec.ResolvedModel, &rec.Stream, &rec.Attempts, &chain,
+			&rec.Status, &rec.PromptTokens, &rec.CompletionTokens, &rec.Cost, &rec.LatencyMs, &rec.TTFTMs, &rec.ErrorCategory, &rec.Error); err != nil {
+			return nil, err
+		}
+		rec.Timestamp = time.UnixMilli(ts).UTC()
+		_ = json.Unmarshal([]byte(chain), &rec.FallbackChain)
+		records = append(records, rec)
+	}
+	return records, rows.Err()
+}
+
+// requestLogMiddleware creates the request record, makes it available to the
+// handler and the router through the request context and stores it once the
+// response is written
+func requestLogMiddleware(store *RequestLogStore) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		rec := &RequestRecord{
+			Timestamp: start.UTC(),
+			Client:    clientFromContext(c.Request.Context()).ClientName(),
+			Endpoint:  c.FullPath(),
+		}
+		c.Request = c.Request.WithContext(context.WithValue(c.Request.Context(), requestRecordContextKey{}, rec))
+
+		c.Next()
+
+		rec.mu.Lock()
+		rec.Status = c.Writer.Status()
+		rec.LatencyMs = time.Since(start).Milliseconds()
+		rec.TTFTMs = rec.LatencyMs
+		if !rec.firstToken.IsZero() {
+			rec.TTFTMs = rec.firstToken.Sub(start).Milliseconds()
+		}
+		if value, ok := c.Get("usage"); ok {
+			if usage, ok := value.(openai.Usage); ok {
+				rec.PromptTokens = usage.PromptTokens
+				rec.CompletionTokens = usage.CompletionTokens
+			}
+		}
+		rec.Cost = c.GetFloat64("cost")
+		rec.mu.Unlock()
+
+		if err := store.Insert(rec); err != nil {
+			slog.Error("failed to write request log", "error", err)
+		}
+	}
+}
+
+// parseLogTime accepts RFC 3339 timestamps, dates and unix seconds
+func parseLogTime(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if secs, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return time.Unix(secs, 0), nil
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	return time.Parse("2006-01-02", value)
+}
+
+func parseRequestLogQuery(c *gin.Context) (RequestLogQuery, error) {
+	var q RequestLogQuery
+	var err error
+	if q.From, err = parseLogTime(c.Query("from")); err != nil {
+		return q, fmt.Errorf("invalid from: %w", err)
+	}
+	if q.To, err = parseLogTime(c.Query("to")); err != nil {
+		return q, fmt.Errorf("invalid to: %w", err)
+	}
+	q.Model = c.Query("model")
+	q.Client = c.Query("client")
+	if limit := c.Query("limit"); limit != "" {
+		if q.Limit, err = strconv.Atoi(limit); err != nil {
+			return q, fmt.Errorf("invalid limit: %w", err)
+		}
+	}
+	return q, nil
+}
+
+// registerRequestLogRoutes adds the request log query and export endpoints to the admin API
+func registerRequestLogRoutes(admin *gin.RouterGroup, store *RequestLogStore) {
+	admin.GET("/requests", func(c *gin.Context) {
+		q, err := parseRequestLogQuery(c)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if q.Limit == 0 {
+			q.Limit = 100
+		}
+		records, err := store.Query(q)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"requests": records})
+	})
+
+	admin.GET("/requests/export", func(c *gin.Context) {
+		q, err := parseRequestLogQuery(c)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		records, err := store.Query(q)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		filename := "requests-" + time.Now().UTC().Format("20060102-150405")
+		switch c.DefaultQuery("format", "csv") {
+		case "json":
+			c.Header("Content-Disposition", `attachment; filename="`+filename+`.json"`)
+			c.JSON(http.StatusOK, records)
+		case "csv":
+			c.Header("Content-Disposition", `attachment; filename="`+filename+`.csv"`)
+			c.Header("Content-Type", "text/csv")
+			w := csv.NewWriter(c.Writer)
+			_ = w.Write([]string{"id", "timestamp", "client", "endpoint", "requested_model", "resolved_model", "stream", "attempts", "fallback_chain",
+				"status", "prompt_tokens", "completion_tokens", "cost", "latency_ms", "ttft_ms", "error_category", "error"})
+			for _, r := range records {
+				_ = w.Write([]string{
+					strconv.FormatInt(r.ID, 10), r.Timestamp.Format(time.RFC3339Nano), r.Client, r.Endpoint, r.RequestedModel, r.ResolvedModel,
+					strconv.FormatBool(r.Stream), strconv.Itoa(r.Attempts), strings.Join(r.FallbackChain, " > "), strconv.Itoa(r.Status),
+					strconv.Itoa(r.PromptTokens), strconv.Itoa(r.CompletionTokens), formatCost(r.Cost), strconv.FormatInt(r.LatencyMs, 10), strconv.FormatInt(r.TTFTMs, 10),
+					r.ErrorCategory, r.Error,
+				})
+			}
+			w.Flush()
+		default:
+			c.JSON(http.StatusBadRequest, gin.H{"error": "format must be csv or json"})
+		}
+	})
+}
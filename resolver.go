@@ -0,0 +1,139 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// AmbiguousModelError is returned when a display name matches several models,
+// e.g. the same model published by two vendors
+type AmbiguousModelError struct {
+	Name       string
+	Candidates []string
+}
+
+func (e *AmbiguousModelError) Error() string {
+	return fmt.Sprintf("model %q is ambiguous, use one of: %s", e.Name, strings.Join(e.Candidates, ", "))
+}
+
+// ModelNotFoundError is returned when a name matches no model
+type ModelNotFoundError struct {
+	Name string
+}
+
+func (e *ModelNotFoundError) Error() string {
+	return fmt.Sprintf("model %q not found", e.Name)
+}
+
+// resolveModelName maps a requested name to one of ids: an exact full ID first,
+// then a display name that identifies a single model. The result does not
+// depend on the order of ids.
+func resolveModelName(name string, ids []string) (string, error) {
+	var matches []string
+	for _, id := range ids {
+		if id == name {
+			return id, nil
+		}
+		if modelDisplayName(id) == name {
+			matches = append(matches, id)
+		}
+	}
+	switch len(matches) {
+	case 0:
+		return "", &ModelNotFoundError{Name: name}
+	case 1:
+		return matches[0], nil
+	}
+	sort.Strings(matches)
+	return "", &AmbiguousModelError{Name: name, Candidates: matches}
+}
+
+// freeModelCandidates returns the free models a name can resolve to: those
+// allowed by the model filter
+func freeModelCandidates() []string {
+	var ids []string
+	for _, m := range currentFreeModels() {
+		if currentModelFilter().Allows(m) {
+			ids = append(ids, m)
+		}
+	}
+	return ids
+}
+
+// resolveFreeModel resolves a requested name to a free model
+func resolveFreeModel(name string) (string, error) {
+	return resolveModelName(name, freeModelCandidates())
+}
+
+// modelNames maps model IDs to the names they are listed under
+type modelNames map[string]string
+
+// name returns the listed name of a model, its display name if it is unknown
+func (n modelNames) name(id string) string {
+	if name, ok := n[id]; ok {
+		return name
+	}
+	return modelDisplayName(id)
+}
+
+// listingNames returns the name under which each model is listed: its display
+// name, or its vendor-qualified full ID when the display name is shared by
+// several of ids. Every listed name resolves back to its model.
+func listingNames(ids []string) modelNames {
+	count := make(map[string]int, len(ids))
+	for _, id := range ids {
+		count[modelDisplayName(id)]++
+	}
+	names := make(modelNames, len(ids))
+	for _, id := range ids {
+		if count[modelDisplayName(id)] > 1 {
+			names[id] = id
+		} else {
+			names[id] = modelDisplayName(id)
+		}
+	}
+	return names
+}
+
+// respondAmbiguousModel rejects a request for an ambiguous model name, listing
+// the models it could mean
+func respondAmbiguousModel(c *gin.Context, err *AmbiguousModelError, openAIStyle bool) {
+	if openAIStyle {
+		c.JSON(http.StatusBadRequest, gin.H{"error": gin.H{
+			"message":    err.Error(),
+			"type":       "invalid_request_error",
+			"param":      "model",
+			"code":       "model_ambiguous",
+			"candidates": err.Candidates,
+		}})
+		return
+	}
+	c.JSON(http.StatusBadRequest, gin.H{"error": err.Error(), "candidates": err.Candidates})
+}
+
+// isUnresolvedModel reports whether err is an ambiguous or unknown model name
+func isUnresolvedModel(err error) bool {
+	var ambiguousErr *AmbiguousModelError
+	var notFoundErr *ModelNotFoundError
+	return errors.As(err, &ambiguousErr) || errors.As(err, &notFoundErr)
+}
+
+// respondUnresolvedModel answers a request whose model name could not be
+// resolved: 400 for an ambiguous name, otherwise 404 as Ollama does
+func respondUnresolvedModel(c *gin.Context, err error, openAIStyle bool) {
+	var ambiguousErr *AmbiguousModelError
+	if errors.As(err, &ambiguousErr) {
+		respondAmbiguousModel(c, ambiguousErr, openAIStyle)
+		return
+	}
+	if openAIStyle {
+		c.JSON(http.StatusNotFound, gin.H{"error": gin.H{"message": err.Error()}})
+		return
+	}
+	c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+}
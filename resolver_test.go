@@ -0,0 +1,60 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestResolveModelName(t *testing.T) {
+	ids := []string{
+		"google/gemma-3-27b-it:free",
+		"acme/gemini-2.0-flash-exp:free",
+		"google/gemini-2.0-flash-exp:free",
+		"gemini-2.0-flash-exp:free", // a full ID equal to the display name of others
+		"openai/gpt-4o",
+	}
+	tests := []struct {
+		name      string
+		requested string
+		want      string
+		notFound  bool
+	}{
+		{name: "full ID", requested: "google/gemma-3-27b-it:free", want: "google/gemma-3-27b-it:free"},
+		{name: "unique display name", requested: "gpt-4o", want: "openai/gpt-4o"},
+		{name: "exact ID wins over display names", requested: "gemini-2.0-flash-exp:free", want: "gemini-2.0-flash-exp:free"},
+		{name: "not found", requested: "claude-3", notFound: true},
+		{name: "partial names do not match", requested: "gemma", notFound: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := resolveModelName(tt.requested, ids)
+			var notFoundErr *ModelNotFoundError
+			if tt.notFound && !errors.As(err, &notFoundErr) {
+				t.Fatalf("error = %v, want ModelNotFoundError", err)
+			}
+			if !tt.notFound && err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("resolveModelName(%q) = %q, want %q", tt.requested, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestResolveModelNameAmbiguous(t *testing.T) {
+	// The candidates are the same whatever the catalog order
+	for _, ids := range [][]string{
+		{"google/gemini-2.0-flash-exp:free", "acme/gemini-2.0-flash-exp:free"},
+		{"acme/gemini-2.0-flash-exp:free", "google/gemini-2.0-flash-exp:free"},
+	} {
+		_, err := resolveModelName("gemini-2.0-flash-exp:free", ids)
+		var ambiguousErr *AmbiguousModelError
+		if !errors.As(err, &ambiguousErr) {
+			t.Fatalf("error = %v, want AmbiguousModelError", err)
+		}
+		if got := ambiguousErr.Candidates; len(got) != 2 || got[0] != "acme/gemini-2.0-flash-exp:free" {
+			t.Errorf("candidates = %v, want sorted", got)
+		}
+	}
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sashabaranov/go-openai"
+)
+
+// requestCostHeader reports the cost in USD of a non-streamed response
+const requestCostHeader = "X-Request-Cost"
+
+// formatCost formats a cost in USD for a header
+func formatCost(cost float64) string {
+	return strconv.FormatFloat(cost, 'f', -1, 64)
+}
+
+// modelCost returns the cost in USD of a request from the model's catalog
+// pricing, 0 for models without pricing
+func modelCost(model string, usage openai.Usage) float64 {
+	rec, ok := modelCatalog.Lookup(model)
+	if !ok {
+		return 0
+	}
+	return unitPrice(rec.Pricing.Prompt)*float64(usage.PromptTokens) +
+		unitPrice(rec.Pricing.Completion)*float64(usage.CompletionTokens) +
+		unitPrice(rec.Pricing.Request)
+}
+
+// unitPrice parses one of OpenRouter's decimal price strings. Negative prices,
+// such as the "-1" of models priced at runtime, count as 0.
+func unitPrice(s string) float64 {
+	v, _ := strconv.ParseFloat(s, 64)
+	return max(v, 0)
+}
+
+// servedModel returns the model OpenRouter reports for a response, which can
+// differ from the one requested upstream, e.g. for openrouter/auto
+func servedModel(routed, reported string) string {
+	if reported != "" {
+		return reported
+	}
+	return routed
+}
+
+// setUsage reports the token usage and cost of a request to the middlewares
+// and returns the cost
+func setUsage(c *gin.Context, model string, usage openai.Usage) float64 {
+	cost := modelCost(model, usage)
+	c.Set("usage", usage)
+	c.Set("cost", cost)
+	c.Set("served_model", model)
+	return cost
+}
+
+// costUsage is an OpenAI usage object with the cost field OpenRouter adds
+type costUsage struct {
+	openai.Usage
+	Cost float64 `json:"cost"`
+}
+
+// chatResponseWithCost is an OpenAI chat response reporting its cost
+type chatResponseWithCost struct {
+	openai.ChatCompletionResponse
+	Usage costUsage `json:"usage"`
+}
+
+// streamUsageWithCost is the usage chunk of an OpenAI stream reporting its cost
+type streamUsageWithCost struct {
+	openai.ChatCompletionStreamResponse
+	Usage costUsage `json:"usage"`
+}
+
+// ModelSpend is the consumption of one model, client or day in a period
+type ModelSpend struct {
+	Day              string  `json:"day,omitempty"`
+	Model            string  `json:"model,omitempty"`
+	Client           string  `json:"client,omitempty"`
+	Requests         int64   `json:"requests"`
+	PromptTokens     int64   `json:"prompt_tokens"`
+	CompletionTokens int64   `json:"completion_tokens"`
+	Cost             float64 `json:"cost"`
+}
+
+// SpendCapError is returned when the proxy has reached a spend cap
+type SpendCapError struct {
+	Period  string
+	Spent   float64
+	Cap     float64
+	ResetAt time.Time
+}
+
+func (e *SpendCapError) Error() string {
+	return fmt.Sprintf("spend cap of $%s per %s reached ($%.4f spent), resets at %s",
+		formatCost(e.Cap), e.Period, e.Spent, e.ResetAt.UTC().Format(time.RFC3339))
+}
+
+// SpendStore accumulates the cost of chat requests per day, model and client in SQLite
+type SpendStore struct {
+	db *sql.DB
+}
+
+func NewSpendStore(path string) (*SpendStore, error) {
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = db.Exec(`CREATE TABLE IF NOT EXISTS model_spend (
+		day TEXT NOT NULL,
+		model TEXT NOT NULL,
+		client TEXT NOT NULL,
+		requests INTEGER DEFAULT 0,
+		prompt_tokens INTEGER DEFAULT 0,
+		completion_tokens INTEGER DEFAULT 0,
+		cost REAL DEFAULT 0,
+		PRIMARY KEY (day, model, client)
+	)`); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &SpendStore{db: db}, nil
+}
+
+func (s *SpendStore) Close() error { return s.db.Close() }
+
+// Record adds one completed request
+func (s *SpendStore) Record(model, client string, usage openai.Usage, cost float64) error {
+	_, err := s.db.Exec(`
+		INSERT INTO model_spend(day, model, client, requests, prompt_tokens, completion_tokens, cost)
+		VALUES(?, ?, ?, 1, ?, ?, ?)
+		ON CONFLICT(day, model, client) DO UPDATE SET
+			requests=requests+1,
+			prompt_tokens=prompt_tokens+excluded.prompt_tokens,
+			completion_tokens=completion_tokens+excluded.completion_tokens,
+			cost=cost+excluded.cost
+	`, quotaDay(time.Now()), model, client, usage.PromptTokens, usage.CompletionTokens, cost)
+	return err
+}
+
+// Spent returns the total cost in the current day or month and when it resets
+func (s *SpendStore) Spent(period string, now time.Time) (float64, time.Time, error) {
+	bucket, resetAt := usageBucket(period, now)
+	var spent float64
+	err := s.db.QueryRow(`SELECT COALESCE(SUM(cost), 0) FROM model_spend WHERE day LIKE ?`, bucket+"%").Scan(&spent)
+	return spent, resetAt, err
+}
+
+// CheckCaps returns a *SpendCapError once the daily or monthly spend cap is reached
+func (s *SpendStore) CheckCaps() error {
+	limits := currentConfig().Limits
+	now := time.Now()
+	for _, check := range []struct {
+		period string
+		cap    float64
+	}{
+		{PeriodDay, limits.DailySpendCap},
+		{PeriodMonth, limits.MonthlySpendCap},
+	} {
+		if check.cap <= 0 {
+			continue
+		}
+		spent, resetAt, err := s.Spent(check.period, now)
+		if err != nil {
+			return err
+		}
+		if spent >= check.cap {
+			return &SpendCapError{Period: check.period, Spent: spent, Cap: check.cap, ResetAt: resetAt}
+		}
+	}
+	return nil
+}
+
+// spendGroups are the columns spend can be grouped by
+var spendGroups = map[string]string{"model": "model", "client": "client", "day": "day"}
+
+// Summary returns the spend in a day or month bucket, grouped by model, client or day
+func (s *SpendStore) Summary(period, bucket, group string) ([]ModelSpend, error) {
+	if bucket == "" {
+		bucket, _ = usageBucket(period, time.Now())
+	}
+	column := spendGroups[group]
+	rows, err := s.db.Query(`SELECT `+column+`, SUM(requests), SUM(prompt_tokens), SUM(completion_tokens), SUM(cost)
+		FROM model_spend WHERE day LIKE ? GROUP BY `+column+` ORDER BY SUM(cost) DESC, `+column, bucket+"%")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result []ModelSpend
+	for rows.Next() {
+		var m ModelSpend
+		var key string
+		if err := rows.Scan(&key, &m.Requests, &m.PromptTokens, &m.CompletionTokens, &m.Cost); err != nil {
+			return nil, err
+		}
+		switch group {
+		case "model":
+			m.Model = key
+		case "client":
+			m.Client = key
+		default:
+			m.Day = key
+		}
+		result = append(result, m)
+	}
+	return result, rows.Err()
+}
+
+// spendMiddleware blocks chat requests once a spend cap is reached and records
+// the cost of completed requests. Handlers report it with setUsage.
+func spendMiddleware(store *SpendStore) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if err := store.CheckCaps(); err != nil {
+			var capErr *SpendCapError
+			if errors.As(err, &capErr) {
+				recordError(c.Request.Context(), err)
+				respondSpendCapExceeded(c, capErr)
+				return
+			}
+			respondError(c, http.StatusInternalServerError, "server_error", "failed to check spend caps")
+			return
+		}
+
+		c.Next()
+
+		model := c.GetString("served_model")
+		if model == "" || c.Writer.Status() >= http.StatusBadRequest {
+			return
+		}
+		value, _ := c.Get("usage")
+		usage, _ := value.(openai.Usage)
+		client := clientFromContext(c.Request.Context()).ClientName()
+		if err := store.Record(model, client, usage, c.GetFloat64("cost")); err != nil {
+			slog.Error("failed to record spend", "model", model, "client", client, "error", err)
+		}
+	}
+}
+
+// respondSpendCapExceeded writes a 429 in the error shape of the calling API
+func respondSpendCapExceeded(c *gin.Context, err *SpendCapError) {
+	c.Header("Retry-After", strconv.Itoa(int(time.Until(err.ResetAt).Seconds())+1))
+	if isOpenAIPath(c.Request.URL.Path) {
+		c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{"error": gin.H{
+			"message": err.Error(),
+			"type":    "rate_limit_exceeded",
+			"code":    "spend_cap_exceeded",
+		}})
+		return
+	}
+	c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{"error": err.Error()})
+}
+
+// registerSpendRoutes adds the spend report to the admin API
+func registerSpendRoutes(admin *gin.RouterGroup, store *SpendStore) {
+	admin.GET("/spend", func(c *gin.Context) {
+		period := c.DefaultQuery("period", PeriodDay)
+		if period != PeriodDay && period != PeriodMonth {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "period must be day or month"})
+			return
+		}
+		group := c.DefaultQuery("group", "model")
+		if _, ok := spendGroups[group]; !ok {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "group must be model, client or day"})
+			return
+		}
+		spend, err := store.Summary(period, c.Query("bucket"), group)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		limits := currentConfig().Limits
+		c.JSON(http.StatusOK, gin.H{"spend": spend, "daily_cap": limits.DailySpendCap, "monthly_cap": limits.MonthlySpendCap})
+	})
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"path/filepath"
+	"testing"
+
+	"github.com/sashabaranov/go-openai"
+)
+
+func TestModelCost(t *testing.T) {
+	useCatalog(t,
+		ModelRecord{ID: "openai/gpt-4o", Pricing: ModelPricing{Prompt: "0.0000025", Completion: "0.00001"}},
+		ModelRecord{ID: "acme/per-request", Pricing: ModelPricing{Prompt: "0", Completion: "0", Request: "0.005"}},
+		ModelRecord{ID: "openrouter/auto", Pricing: ModelPricing{Prompt: "-1", Completion: "-1"}},
+		ModelRecord{ID: "google/gemma:free", Pricing: ModelPricing{Prompt: "0", Completion: "0"}},
+	)
+	usage := openai.Usage{PromptTokens: 1000, CompletionTokens: 200}
+	tests := []struct {
+		model string
+		want  float64
+	}{
+		{model: "openai/gpt-4o", want: 0.0045},
+		{model: "acme/per-request", want: 0.005},
+		{model: "openrouter/auto", want: 0}, // priced at runtime
+		{model: "google/gemma:free", want: 0},
+		{model: "unknown/model", want: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.model, func(t *testing.T) {
+			if got := modelCost(tt.model, usage); math.Abs(got-tt.want) > 1e-12 {
+				t.Errorf("modelCost(%q) = %g, want %g", tt.model, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestUnitPrice(t *testing.T) {
+	tests := map[string]float64{"0.000002": 0.000002, "0": 0, "-1": 0, "": 0, "n/a": 0}
+	for s, want := range tests {
+		if got := unitPrice(s); got != want {
+			t.Errorf("unitPrice(%q) = %g, want %g", s, got, want)
+		}
+	}
+}
+
+func TestServedModel(t *testing.T) {
+	if got := servedModel("openrouter/auto", "openai/gpt-4o"); got != "openai/gpt-4o" {
+		t.Errorf("servedModel() = %q, want the reported model", got)
+	}
+	if got := servedModel("openai/gpt-4o", ""); got != "openai/gpt-4o" {
+		t.Errorf("servedModel() = %q, want the routed model", got)
+	}
+}
+
+func TestSpendStoreCaps(t *testing.T) {
+	tests := []struct {
+		name       string
+		dailyCap   float64
+		monthlyCap float64
+		wantPeriod string // "" when below the caps
+	}{
+		{name: "no caps"},
+		{name: "below caps", dailyCap: 1, monthlyCap: 10},
+		{name: "daily cap", dailyCap: 0.3, monthlyCap: 10, wantPeriod: PeriodDay},
+		{name: "monthly cap", monthlyCap: 0.3, wantPeriod: PeriodMonth},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useConfig(t, func(c *Config) {
+				c.Limits.DailySpendCap = tt.dailyCap
+				c.Limits.MonthlySpendCap = tt.monthlyCap
+			})
+			s, err := NewSpendStore(filepath.Join(t.TempDir(), "spend.db"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer s.Close()
+			for _, client := range []string{"a", "b", "a"} {
+				if err := s.Record("openai/gpt-4o", client, openai.Usage{PromptTokens: 10}, 0.1); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			err = s.CheckCaps()
+			var capErr *SpendCapError
+			if tt.wantPeriod == "" {
+				if err != nil {
+					t.Fatalf("CheckCaps() = %v, want nil", err)
+				}
+			} else if !errors.As(err, &capErr) || capErr.Period != tt.wantPeriod {
+				t.Fatalf("CheckCaps() = %v, want %s cap reached", err, tt.wantPeriod)
+			}
+
+			byClient, err := s.Summary(PeriodDay, "", "client")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(byClient) != 2 || byClient[0].Client != "a" || byClient[0].Requests != 2 || math.Abs(byClient[0].Cost-0.2) > 1e-12 {
+				t.Errorf("spend by client = %+v", byClient)
+			}
+		})
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracer is a no-op until initTracing installs an exporter
+var tracer = otel.Tracer("ollama-openrouter-proxy")
+
+// initTracing configures the OpenTelemetry exporter ("otlp", "console" or
+// "none", the default). The OTLP protocol is "http/protobuf" or "grpc";
+// endpoint, headers and sampling use the standard OTEL_* variables. The
+// returned func flushes spans.
+func initTracing(ctx context.Context, cfg TracingConfig) (func(context.Context) error, error) {
+	// Always accept W3C traceparent from clients so logs can be correlated
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+
+	var exporter sdktrace.SpanExporter
+	var err error
+	switch cfg.Exporter {
+	case "", "none":
+		return func(context.Context) error { return nil }, nil
+	case "otlp":
+		switch cfg.Protocol {
+		case "", "http/protobuf":
+			exporter, err = otlptracehttp.New(ctx)
+		case "grpc":
+			exporter, err = otlptracegrpc.New(ctx)
+		default:
+			return nil, fmt.Errorf("unsupported OTLP protocol %q", cfg.Protocol)
+		}
+	case "console":
+		exporter, err = stdouttrace.New(stdouttrace.WithPrettyPrint())
+	default:
+		return nil, fmt.Errorf("unsupported trace exporter %q", cfg.Exporter)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to create trace exporter: %w", err)
+	}
+
+	res, err := resource.Merge(resource.Default(), resource.NewWithAttributes(semconv.SchemaURL, semconv.ServiceName(cfg.ServiceName)))
+	if err != nil {
+		return nil, err
+	}
+
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+	)
+	otel.SetTracerProvider(tp)
+	tracer = tp.Tracer("ollama-openrouter-proxy")
+	return tp.Shutdown, nil
+}
+
+// endSpan marks the span as failed when err is set and ends it
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		span.SetAttributes(attribute.String("error.category", errorCategory(err)))
+	}
+	span.End()
+}
+
+// tracingMiddleware starts a server span per request, continuing the trace from
+// the client's traceparent header when present
+func tracingMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx := otel.GetTextMapPropagator().Extract(c.Request.Context(), propagation.HeaderCarrier(c.Request.Header))
+		route := c.FullPath()
+		if route == "" {
+			route = "unmatched"
+		}
+		ctx, span := tracer.Start(ctx, c.Request.Method+" "+route,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				semconv.HTTPRequestMethodKey.String(c.Request.Method),
+				semconv.HTTPRoute(route),
+			))
+		defer span.End()
+		c.Request = c.Request.WithContext(ctx)
+
+		c.Next()
+
+		status := c.Writer.Status()
+		span.SetAttributes(semconv.HTTPResponseStatusCode(status))
+		if client := clientFromContext(c.Request.Context()); client != nil {
+			span.SetAttributes(attribute.String("proxy.client", client.Name))
+		}
+		if rec := requestRecordFromContext(c.Request.Context()); rec != nil {
+			rec.mu.Lock()
+			span.SetAttributes(
+				attribute.String("proxy.requested_model", rec.RequestedModel),
+				attribute.String("proxy.resolved_model", rec.ResolvedModel),
+				attribute.Int("proxy.attempts", rec.Attempts),
+			)
+			rec.mu.Unlock()
+		}
+		if status >= 500 {
+			span.SetStatus(codes.Error, strconv.Itoa(status))
+		}
+	}
+}
+
+// startAttemptSpan starts the span for one model attempt of the router
+func startAttemptSpan(ctx context.Context, model string, attempt int) (context.Context, trace.Span) {
+	return tracer.Start(ctx, "router.attempt", trace.WithAttributes(
+		attribute.String("proxy.model", model),
+		attribute.Int("proxy.attempt", attempt),
+	))
+}
+
+// waitRateLimits sleeps in the per-model and global rate limiters under a span
+func waitRateLimits(ctx context.Context, limiter *RateLimiter) {
+	_, span := tracer.Start(ctx, "ratelimit.wait")
+	defer span.End()
+	limiter.Wait()
+	globalRateLimiter.WaitGlobal()
+}
+
+// shouldSkipModel checks the failure store for a model's cooldown under a span
+func shouldSkipModel(ctx context.Context, model string) (bool, error) {
+	_, span := tracer.Start(ctx, "failurestore.should_skip", trace.WithAttributes(attribute.String("proxy.model", model)))
+	skip, err := failureStore.ShouldSkip(model)
+	span.SetAttributes(attribute.Bool("proxy.skip", skip))
+	endSpan(span, err)
+	return skip, err
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+)
+
+// upstreamExtras are fields added to the JSON body of upstream chat requests,
+// for OpenRouter features the OpenAI request type does not have
+type upstreamExtras map[string]json.RawMessage
+
+type upstreamExtrasContextKey struct{}
+
+// withUpstreamExtras attaches the extras to the upstream requests made with ctx
+func withUpstreamExtras(ctx context.Context, extras upstreamExtras) context.Context {
+	if len(extras) == 0 {
+		return ctx
+	}
+	return context.WithValue(ctx, upstreamExtrasContextKey{}, extras)
+}
+
+func upstreamExtrasFromContext(ctx context.Context) upstreamExtras {
+	extras, _ := ctx.Value(upstreamExtrasContextKey{}).(upstreamExtras)
+	return extras
+}
+
+// mergeExtras combines extras; fields of later ones replace earlier ones
+func mergeExtras(layers ...upstreamExtras) upstreamExtras {
+	merged := upstreamExtras{}
+	for _, extras := range layers {
+		for name, value := range extras {
+			merged[name] = value
+		}
+	}
+	return merged
+}
+
+// reservedFields are set by the proxy and cannot be changed by extensions
+var reservedFields = []string{"model", "messages", "stream", "stream_options"}
+
+// compiledExtensions are the configured extensions encoded as JSON
+type compiledExtensions struct {
+	defaults upstreamExtras
+	models   map[string]upstreamExtras
+}
+
+// encodeExtras encodes the fields of one extensions entry
+func encodeExtras(fields map[string]interface{}) (upstreamExtras, error) {
+	extras := make(upstreamExtras, len(fields))
+	for name, value := range fields {
+		if contains(reservedFields, name) {
+			return nil, fmt.Errorf("%s is set by the proxy", name)
+		}
+		raw, err := json.Marshal(value)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		extras[name] = raw
+	}
+	return extras, nil
+}
+
+// compileExtensions encodes the configured extensions
+func compileExtensions(cfg ExtensionsConfig) (*compiledExtensions, error) {
+	defaults, err := encodeExtras(cfg.Default)
+	if err != nil {
+		return nil, err
+	}
+	compiled := &compiledExtensions{defaults: defaults, models: make(map[string]upstreamExtras, len(cfg.Models))}
+	for name, fields := range cfg.Models {
+		if compiled.models[name], err = encodeExtras(fields); err != nil {
+			return nil, err
+		}
+	}
+	return compiled, nil
+}
+
+// configuredExtras returns the configured extensions of a model: the defaults,
+// with the fields of the model's entry, by full ID or display name, replacing them
+func configuredExtras(model string) upstreamExtras {
+	ext := currentConfig().extensions
+	if ext == nil {
+		return nil
+	}
+	perModel, ok := ext.models[model]
+	if !ok {
+		perModel = ext.models[modelDisplayName(model)]
+	}
+	return mergeExtras(ext.defaults, perModel)
+}
+
+// passthroughFields are the OpenRouter request fields clients may set, in the
+// request body or with a header holding the JSON value. They are forwarded
+// unchanged; the body takes precedence.
+var passthroughFields = []struct {
+	name   string
+	header string
+}{
+	{"models", "X-OpenRouter-Models"},
+	{"provider", "X-OpenRouter-Provider"},
+	{"transforms", "X-OpenRouter-Transforms"},
+	{"reasoning", "X-OpenRouter-Reasoning"},
+}
+
+// requestExtras returns the pass-through fields of a client request. In free
+// mode the models array is dropped, as it could name paid models.
+func requestExtras(c *gin.Context) (upstreamExtras, error) {
+	var fields map[string]json.RawMessage
+	if err := c.ShouldBindBodyWith(&fields, binding.JSON); err != nil {
+		return nil, err
+	}
+	extras := upstreamExtras{}
+	for _, field := range passthroughFields {
+		if v, ok := fields[field.name]; ok && string(v) != "null" {
+			extras[field.name] = v
+			continue
+		}
+		if h := c.GetHeader(field.header); h != "" {
+			if !json.Valid([]byte(h)) {
+				return nil, fmt.Errorf("%s must be a JSON value", field.header)
+			}
+			extras[field.name] = json.RawMessage(h)
+		}
+	}
+	if raw, ok := extras["models"]; ok {
+		if freeMode {
+			slog.Debug("ignoring models array in free mode")
+			delete(extras, "models")
+		} else if err := json.Unmarshal(raw, new([]string)); err != nil {
+			return nil, fmt.Errorf("models must be a list of model IDs")
+		}
+	}
+	return extras, nil
+}
+
+// deniedModel returns the first model of the models array the client may not
+// use, or "" if it may use all of them
+func (e upstreamExtras) deniedModel(client *ClientKey) string {
+	var models []string
+	if err := json.Unmarshal(e["models"], &models); err != nil {
+		return ""
+	}
+	for _, m := range models {
+		if !client.AllowsModel(m) {
+			return m
+		}
+	}
+	return ""
+}
+
+// extrasTransport adds extensions to the body of chat completion requests: the
+// configured ones for the requested model, replaced field by field by those of
+// the client request in the context. Fields the proxy sets itself are kept.
+type extrasTransport struct {
+	base http.RoundTripper
+}
+
+func (t *extrasTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Body == nil || !strings.HasSuffix(req.URL.Path, "/chat/completions") {
+		return t.base.RoundTrip(req)
+	}
+
+	body, err := io.ReadAll(req.Body)
+	req.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(body, &fields); err != nil {
+		return nil, fmt.Errorf("failed to add request extensions: %w", err)
+	}
+	var model string
+	_ = json.Unmarshal(fields["model"], &model)
+	extras := mergeExtras(configuredExtras(model), upstreamExtrasFromContext(req.Context()))
+	for name, value := range extras {
+		if _, set := fields[name]; !set {
+			fields[name] = value
+		}
+	}
+	if body, err = json.Marshal(fields); err != nil {
+		return nil, fmt.Errorf("failed to add request extensions: %w", err)
+	}
+
+	req = req.Clone(req.Context())
+	req.Body = io.NopCloser(bytes.NewReader(body))
+	req.GetBody = func() (io.ReadCloser, error) { return io.NopCloser(bytes.NewReader(body)), nil }
+	req.ContentLength = int64(len(body))
+	return t.base.RoundTrip(req)
+}
@@ -0,0 +1,346 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sashabaranov/go-openai"
+)
+
+// Accounting periods for per-client usage
+const (
+	PeriodMinute = "minute"
+	PeriodDay    = "day"
+	PeriodMonth  = "month"
+)
+
+// ClientLimits are per-client caps; zero means unlimited
+type ClientLimits struct {
+	RequestsPerMinute int64   `json:"requests_per_minute,omitempty"`
+	RequestsPerDay    int64   `json:"requests_per_day,omitempty"`
+	RequestsPerMonth  int64   `json:"requests_per_month,omitempty"`
+	TokensPerDay      int64   `json:"tokens_per_day,omitempty"`
+	TokensPerMonth    int64   `json:"tokens_per_month,omitempty"`
+	CostPerDay        float64 `json:"cost_per_day,omitempty"`
+	CostPerMonth      float64 `json:"cost_per_month,omitempty"`
+}
+
+// ClientUsage is the consumption of one client in one period bucket
+type ClientUsage struct {
+	Client           string        `json:"client"`
+	Period           string        `json:"period"`
+	Bucket           string        `json:"bucket"`
+	Requests         int64         `json:"requests"`
+	PromptTokens     int64         `json:"prompt_tokens"`
+	CompletionTokens int64         `json:"completion_tokens"`
+	Cost             float64       `json:"cost"`
+	Limits           *ClientLimits `json:"limits,omitempty"`
+}
+
+// ClientLimitError is returned when a client has used up one of its limits
+type ClientLimitError struct {
+	Client  string
+	Metric  string // "requests", "tokens" or "cost"
+	Period  string
+	Used    float64
+	Limit   float64
+	ResetAt time.Time
+}
+
+func (e *ClientLimitError) Error() string {
+	return fmt.Sprintf("client %q exceeded its %s per %s limit (%g/%g), resets at %s",
+		e.Client, e.Metric, e.Period, e.Used, e.Limit, e.ResetAt.UTC().Format(time.RFC3339))
+}
+
+// UsageStore keeps per-client request, token and cost counters in SQLite
+type UsageStore struct {
+	db *sql.DB
+}
+
+func NewUsageStore(path string) (*UsageStore, error) {
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = db.Exec(`CREATE TABLE IF NOT EXISTS client_usage (
+		client TEXT NOT NULL,
+		period TEXT NOT NULL,
+		bucket TEXT NOT NULL,
+		requests INTEGER DEFAULT 0,
+		prompt_tokens INTEGER DEFAULT 0,
+		completion_tokens INTEGER DEFAULT 0,
+		cost REAL DEFAULT 0,
+		PRIMARY KEY (client, period, bucket)
+	)`); err != nil {
+		db.Close()
+		return nil, err
+	}
+	if _, err = db.Exec(`CREATE TABLE IF NOT EXISTS client_limits (
+		client TEXT PRIMARY KEY,
+		requests_per_minute INTEGER DEFAULT 0,
+		requests_per_day INTEGER DEFAULT 0,
+		requests_per_month INTEGER DEFAULT 0,
+		tokens_per_day INTEGER DEFAULT 0,
+		tokens_per_month INTEGER DEFAULT 0,
+		cost_per_day REAL DEFAULT 0,
+		cost_per_month REAL DEFAULT 0
+	)`); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &UsageStore{db: db}, nil
+}
+
+func (s *UsageStore) Close() error { return s.db.Close() }
+
+// usageBucket returns the bucket key and the time the bucket ends
+func usageBucket(period string, t time.Time) (string, time.Time) {
+	t = t.UTC()
+	switch period {
+	case PeriodMinute:
+		start := t.Truncate(time.Minute)
+		return start.Format("2006-01-02T15:04"), start.Add(time.Minute)
+	case PeriodMonth:
+		y, m, _ := t.Date()
+		return t.Format("2006-01"), time.Date(y, m+1, 1, 0, 0, 0, 0, time.UTC)
+	default:
+		return quotaDay(t), nextQuotaReset(t)
+	}
+}
+
+// Record adds one completed request to every period bucket of the client
+func (s *UsageStore) Record(client string, usage openai.Usage, cost float64) error {
+	now := time.Now()
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, period := range []string{PeriodMinute, PeriodDay, PeriodMonth} {
+		bucket, _ := usageBucket(period, now)
+		if _, err := tx.Exec(`
+			INSERT INTO client_usage(client, period, bucket, requests, prompt_tokens, completion_tokens, cost)
+			VALUES(?, ?, ?, 1, ?, ?, ?)
+			ON CONFLICT(client, period, bucket) DO UPDATE SET
+				requests=requests+1,
+				prompt_tokens=prompt_tokens+excluded.prompt_tokens,
+				completion_tokens=completion_tokens+excluded.completion_tokens,
+				cost=cost+excluded.cost
+		`, client, period, bucket, usage.PromptTokens, usage.CompletionTokens, cost); err != nil {
+			return err
+		}
+	}
+
+	// Minute buckets are only needed for the per-minute limit
+	oldest, _ := usageBucket(PeriodMinute, now.Add(-time.Hour))
+	if _, err := tx.Exec(`DELETE FROM client_usage WHERE client=? AND period=? AND bucket<?`, client, PeriodMinute, oldest); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *UsageStore) usage(client, period string, now time.Time) (ClientUsage, time.Time, error) {
+	bucket, resetAt := usageBucket(period, now)
+	u := ClientUsage{Client: client, Period: period, Bucket: bucket}
+	err := s.db.QueryRow(`SELECT requests, prompt_tokens, completion_tokens, cost FROM client_usage WHERE client=? AND period=? AND bucket=?`,
+		client, period, bucket).Scan(&u.Requests, &u.PromptTokens, &u.CompletionTokens, &u.Cost)
+	if err == sql.ErrNoRows {
+		err = nil
+	}
+	return u, resetAt, err
+}
+
+// Limits returns the limits configured for a client, or nil if it has none
+func (s *UsageStore) Limits(client string) (*ClientLimits, error) {
+	var l ClientLimits
+	err := s.db.QueryRow(`SELECT requests_per_minute, requests_per_day, requests_per_month, tokens_per_day, tokens_per_month, cost_per_day, cost_per_month FROM client_limits WHERE client=?`, client).
+		Scan(&l.RequestsPerMinute, &l.RequestsPerDay, &l.RequestsPerMonth, &l.TokensPerDay, &l.TokensPerMonth, &l.CostPerDay, &l.CostPerMonth)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &l, nil
+}
+
+// SetLimits replaces the limits of a client
+func (s *UsageStore) SetLimits(client string, l ClientLimits) error {
+	_, err := s.db.Exec(`
+		INSERT INTO client_limits(client, requests_per_minute, requests_per_day, requests_per_month, tokens_per_day, tokens_per_month, cost_per_day, cost_per_month)
+		VALUES(?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT(client) DO UPDATE SET
+			requests_per_minute=excluded.requests_per_minute,
+			requests_per_day=excluded.requests_per_day,
+			requests_per_month=excluded.requests_per_month,
+			tokens_per_day=excluded.tokens_per_day,
+			tokens_per_month=excluded.tokens_per_month,
+			cost_per_day=excluded.cost_per_day,
+			cost_per_month=excluded.cost_per_month
+	`, client, l.RequestsPerMinute, l.RequestsPerDay, l.RequestsPerMonth, l.TokensPerDay, l.TokensPerMonth, l.CostPerDay, l.CostPerMonth)
+	return err
+}
+
+// Check returns a *ClientLimitError if the client has used up any of its limits
+func (s *UsageStore) Check(client string) error {
+	limits, err := s.Limits(client)
+	if err != nil || limits == nil {
+		return err
+	}
+
+	now := time.Now()
+	checks := []struct {
+		period string
+		limits [3]float64 // requests, tokens, cost
+	}{
+		{PeriodMinute, [3]float64{float64(limits.RequestsPerMinute), 0, 0}},
+		{PeriodDay, [3]float64{float64(limits.RequestsPerDay), float64(limits.TokensPerDay), limits.CostPerDay}},
+		{PeriodMonth, [3]float64{float64(limits.RequestsPerMonth), float64(limits.TokensPerMonth), limits.CostPerMonth}},
+	}
+	for _, check := range checks {
+		if check.limits == [3]float64{} {
+			continue
+		}
+		u, resetAt, err := s.usage(client, check.period, now)
+		if err != nil {
+			return err
+		}
+		used := [3]float64{float64(u.Requests), float64(u.PromptTokens + u.CompletionTokens), u.Cost}
+		for i, metric := range []string{"requests", "tokens", "cost"} {
+			if check.limits[i] > 0 && used[i] >= check.limits[i] {
+				return &ClientLimitError{Client: client, Metric: metric, Period: check.period, Used: used[i], Limit: check.limits[i], ResetAt: resetAt}
+			}
+		}
+	}
+	return nil
+}
+
+// Summary returns the usage of every client (or just one) in the given period bucket
+func (s *UsageStore) Summary(client, period, bucket string) ([]ClientUsage, error) {
+	if bucket == "" {
+		bucket, _ = usageBucket(period, time.Now())
+	}
+	query := `SELECT client, requests, prompt_tokens, completion_tokens, cost FROM client_usage WHERE period=? AND bucket=?`
+	args := []any{period, bucket}
+	if client != "" {
+		query += ` AND client=?`
+		args = append(args, client)
+	}
+	rows, err := s.db.Query(query+` ORDER BY client`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result []ClientUsage
+	for rows.Next() {
+		u := ClientUsage{Period: period, Bucket: bucket}
+		if err := rows.Scan(&u.Client, &u.Requests, &u.PromptTokens, &u.CompletionTokens, &u.Cost); err != nil {
+			return nil, err
+		}
+		result = append(result, u)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	for i := range result {
+		if result[i].Limits, err = s.Limits(result[i].Client); err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+// usageMiddleware enforces per-client limits before a chat request and records
+// its usage afterwards. Handlers report token usage with c.Set("usage", openai.Usage).
+func usageMiddleware(store *UsageStore) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		client := clientFromContext(c.Request.Context()).ClientName()
+		if err := store.Check(client); err != nil {
+			recordError(c.Request.Context(), err)
+			if limitErr, ok := err.(*ClientLimitError); ok {
+				respondClientLimitExceeded(c, limitErr)
+				return
+			}
+			respondError(c, http.StatusInternalServerError, "server_error", "failed to check client limits")
+			return
+		}
+
+		c.Next()
+
+		if c.Writer.Status() >= http.StatusBadRequest {
+			return
+		}
+		value, _ := c.Get("usage")
+		usage, _ := value.(openai.Usage)
+		if err := store.Record(client, usage, c.GetFloat64("cost")); err != nil {
+			slog.Error("failed to record client usage", "client", client, "error", err)
+		}
+	}
+}
+
+// respondClientLimitExceeded writes a 429 in the error shape of the calling API
+func respondClientLimitExceeded(c *gin.Context, err *ClientLimitError) {
+	retryAfter := int(time.Until(err.ResetAt).Seconds()) + 1
+	c.Header("Retry-After", strconv.Itoa(retryAfter))
+	c.Header("X-RateLimit-Limit", strconv.FormatFloat(err.Limit, 'f', -1, 64))
+	c.Header("X-RateLimit-Remaining", "0")
+	c.Header("X-RateLimit-Reset", strconv.FormatInt(err.ResetAt.Unix(), 10))
+	if isOpenAIPath(c.Request.URL.Path) {
+		c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{"error": gin.H{
+			"message": err.Error(),
+			"type":    "rate_limit_exceeded",
+			"code":    "client_quota_exceeded",
+		}})
+		return
+	}
+	c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{"error": err.Error()})
+}
+
+// registerUsageRoutes adds the usage query and limit endpoints to the admin API
+func registerUsageRoutes(admin *gin.RouterGroup, store *UsageStore) {
+	admin.GET("/usage", func(c *gin.Context) {
+		period := c.DefaultQuery("period", PeriodDay)
+		if period != PeriodMinute && period != PeriodDay && period != PeriodMonth {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "period must be minute, day or month"})
+			return
+		}
+		usage, err := store.Summary(c.Query("client"), period, c.Query("bucket"))
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"usage": usage})
+	})
+
+	admin.GET("/keys/:name/limits", func(c *gin.Context) {
+		limits, err := store.Limits(c.Param("name"))
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if limits == nil {
+			limits = &ClientLimits{}
+		}
+		c.JSON(http.StatusOK, limits)
+	})
+
+	admin.PUT("/keys/:name/limits", func(c *gin.Context) {
+		var limits ClientLimits
+		if err := c.ShouldBindJSON(&limits); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid JSON payload: " + err.Error()})
+			return
+		}
+		if err := store.SetLimits(c.Param("name"), limits); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, limits)
+	})
+}
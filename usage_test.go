@@ -0,0 +1,123 @@
+package main
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/sashabaranov/go-openai"
+)
+
+func newTestUsageStore(t *testing.T) *UsageStore {
+	t.Helper()
+	s, err := NewUsageStore(filepath.Join(t.TempDir(), "usage.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func TestUsageBucket(t *testing.T) {
+	at := time.Date(2026, 12, 31, 23, 59, 30, 0, time.UTC)
+	tests := []struct {
+		period     string
+		wantBucket string
+		wantEnd    time.Time
+	}{
+		{PeriodMinute, "2026-12-31T23:59", time.Date(2027, 1, 1, 0, 0, 0, 0, time.UTC)},
+		{PeriodDay, "2026-12-31", time.Date(2027, 1, 1, 0, 0, 0, 0, time.UTC)},
+		{PeriodMonth, "2026-12", time.Date(2027, 1, 1, 0, 0, 0, 0, time.UTC)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.period, func(t *testing.T) {
+			bucket, end := usageBucket(tt.period, at)
+			if bucket != tt.wantBucket || !end.Equal(tt.wantEnd) {
+				t.Errorf("usageBucket() = %s, %v, want %s, %v", bucket, end, tt.wantBucket, tt.wantEnd)
+			}
+		})
+	}
+}
+
+func TestUsageStoreCheck(t *testing.T) {
+	usage := openai.Usage{PromptTokens: 60, CompletionTokens: 40}
+	tests := []struct {
+		name       string
+		limits     *ClientLimits
+		requests   int
+		wantMetric string // "" when the client is within its limits
+		wantPeriod string
+	}{
+		{name: "no limits", requests: 5},
+		{name: "within limits", limits: &ClientLimits{RequestsPerDay: 3, TokensPerDay: 1000, CostPerDay: 1}, requests: 2},
+		{name: "requests per minute", limits: &ClientLimits{RequestsPerMinute: 2}, requests: 2, wantMetric: "requests", wantPeriod: PeriodMinute},
+		{name: "tokens per day", limits: &ClientLimits{TokensPerDay: 200}, requests: 2, wantMetric: "tokens", wantPeriod: PeriodDay},
+		{name: "cost per month", limits: &ClientLimits{CostPerMonth: 0.02}, requests: 2, wantMetric: "cost", wantPeriod: PeriodMonth},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestUsageStore(t)
+			if tt.limits != nil {
+				if err := s.SetLimits("ci", *tt.limits); err != nil {
+					t.Fatal(err)
+				}
+			}
+			for i := 0; i < tt.requests; i++ {
+				if err := s.Record("ci", usage, 0.01); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			err := s.Check("ci")
+			if tt.wantMetric == "" {
+				if err != nil {
+					t.Fatalf("Check() = %v, want nil", err)
+				}
+				return
+			}
+			var limitErr *ClientLimitError
+			if !errors.As(err, &limitErr) || limitErr.Metric != tt.wantMetric || limitErr.Period != tt.wantPeriod {
+				t.Fatalf("Check() = %v, want %s per %s exceeded", err, tt.wantMetric, tt.wantPeriod)
+			}
+			if err := s.Check("other"); err != nil {
+				t.Errorf("other client limited: %v", err)
+			}
+		})
+	}
+}
+
+func TestUsageStoreSummary(t *testing.T) {
+	s := newTestUsageStore(t)
+	for _, client := range []string{"b", "a", "b"} {
+		if err := s.Record(client, openai.Usage{PromptTokens: 10, CompletionTokens: 5}, 0.5); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.SetLimits("b", ClientLimits{RequestsPerDay: 10}); err != nil {
+		t.Fatal(err)
+	}
+
+	all, err := s.Summary("", PeriodDay, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all) != 2 || all[0].Client != "a" || all[1].Client != "b" {
+		t.Fatalf("Summary() = %+v, want clients a and b", all)
+	}
+	b := all[1]
+	if b.Requests != 2 || b.PromptTokens != 20 || b.CompletionTokens != 10 || b.Cost != 1 || b.Limits == nil {
+		t.Errorf("usage of b = %+v", b)
+	}
+	if all[0].Limits != nil {
+		t.Errorf("client without limits has %+v", all[0].Limits)
+	}
+
+	one, err := s.Summary("a", PeriodMonth, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(one) != 1 || one[0].Requests != 1 {
+		t.Errorf("Summary(a) = %+v", one)
+	}
+}
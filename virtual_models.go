@@ -0,0 +1,98 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// defaultVirtualModels are the router models available without configuration.
+// Each maps to model filter rules that restrict free-mode fallback.
+func defaultVirtualModels() map[string][]string {
+	return map[string][]string{
+		"free-auto":   {},
+		"free-tools":  {"has:tools"},
+		"free-vision": {"has:vision"},
+		"free-long":   {"context>=100000"},
+	}
+}
+
+// compileVirtualModels parses the rules of every virtual model
+func compileVirtualModels(models map[string][]string) (map[string]*ModelFilter, error) {
+	compiled := make(map[string]*ModelFilter, len(models))
+	for name, rules := range models {
+		f, err := parseModelFilter(strings.NewReader(strings.Join(rules, "\n")))
+		if err != nil {
+			return nil, err
+		}
+		compiled[name] = f
+	}
+	return compiled, nil
+}
+
+// lookupVirtualModel returns the routing policy of a virtual model. Like
+// aliases, the ":latest" tag is ignored. Virtual models only exist in free mode.
+func lookupVirtualModel(name string) (*ModelFilter, bool) {
+	if !freeMode {
+		return nil, false
+	}
+	virtual := currentConfig().virtualModels
+	if policy, ok := virtual[name]; ok {
+		return policy, true
+	}
+	policy, ok := virtual[strings.TrimSuffix(name, ":latest")]
+	return policy, ok
+}
+
+// listedVirtualModels returns the names of the virtual models, sorted
+func listedVirtualModels() []string {
+	if !freeMode {
+		return nil
+	}
+	var names []string
+	for name := range currentConfig().virtualModels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// virtualModelTags returns the /api/tags entries of the virtual models
+func virtualModelTags() []map[string]interface{} {
+	currentTime := time.Now().Format(time.RFC3339)
+	var tags []map[string]interface{}
+	for _, name := range listedVirtualModels() {
+		tags = append(tags, map[string]interface{}{
+			"name":        name,
+			"model":       name,
+			"modified_at": currentTime,
+			"size":        270898672,
+			"digest":      "9077fe9d2ae1a4a41a868836b56b8163731a8fe16621397028c2c76f838c6907",
+			"details": map[string]interface{}{
+				"parent_model":       "",
+				"format":             "gguf",
+				"family":             "virtual",
+				"families":           []string{"virtual"},
+				"parameter_size":     "varies",
+				"quantization_level": "Q4_K_M",
+			},
+		})
+	}
+	return tags
+}
+
+// virtualModelEntries returns the /v1/models entries of the virtual models
+func virtualModelEntries() []gin.H {
+	var models []gin.H
+	for _, name := range listedVirtualModels() {
+		models = append(models, gin.H{
+			"id":       name,
+			"object":   "model",
+			"created":  time.Now().Unix(),
+			"owned_by": "openrouter",
+		})
+	}
+	return models
+}
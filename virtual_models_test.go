@@ -0,0 +1,100 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+// useFreeMode switches free mode on or off for the test
+func useFreeMode(t *testing.T, on bool) {
+	t.Helper()
+	prev := freeMode
+	freeMode = on
+	t.Cleanup(func() { freeMode = prev })
+}
+
+// useVirtualModels makes the given virtual models current for the test
+func useVirtualModels(t *testing.T, models map[string][]string) {
+	t.Helper()
+	compiled, err := compileVirtualModels(models)
+	if err != nil {
+		t.Fatal(err)
+	}
+	useConfig(t, func(c *Config) {
+		c.VirtualModels = models
+		c.virtualModels = compiled
+	})
+}
+
+func TestDefaultVirtualModels(t *testing.T) {
+	models := []ModelRecord{
+		{ID: "a/tools:free", ContextLength: 32000, SupportedParameters: []string{"tools"}},
+		{ID: "b/vision:free", ContextLength: 8000, InputModalities: []string{"text", "image"}},
+		{ID: "c/long:free", ContextLength: 128000},
+	}
+	compiled, err := compileVirtualModels(defaultVirtualModels())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string][]string{
+		"free-auto":   {"a/tools:free", "b/vision:free", "c/long:free"},
+		"free-tools":  {"a/tools:free"},
+		"free-vision": {"b/vision:free"},
+		"free-long":   {"c/long:free"},
+	}
+	if len(compiled) != len(want) {
+		t.Errorf("got %d default virtual models, want %d", len(compiled), len(want))
+	}
+	for name, wantIDs := range want {
+		t.Run(name, func(t *testing.T) {
+			var got []string
+			for _, m := range models {
+				if compiled[name].AllowsRecord(m) {
+					got = append(got, m.ID)
+				}
+			}
+			if !reflect.DeepEqual(got, wantIDs) {
+				t.Errorf("%s routes to %v, want %v", name, got, wantIDs)
+			}
+		})
+	}
+}
+
+func TestCompileVirtualModelsInvalid(t *testing.T) {
+	if _, err := compileVirtualModels(map[string][]string{"bad": {"has:magic"}}); err == nil {
+		t.Error("compileVirtualModels() accepted an unknown predicate")
+	}
+}
+
+func TestLookupVirtualModel(t *testing.T) {
+	useVirtualModels(t, map[string][]string{"free-tools": {"has:tools"}, "cheap": {"is:free"}})
+	tests := []struct {
+		name      string
+		free      bool
+		requested string
+		found     bool
+	}{
+		{name: "virtual model", free: true, requested: "free-tools", found: true},
+		{name: "latest tag", free: true, requested: "cheap:latest", found: true},
+		{name: "regular model", free: true, requested: "openai/gpt-4o"},
+		{name: "paid mode", free: false, requested: "free-tools"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useFreeMode(t, tt.free)
+			policy, ok := lookupVirtualModel(tt.requested)
+			if ok != tt.found || (ok && policy == nil) {
+				t.Errorf("lookupVirtualModel(%q) = %v, %v, want found %v", tt.requested, policy, ok, tt.found)
+			}
+		})
+	}
+
+	useFreeMode(t, true)
+	if got := listedVirtualModels(); !reflect.DeepEqual(got, []string{"cheap", "free-tools"}) {
+		t.Errorf("listedVirtualModels() = %v, want sorted names", got)
+	}
+	useFreeMode(t, false)
+	if got := listedVirtualModels(); got != nil {
+		t.Errorf("listedVirtualModels() in paid mode = %v, want none", got)
+	}
+}